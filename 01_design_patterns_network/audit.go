@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+// Kinds of audit entries.
+const (
+	// AuditAttempt is a single call to a device, one per retry.
+	AuditAttempt = "attempt"
+	// AuditOperation summarises a whole network operation on a device.
+	AuditOperation = "operation"
+)
+
+// AuditEntry is one record in the audit trail.
+type AuditEntry struct {
+	Kind        string `json:"kind"`
+	OperationID string `json:"operation_id"`
+	Operator    string `json:"operator"`
+	IPAddress   string `json:"ip_address"`
+	Hostname    string `json:"hostname,omitempty"`
+	Stage       Stage  `json:"stage,omitempty"`
+	Attempt     int    `json:"attempt"`
+	Success     bool   `json:"success"`
+	Error       string `json:"error,omitempty"`
+	// ConfigHash is the SHA-256 of the whole rendered configuration.
+	ConfigHash string `json:"config_hash,omitempty"`
+	// DiffHash is the SHA-256 of the unified diff from the previously applied
+	// configuration, or from an empty one if none is recorded, to the rendered one.
+	DiffHash   string    `json:"diff_hash,omitempty"`
+	Override   string    `json:"override,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// AuditQuery filters audit entries. Zero fields match everything.
+type AuditQuery struct {
+	IPAddress   string
+	OperationID string
+	From        time.Time
+	To          time.Time
+}
+
+func (q AuditQuery) matches(e AuditEntry) bool {
+	return (q.IPAddress == "" || e.IPAddress == q.IPAddress) &&
+		(q.OperationID == "" || e.OperationID == q.OperationID) &&
+		(q.From.IsZero() || !e.StartedAt.Before(q.From)) &&
+		(q.To.IsZero() || e.StartedAt.Before(q.To))
+}
+
+// AuditLog stores the audit trail of network operations.
+type AuditLog interface {
+	Record(entry AuditEntry) error
+	Query(q AuditQuery) ([]AuditEntry, error)
+}
+
+// JSONLinesAuditLog is an append-only AuditLog writing one JSON object per line.
+type JSONLinesAuditLog struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewJSONLinesAuditLog is a constructor for the JSONLinesAuditLog struct.
+func NewJSONLinesAuditLog(path string) *JSONLinesAuditLog {
+	return &JSONLinesAuditLog{path: path}
+}
+
+// Record appends an entry and syncs it to disk.
+func (a *JSONLinesAuditLog) Record(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return f.Sync()
+}
+
+// Query returns the matching entries in the order they were recorded.
+func (a *JSONLinesAuditLog) Query(q AuditQuery) ([]AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("audit log line %d: %w", line, err)
+		}
+		if q.matches(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// WithAuditLog returns a copy of the handler that records every operation, and
+// every attempt within it, to the audit log. Failing to write the audit log is
+// logged but doesn't stop the change.
+func (n NetworkHandler) WithAuditLog(auditLog AuditLog) NetworkHandler {
+	n.auditLog = auditLog
+	return n
+}
+
+type operatorKey struct{}
+
+// WithOperator returns a context that attributes the operations run with it to operator.
+func WithOperator(ctx context.Context, operator string) context.Context {
+	return context.WithValue(ctx, operatorKey{}, operator)
+}
+
+// OperatorFromContext returns the operator set with WithOperator, falling back to
+// the user running the process.
+func OperatorFromContext(ctx context.Context) string {
+	if operator, ok := ctx.Value(operatorKey{}).(string); ok && operator != "" {
+		return operator
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown"
+}
+
+// operation is the state of one network operation on a device, carried in its context.
+type operation struct {
+	id         string
+	operator   string
+	device     Device
+	configHash string
+	diffHash   string
+	override   string
+	// fencingToken is the token of the device lock, zero if none is held.
+	fencingToken int64
+	startedAt    time.Time
+	attempts     map[Stage]int
+}
+
+type operationKey struct{}
+
+// startOperation creates the state for a new operation and attaches it to ctx.
+func startOperation(ctx context.Context, device Device) (context.Context, *operation) {
+	op := &operation{
+		id:        newOperationID(),
+		operator:  OperatorFromContext(ctx),
+		device:    device,
+		startedAt: time.Now(),
+		attempts:  make(map[Stage]int),
+	}
+	return context.WithValue(ctx, operationKey{}, op), op
+}
+
+func operationFromContext(ctx context.Context) *operation {
+	op, _ := ctx.Value(operationKey{}).(*operation)
+	return op
+}
+
+// attempt wraps a call to a device so that every call, retries included, is audited.
+func (n NetworkHandler) attempt(ctx context.Context, stage Stage, f func() error) func() error {
+	return func() error {
+		op := operationFromContext(ctx)
+		if n.auditLog == nil || op == nil {
+			return f()
+		}
+
+		op.attempts[stage]++
+		startedAt := time.Now()
+		err := f()
+
+		entry := op.entry(AuditAttempt, startedAt)
+		entry.Stage = stage
+		entry.Attempt = op.attempts[stage]
+		entry.Success = err == nil
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		n.record(entry)
+		return err
+	}
+}
+
+// finishOperation records the summary entry of an operation.
+func (n NetworkHandler) finishOperation(op *operation, result DeviceResult) {
+	if n.auditLog == nil {
+		return
+	}
+
+	entry := op.entry(AuditOperation, op.startedAt)
+	entry.Stage = result.FailedStage
+	entry.Attempt = result.Attempts
+	entry.Success = result.Success
+	if result.Err != nil {
+		entry.Error = result.Err.Error()
+	}
+	n.record(entry)
+}
+
+func (n NetworkHandler) record(entry AuditEntry) {
+	if err := n.auditLog.Record(entry); err != nil {
+		log.Printf("failed to record audit entry for device %s: %v", entry.IPAddress, err)
+	}
+}
+
+func (op *operation) entry(kind string, startedAt time.Time) AuditEntry {
+	return AuditEntry{
+		Kind:        kind,
+		OperationID: op.id,
+		Operator:    op.operator,
+		IPAddress:   op.device.IPAddress,
+		Hostname:    op.device.Hostname,
+		ConfigHash:  op.configHash,
+		DiffHash:    op.diffHash,
+		Override:    op.override,
+		StartedAt:   startedAt,
+		FinishedAt:  time.Now(),
+	}
+}
+
+// configHash identifies a rendered configuration, or a diff, in the audit trail
+// without storing it.
+func configHash(config string) string {
+	sum := sha256.Sum256([]byte(config))
+	return hex.EncodeToString(sum[:])
+}
+
+func newOperationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// transientOnceConfigurationClient fails the first call to each device with a transient error.
+type transientOnceConfigurationClient struct {
+	calls map[string]int
+}
+
+func (c *transientOnceConfigurationClient) ConfigureDevice(d Device, config string) error {
+	c.calls[d.IPAddress]++
+	if c.calls[d.IPAddress] == 1 {
+		return Transient(errors.New("connection reset"))
+	}
+	return nil
+}
+
+// missingDeviceRepository knows no devices.
+type missingDeviceRepository struct{}
+
+func (missingDeviceRepository) GetDevice(ipAddress string) (Device, error) {
+	return Device{}, fmt.Errorf("%w: %s", ErrDeviceNotFound, ipAddress)
+}
+
+func TestAuditLog(t *testing.T) {
+	auditLog := NewJSONLinesAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"))
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	handler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, &transientOnceConfigurationClient{calls: map[string]int{}}, MockMonitoringClient{}, policy).
+		WithAuditLog(auditLog)
+	ctx := WithOperator(context.Background(), "alice")
+
+	before := time.Now()
+	result := handler.performOperation(ctx, "10.0.0.1")
+	assert.True(t, result.Success)
+	assert.NotEmpty(t, result.OperationID)
+	assert.NoError(t, handler.PerformNetworkOperation(ctx, "10.0.0.2"))
+
+	t.Run("records every attempt and a summary", func(t *testing.T) {
+		entries, err := auditLog.Query(AuditQuery{OperationID: result.OperationID})
+		assert.NoError(t, err)
+		if !assert.Len(t, entries, 4) {
+			return
+		}
+
+		assert.Equal(t, AuditAttempt, entries[0].Kind)
+		assert.Equal(t, StageConfigure, entries[0].Stage)
+		assert.Equal(t, 1, entries[0].Attempt)
+		assert.False(t, entries[0].Success)
+		assert.Contains(t, entries[0].Error, "connection reset")
+
+		assert.Equal(t, StageConfigure, entries[1].Stage)
+		assert.Equal(t, 2, entries[1].Attempt)
+		assert.True(t, entries[1].Success)
+
+		assert.Equal(t, StageMonitor, entries[2].Stage)
+
+		summary := entries[3]
+		assert.Equal(t, AuditOperation, summary.Kind)
+		assert.True(t, summary.Success)
+		assert.Equal(t, 3, summary.Attempt)
+		assert.Equal(t, configHash("hostname 10.0.0.1\n"), summary.ConfigHash)
+		assert.Equal(t, configHash(unifiedDiff("intended", "rendered", "", "hostname 10.0.0.1\n")), summary.DiffHash)
+		for _, e := range entries {
+			assert.Equal(t, "alice", e.Operator)
+			assert.Equal(t, "10.0.0.1", e.IPAddress)
+		}
+	})
+
+	t.Run("queries by device and time range", func(t *testing.T) {
+		entries, err := auditLog.Query(AuditQuery{IPAddress: "10.0.0.2"})
+		assert.NoError(t, err)
+		assert.Len(t, entries, 4)
+
+		entries, err = auditLog.Query(AuditQuery{From: before, To: time.Now()})
+		assert.NoError(t, err)
+		assert.Len(t, entries, 8)
+
+		entries, err = auditLog.Query(AuditQuery{From: time.Now()})
+		assert.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("hashes the diff from the previously applied configuration", func(t *testing.T) {
+		intents := NewMemoryIntentStore()
+		assert.NoError(t, intents.SaveIntent("10.0.0.3", "hostname old\n"))
+		handler := handler.WithIntentStore(intents)
+
+		result := handler.performOperation(ctx, "10.0.0.3")
+		assert.True(t, result.Success)
+		entries, err := auditLog.Query(AuditQuery{OperationID: result.OperationID})
+		assert.NoError(t, err)
+		summary := entries[len(entries)-1]
+		assert.Equal(t, configHash(unifiedDiff("intended", "rendered", "hostname old\n", "hostname 10.0.0.3\n")), summary.DiffHash)
+		assert.Equal(t, configHash("hostname 10.0.0.3\n"), summary.ConfigHash)
+	})
+
+	t.Run("records failed lookups", func(t *testing.T) {
+		handler := NewNetworkHandler(missingDeviceRepository{}, MockConfigRenderer{}, MockConfigurationClient{}, MockMonitoringClient{}, policy).
+			WithAuditLog(auditLog)
+
+		result := handler.performOperation(ctx, "10.0.0.9")
+		assert.ErrorIs(t, result.Err, ErrDeviceNotFound)
+		assert.NotEmpty(t, result.OperationID)
+
+		entries, err := auditLog.Query(AuditQuery{OperationID: result.OperationID})
+		assert.NoError(t, err)
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, AuditOperation, entries[0].Kind)
+			assert.Equal(t, StageLookup, entries[0].Stage)
+			assert.Equal(t, "10.0.0.9", entries[0].IPAddress)
+			assert.False(t, entries[0].Success)
+		}
+	})
+}
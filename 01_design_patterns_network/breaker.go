@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling the device while its circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// BreakerState is the state of a device's circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets every call through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails every call straight away until the cool-down has passed.
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe call through to find out if the device has recovered.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("BreakerState(%d)", int(s))
+	}
+}
+
+// BreakerSettings configures every breaker of a CircuitBreakers.
+type BreakerSettings struct {
+	// FailureThreshold is the number of consecutive failures that opens the breaker.
+	FailureThreshold int
+	// CoolDown is how long the breaker stays open before a probe call is let through.
+	CoolDown time.Duration
+}
+
+// BreakerStateChange is reported whenever a device's breaker changes state.
+type BreakerStateChange struct {
+	IPAddress string
+	From      BreakerState
+	To        BreakerState
+	At        time.Time
+	// Err is the failure that opened the breaker, if any.
+	Err error
+}
+
+type breaker struct {
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// CircuitBreakers keeps one circuit breaker per device, keyed by IP address.
+// Configuration and monitoring calls to the same device share a breaker.
+//
+// Only errors that aren't permanent count as failures: a device that rejects our
+// credentials is reachable, and tripping its breaker wouldn't help.
+type CircuitBreakers struct {
+	settings      BreakerSettings
+	onStateChange func(BreakerStateChange)
+	now           func() time.Time
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+// NewCircuitBreakers is a constructor for the CircuitBreakers struct.
+// onStateChange may be nil. It is called synchronously by the call that changed the
+// state, after the breakers are unlocked, so it may call State or OpenDevices; it
+// should not block.
+func NewCircuitBreakers(settings BreakerSettings, onStateChange func(BreakerStateChange)) *CircuitBreakers {
+	if settings.FailureThreshold < 1 {
+		settings.FailureThreshold = 1
+	}
+	return &CircuitBreakers{
+		settings:      settings,
+		onStateChange: onStateChange,
+		now:           time.Now,
+		breakers:      make(map[string]*breaker),
+	}
+}
+
+// Call runs f unless the device's breaker is open, and records the outcome.
+// An open breaker returns a permanent error wrapping ErrCircuitOpen, so retries stop straight away.
+func (c *CircuitBreakers) Call(ipAddress string, f func() error) error {
+	change, err := c.before(ipAddress)
+	c.notify(change)
+	if err != nil {
+		return err
+	}
+	err = f()
+	c.notify(c.after(ipAddress, err))
+	return err
+}
+
+// State returns the current state of a device's breaker.
+func (c *CircuitBreakers) State(ipAddress string) BreakerState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if b, ok := c.breakers[ipAddress]; ok {
+		return b.state
+	}
+	return BreakerClosed
+}
+
+// OpenDevices returns the IP addresses of devices whose breaker is open or half-open, sorted.
+func (c *CircuitBreakers) OpenDevices() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var open []string
+	for ip, b := range c.breakers {
+		if b.state != BreakerClosed {
+			open = append(open, ip)
+		}
+	}
+	sort.Strings(open)
+	return open
+}
+
+// before checks a device's breaker before a call. It returns the state change it
+// made, if any, for the caller to report once the lock is released.
+func (c *CircuitBreakers) before(ipAddress string) (*BreakerStateChange, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b := c.breaker(ipAddress)
+	switch b.state {
+	case BreakerOpen:
+		remaining := c.settings.CoolDown - c.now().Sub(b.openedAt)
+		if remaining > 0 {
+			return nil, Permanent(fmt.Errorf("%w for device %s, retrying in %s", ErrCircuitOpen, ipAddress, remaining.Round(time.Second)))
+		}
+		b.probing = true
+		return c.transition(ipAddress, b, BreakerHalfOpen, nil), nil
+	case BreakerHalfOpen:
+		if b.probing {
+			return nil, Permanent(fmt.Errorf("%w for device %s, probe in progress", ErrCircuitOpen, ipAddress))
+		}
+		b.probing = true
+	}
+	return nil, nil
+}
+
+// after records the outcome of a call. It returns the state change it made, if any.
+func (c *CircuitBreakers) after(ipAddress string, err error) *BreakerStateChange {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b := c.breaker(ipAddress)
+	b.probing = false
+
+	if err == nil || errors.Is(err, ErrPermanent) {
+		b.failures = 0
+		if b.state != BreakerClosed {
+			return c.transition(ipAddress, b, BreakerClosed, nil)
+		}
+		return nil
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= c.settings.FailureThreshold {
+		b.openedAt = c.now()
+		if b.state != BreakerOpen {
+			return c.transition(ipAddress, b, BreakerOpen, err)
+		}
+	}
+	return nil
+}
+
+func (c *CircuitBreakers) breaker(ipAddress string) *breaker {
+	b, ok := c.breakers[ipAddress]
+	if !ok {
+		b = &breaker{}
+		c.breakers[ipAddress] = b
+	}
+	return b
+}
+
+// transition changes a breaker's state. c.mu must be held.
+func (c *CircuitBreakers) transition(ipAddress string, b *breaker, to BreakerState, err error) *BreakerStateChange {
+	change := BreakerStateChange{IPAddress: ipAddress, From: b.state, To: to, At: c.now(), Err: err}
+	b.state = to
+	return &change
+}
+
+// notify reports a state change. c.mu must not be held.
+func (c *CircuitBreakers) notify(change *BreakerStateChange) {
+	if change != nil && c.onStateChange != nil {
+		c.onStateChange(*change)
+	}
+}
+
+// BreakerConfigurationClient wraps a ConfigurationClient with per-device circuit breakers.
+// Calls to the ConfigurationClient extensions go through the breaker too, when the
+// wrapped client supports them. RestoreConfiguration and CancelConfiguration undo a
+// change, so they bypass an open breaker rather than leave the device half-configured.
+type BreakerConfigurationClient struct {
+	client   ConfigurationClient
+	breakers *CircuitBreakers
+}
+
+// NewBreakerConfigurationClient is a constructor for the BreakerConfigurationClient struct.
+func NewBreakerConfigurationClient(client ConfigurationClient, breakers *CircuitBreakers) BreakerConfigurationClient {
+	return BreakerConfigurationClient{client: client, breakers: breakers}
+}
+
+func (b BreakerConfigurationClient) ConfigureDevice(d Device, config string) error {
+	return b.breakers.Call(d.IPAddress, func() error {
+		return b.client.ConfigureDevice(d, config)
+	})
+}
+
+func (b BreakerConfigurationClient) ConfigureDeviceFenced(d Device, config string, token int64) error {
+	client, ok := b.client.(FencedConfigurationClient)
+	if !ok {
+		return Permanent(ErrFencingNotSupported)
+	}
+	return b.breakers.Call(d.IPAddress, func() error {
+		return client.ConfigureDeviceFenced(d, config, token)
+	})
+}
+
+func (b BreakerConfigurationClient) SnapshotConfiguration(d Device) (snapshot ConfigSnapshot, err error) {
+	client, ok := b.client.(RollbackableConfigurationClient)
+	if !ok {
+		return ConfigSnapshot{}, Permanent(ErrRollbackNotSupported)
+	}
+	err = b.breakers.Call(d.IPAddress, func() error {
+		snapshot, err = client.SnapshotConfiguration(d)
+		return err
+	})
+	return snapshot, err
+}
+
+func (b BreakerConfigurationClient) RestoreConfiguration(d Device, snapshot ConfigSnapshot) error {
+	client, ok := b.client.(RollbackableConfigurationClient)
+	if !ok {
+		return Permanent(ErrRollbackNotSupported)
+	}
+	// A rollback bypasses the breaker and isn't recorded by it.
+	return client.RestoreConfiguration(d, snapshot)
+}
+
+func (b BreakerConfigurationClient) RunningConfiguration(d Device) (running string, err error) {
+	client, ok := b.client.(DiffingConfigurationClient)
+	if !ok {
+		return "", Permanent(ErrDryRunNotSupported)
+	}
+	err = b.breakers.Call(d.IPAddress, func() error {
+		running, err = client.RunningConfiguration(d)
+		return err
+	})
+	return running, err
+}
+
+func (b BreakerConfigurationClient) ConfigureDeviceConfirmed(d Device, config string, timeout time.Duration) (commit PendingCommit, err error) {
+	client, ok := b.client.(ConfirmableConfigurationClient)
+	if !ok {
+		return PendingCommit{}, Permanent(ErrCommitConfirmedNotSupported)
+	}
+	err = b.breakers.Call(d.IPAddress, func() error {
+		commit, err = client.ConfigureDeviceConfirmed(d, config, timeout)
+		return err
+	})
+	return commit, err
+}
+
+func (b BreakerConfigurationClient) SupportsCommitConfirmed(d Device) bool {
+	client, ok := b.client.(ConfirmableConfigurationClient)
+	return ok && supportsCommitConfirmed(client, d)
+}
+
+func (b BreakerConfigurationClient) ConfirmConfiguration(d Device, commit PendingCommit) error {
+	client, ok := b.client.(ConfirmableConfigurationClient)
+	if !ok {
+		return Permanent(ErrCommitConfirmedNotSupported)
+	}
+	return b.breakers.Call(d.IPAddress, func() error {
+		return client.ConfirmConfiguration(d, commit)
+	})
+}
+
+func (b BreakerConfigurationClient) CancelConfiguration(d Device, commit PendingCommit) error {
+	client, ok := b.client.(ConfirmableConfigurationClient)
+	if !ok {
+		return Permanent(ErrCommitConfirmedNotSupported)
+	}
+	// Like a rollback, a cancel bypasses the breaker and isn't recorded by it.
+	return client.CancelConfiguration(d, commit)
+}
+
+// BreakerMonitoringClient wraps a MonitoringClient with per-device circuit breakers.
+type BreakerMonitoringClient struct {
+	client   MonitoringClient
+	breakers *CircuitBreakers
+}
+
+// NewBreakerMonitoringClient is a constructor for the BreakerMonitoringClient struct.
+func NewBreakerMonitoringClient(client MonitoringClient, breakers *CircuitBreakers) BreakerMonitoringClient {
+	return BreakerMonitoringClient{client: client, breakers: breakers}
+}
+
+func (b BreakerMonitoringClient) MonitorDevice(d Device) error {
+	return b.breakers.Call(d.IPAddress, func() error {
+		return b.client.MonitorDevice(d)
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreakers(t *testing.T) {
+	var changes []BreakerStateChange
+	breakers := NewCircuitBreakers(BreakerSettings{FailureThreshold: 2, CoolDown: time.Minute}, func(c BreakerStateChange) {
+		changes = append(changes, c)
+	})
+	now := time.Now()
+	breakers.now = func() time.Time { return now }
+
+	unreachable := errors.New("no route to host")
+	calls := 0
+	failing := func() error {
+		calls++
+		return unreachable
+	}
+
+	assert.ErrorIs(t, breakers.Call("10.0.0.1", failing), unreachable)
+	assert.Equal(t, BreakerClosed, breakers.State("10.0.0.1"))
+	assert.ErrorIs(t, breakers.Call("10.0.0.1", failing), unreachable)
+	assert.Equal(t, BreakerOpen, breakers.State("10.0.0.1"))
+	assert.Equal(t, []string{"10.0.0.1"}, breakers.OpenDevices())
+
+	// While open, calls fail fast without reaching the device.
+	err := breakers.Call("10.0.0.1", failing)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.ErrorIs(t, err, ErrPermanent)
+	assert.Equal(t, 2, calls)
+
+	// Other devices are unaffected.
+	assert.NoError(t, breakers.Call("10.0.0.2", func() error { return nil }))
+
+	// After the cool-down a failing probe opens the breaker again.
+	now = now.Add(time.Minute)
+	assert.ErrorIs(t, breakers.Call("10.0.0.1", failing), unreachable)
+	assert.Equal(t, BreakerOpen, breakers.State("10.0.0.1"))
+
+	// A successful probe closes it.
+	now = now.Add(time.Minute)
+	assert.NoError(t, breakers.Call("10.0.0.1", func() error { return nil }))
+	assert.Equal(t, BreakerClosed, breakers.State("10.0.0.1"))
+	assert.Empty(t, breakers.OpenDevices())
+
+	var transitions []string
+	for _, c := range changes {
+		transitions = append(transitions, c.From.String()+"->"+c.To.String())
+	}
+	assert.Equal(t, []string{"closed->open", "open->half-open", "half-open->open", "open->half-open", "half-open->closed"}, transitions)
+
+	// Permanent errors mean the device answered, so they don't trip the breaker.
+	for i := 0; i < 3; i++ {
+		breakers.Call("10.0.0.3", func() error { return Permanent(errors.New("authentication failed")) })
+	}
+	assert.Equal(t, BreakerClosed, breakers.State("10.0.0.3"))
+}
+
+type unreachableMonitoringClient struct{}
+
+func (unreachableMonitoringClient) MonitorDevice(d Device) error {
+	return errors.New("no route to host")
+}
+
+func TestBreakerLetsRollbackThrough(t *testing.T) {
+	breakers := NewCircuitBreakers(BreakerSettings{FailureThreshold: 2, CoolDown: time.Hour}, nil)
+	client := &snapshottingConfigurationClient{running: map[string]string{"10.0.0.1": "old"}}
+	handler := NewNetworkHandler(
+		MockDeviceRepository{},
+		MockConfigRenderer{},
+		NewBreakerConfigurationClient(client, breakers),
+		NewBreakerMonitoringClient(unreachableMonitoringClient{}, breakers),
+		RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+	)
+
+	result := handler.performOperation(context.Background(), "10.0.0.1")
+	assert.Equal(t, StageMonitor, result.FailedStage)
+	assert.ErrorIs(t, result.Err, ErrCircuitOpen)
+	assert.Equal(t, BreakerOpen, breakers.State("10.0.0.1"))
+	assert.True(t, result.Rollback.Succeeded())
+	assert.Equal(t, "old", client.running["10.0.0.1"])
+}
+
+func TestBreakerStateChangeCallback(t *testing.T) {
+	var breakers *CircuitBreakers
+	var states []BreakerState
+	breakers = NewCircuitBreakers(BreakerSettings{FailureThreshold: 1, CoolDown: time.Minute}, func(c BreakerStateChange) {
+		// The callback may inspect the breakers without deadlocking.
+		states = append(states, breakers.State(c.IPAddress))
+		breakers.OpenDevices()
+	})
+
+	breakers.Call("10.0.0.1", func() error { return errors.New("no route to host") })
+	assert.Equal(t, []BreakerState{BreakerOpen}, states)
+}
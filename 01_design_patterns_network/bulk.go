@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrFailureBudgetExhausted is returned by PerformBulkOperation when MaxFailures devices have failed.
+var ErrFailureBudgetExhausted = errors.New("failure budget exhausted")
+
+// ErrSkipped is set on the result of a device that was never attempted.
+var ErrSkipped = errors.New("device skipped")
+
+// BulkOptions controls how PerformBulkOperation fans out across devices.
+type BulkOptions struct {
+	// Concurrency is the maximum number of devices worked on at the same time. Defaults to 1.
+	Concurrency int
+	// MaxFailures stops scheduling new devices once this many have failed. Zero means no limit.
+	MaxFailures int
+}
+
+// BulkReport holds one DeviceResult per requested device, in the order they were requested.
+type BulkReport struct {
+	Results   []DeviceResult
+	Succeeded int
+	Failed    int
+	// Skipped counts devices that were not attempted because the failure budget
+	// was exhausted or ctx was cancelled.
+	Skipped int
+}
+
+// PerformBulkOperation runs PerformNetworkOperation against many devices in parallel.
+// Devices already in flight when the failure budget runs out are allowed to finish;
+// devices not yet started are reported as skipped.
+func (n NetworkHandler) PerformBulkOperation(ctx context.Context, ipAddresses []string, opts BulkOptions) (BulkReport, error) {
+	return runBulk(ctx, ipAddresses, opts, func(ctx context.Context, i int) DeviceResult {
+		return n.performOperation(ctx, ipAddresses[i])
+	})
+}
+
+// runBulk calls op for every index of ipAddresses with bounded concurrency and an optional failure budget.
+func runBulk(ctx context.Context, ipAddresses []string, opts BulkOptions, op func(ctx context.Context, i int) DeviceResult) (BulkReport, error) {
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	report := BulkReport{Results: make([]DeviceResult, len(ipAddresses))}
+	sem := make(chan struct{}, concurrency)
+	var failures atomic.Int64
+	var wg sync.WaitGroup
+
+	budgetExhausted := func() bool {
+		return opts.MaxFailures > 0 && failures.Load() >= int64(opts.MaxFailures)
+	}
+	skip := func(i int) {
+		report.Results[i] = DeviceResult{IPAddress: ipAddresses[i], Err: ErrSkipped}
+	}
+
+	for i := range ipAddresses {
+		if ctx.Err() != nil || budgetExhausted() {
+			skip(i)
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			skip(i)
+			continue
+		}
+
+		// The budget may have run out while we were waiting for a free slot.
+		if budgetExhausted() {
+			<-sem
+			skip(i)
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result := op(ctx, i)
+			if !result.Success {
+				failures.Add(1)
+			}
+			report.Results[i] = result
+		}(i)
+	}
+	wg.Wait()
+
+	for _, result := range report.Results {
+		switch {
+		case result.Success:
+			report.Succeeded++
+		case errors.Is(result.Err, ErrSkipped):
+			report.Skipped++
+		default:
+			report.Failed++
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+	if budgetExhausted() {
+		return report, fmt.Errorf("%w: %d of %d devices failed", ErrFailureBudgetExhausted, report.Failed, len(ipAddresses))
+	}
+	return report, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyConfigurationClient fails permanently for the configured IP addresses.
+type flakyConfigurationClient struct {
+	failing  map[string]bool
+	inFlight atomic.Int64
+	maxSeen  atomic.Int64
+}
+
+func (c *flakyConfigurationClient) ConfigureDevice(d Device, config string) error {
+	current := c.inFlight.Add(1)
+	defer c.inFlight.Add(-1)
+	for {
+		seen := c.maxSeen.Load()
+		if current <= seen || c.maxSeen.CompareAndSwap(seen, current) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if c.failing[d.IPAddress] {
+		return Permanent(errors.New("authentication failed"))
+	}
+	return nil
+}
+
+type recordingMonitoringClient struct {
+	mu        sync.Mutex
+	monitored []string
+}
+
+func (c *recordingMonitoringClient) MonitorDevice(d Device) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.monitored = append(c.monitored, d.IPAddress)
+	return nil
+}
+
+func TestPerformBulkOperation(t *testing.T) {
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"}
+
+	t.Run("reports a result per device", func(t *testing.T) {
+		configClient := &flakyConfigurationClient{failing: map[string]bool{"10.0.0.2": true}}
+		handler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, configClient, &recordingMonitoringClient{}, DefaultRetryPolicy())
+
+		report, err := handler.PerformBulkOperation(context.Background(), ips, BulkOptions{Concurrency: 3})
+		assert.NoError(t, err)
+		assert.Len(t, report.Results, len(ips))
+		assert.Equal(t, 5, report.Succeeded)
+		assert.Equal(t, 1, report.Failed)
+		assert.LessOrEqual(t, configClient.maxSeen.Load(), int64(3))
+
+		failed := report.Results[1]
+		assert.Equal(t, "10.0.0.2", failed.IPAddress)
+		assert.False(t, failed.Success)
+		assert.Equal(t, StageConfigure, failed.FailedStage)
+		assert.Equal(t, 1, failed.Attempts)
+		assert.ErrorIs(t, failed.Err, ErrPermanent)
+
+		assert.True(t, report.Results[0].Success)
+		assert.Equal(t, 2, report.Results[0].Attempts)
+	})
+
+	t.Run("stops after the failure budget is spent", func(t *testing.T) {
+		configClient := &flakyConfigurationClient{failing: map[string]bool{"10.0.0.1": true, "10.0.0.2": true}}
+		handler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, configClient, &recordingMonitoringClient{}, DefaultRetryPolicy())
+
+		report, err := handler.PerformBulkOperation(context.Background(), ips, BulkOptions{Concurrency: 1, MaxFailures: 2})
+		assert.ErrorIs(t, err, ErrFailureBudgetExhausted)
+		assert.Equal(t, 2, report.Failed)
+		assert.Equal(t, 4, report.Skipped)
+		assert.ErrorIs(t, report.Results[5].Err, ErrSkipped)
+		assert.Equal(t, "10.0.0.6", report.Results[5].IPAddress)
+	})
+}
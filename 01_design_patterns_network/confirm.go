@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultConfirmTimeout is how long a device waits for confirmation before it reverts a change.
+const DefaultConfirmTimeout = 5 * time.Minute
+
+// ErrCommitConfirmedNotSupported is returned by clients that only sometimes support
+// commit confirmed, e.g. DriverRegistry for a platform without it. NetworkHandler
+// then falls back to a plain commit.
+var ErrCommitConfirmedNotSupported = errors.New("commit confirmed not supported")
+
+// ErrNoPendingCommit is returned when confirming a commit that has already been reverted.
+var ErrNoPendingCommit = errors.New("no pending commit")
+
+// PendingCommit is a change that the device reverts by itself unless it is confirmed in time.
+type PendingCommit struct {
+	ID        string
+	IPAddress string
+	RevertAt  time.Time
+}
+
+// ConfirmableConfigurationClient is an optional extension of ConfigurationClient
+// for devices that support "commit confirmed". When the configured client
+// implements it, NetworkHandler applies the change with a confirm timeout, runs
+// MonitorDevice as the health check, and only then confirms it. If the check
+// fails the change is cancelled, and if the handler dies the device reverts on its own.
+type ConfirmableConfigurationClient interface {
+	ConfigurationClient
+	// ConfigureDeviceConfirmed applies config and reverts it after timeout unless confirmed.
+	ConfigureDeviceConfirmed(d Device, config string, timeout time.Duration) (PendingCommit, error)
+	// ConfirmConfiguration makes a pending commit permanent.
+	ConfirmConfiguration(d Device, commit PendingCommit) error
+	// CancelConfiguration reverts a pending commit straight away.
+	CancelConfiguration(d Device, commit PendingCommit) error
+}
+
+// CommitConfirmedChecker is an optional extension of ConfirmableConfigurationClient
+// for clients that only support commit confirmed on some devices, such as
+// DriverRegistry. NetworkHandler asks it before applying a change and uses a plain
+// commit for devices without support.
+type CommitConfirmedChecker interface {
+	SupportsCommitConfirmed(d Device) bool
+}
+
+// supportsCommitConfirmed reports whether client can apply a change to d with commit confirmed.
+func supportsCommitConfirmed(client ConfirmableConfigurationClient, d Device) bool {
+	checker, ok := client.(CommitConfirmedChecker)
+	return !ok || checker.SupportsCommitConfirmed(d)
+}
+
+// WithConfirmTimeout returns a copy of the handler that gives devices the given
+// time to be confirmed. It must be longer than the monitoring check, retries included.
+func (n NetworkHandler) WithConfirmTimeout(timeout time.Duration) NetworkHandler {
+	n.confirmTimeout = timeout
+	return n
+}
+
+// applyConfirmed applies the configuration with commit confirmed and only confirms
+// it once the monitoring check passes. It returns the stage that failed, if any.
+// A client that reports ErrCommitConfirmedNotSupported without implementing
+// CommitConfirmedChecker falls back to a plain commit after that first attempt.
+func (n NetworkHandler) applyConfirmed(ctx context.Context, client ConfirmableConfigurationClient, device Device, config string, result *DeviceResult) (Stage, error) {
+	timeout := n.confirmTimeout
+	if timeout <= 0 {
+		timeout = DefaultConfirmTimeout
+	}
+
+	var commit PendingCommit
+	err := retry(ctx, n.retryPolicy, n.attempt(ctx, StageConfigure, func() error {
+		result.Attempts++
+		var err error
+		commit, err = client.ConfigureDeviceConfirmed(device, config, timeout)
+		return err
+	}))
+	if errors.Is(err, ErrCommitConfirmedNotSupported) {
+		return n.applyWithRollback(ctx, device, config, result)
+	}
+	if err != nil {
+		return StageConfigure, fmt.Errorf("failed to configure device after retries: %w", err)
+	}
+
+	n.publishMonitoringStarted(ctx, result)
+	err = retry(ctx, n.retryPolicy, n.attempt(ctx, StageMonitor, func() error {
+		result.Attempts++
+		return n.monitoringClient.MonitorDevice(device)
+	}))
+	if err != nil {
+		err = fmt.Errorf("failed to monitor device after retries: %w", err)
+		result.Rollback = n.cancelCommit(ctx, client, device, commit)
+		return StageMonitor, withRollback(err, result.Rollback)
+	}
+
+	// Confirming uses ctx on purpose: if the operation is aborted now the
+	// device reverts by itself, which is the safe outcome.
+	err = retry(ctx, n.retryPolicy, n.attempt(ctx, StageConfirm, func() error {
+		return client.ConfirmConfiguration(device, commit)
+	}))
+	if err != nil {
+		return StageConfirm, fmt.Errorf("failed to confirm configuration, device reverts at %s: %w", commit.RevertAt.Format(time.RFC3339), err)
+	}
+	return "", nil
+}
+
+// cancelCommit reverts a pending commit after a failed health check. Like rollback
+// it runs even when ctx has been cancelled; if it fails the device still reverts
+// once the confirm timeout expires.
+func (n NetworkHandler) cancelCommit(ctx context.Context, client ConfirmableConfigurationClient, device Device, commit PendingCommit) RollbackResult {
+	err := retry(context.WithoutCancel(ctx), n.retryPolicy, n.attempt(ctx, StageRollback, func() error {
+		return client.CancelConfiguration(device, commit)
+	}))
+	if err != nil {
+		return RollbackResult{Attempted: true, Err: fmt.Errorf("failed to cancel pending commit, device reverts at %s: %w", commit.RevertAt.Format(time.RFC3339), err)}
+	}
+	return RollbackResult{Attempted: true}
+}
+
+// SimulatedConfirmClient is an in-memory device fleet that honours commit confirmed,
+// for trying the flow locally. It also implements DiffingConfigurationClient.
+type SimulatedConfirmClient struct {
+	mu      sync.Mutex
+	running map[string]string
+	pending map[string]*simulatedCommit
+	lastID  int
+}
+
+type simulatedCommit struct {
+	commit   PendingCommit
+	previous string
+	timer    *time.Timer
+}
+
+// NewSimulatedConfirmClient is a constructor for a SimulatedConfirmClient whose
+// devices start with the given running configuration, keyed by IP address.
+func NewSimulatedConfirmClient(running map[string]string) *SimulatedConfirmClient {
+	c := &SimulatedConfirmClient{running: make(map[string]string), pending: make(map[string]*simulatedCommit)}
+	for ip, config := range running {
+		c.running[ip] = config
+	}
+	return c
+}
+
+func (c *SimulatedConfirmClient) ConfigureDevice(d Device, config string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.pending[d.IPAddress]; ok {
+		return Transient(fmt.Errorf("device %s has a commit waiting for confirmation", d.IPAddress))
+	}
+	c.running[d.IPAddress] = config
+	return nil
+}
+
+func (c *SimulatedConfirmClient) ConfigureDeviceConfirmed(d Device, config string, timeout time.Duration) (PendingCommit, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.pending[d.IPAddress]; ok {
+		return PendingCommit{}, Transient(fmt.Errorf("device %s has a commit waiting for confirmation", d.IPAddress))
+	}
+
+	c.lastID++
+	pending := &simulatedCommit{
+		commit:   PendingCommit{ID: fmt.Sprintf("commit-%d", c.lastID), IPAddress: d.IPAddress, RevertAt: time.Now().Add(timeout)},
+		previous: c.running[d.IPAddress],
+	}
+	pending.timer = time.AfterFunc(timeout, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.revert(pending)
+	})
+	c.pending[d.IPAddress] = pending
+	c.running[d.IPAddress] = config
+	return pending.commit, nil
+}
+
+func (c *SimulatedConfirmClient) ConfirmConfiguration(d Device, commit PendingCommit) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pending, err := c.pendingCommit(commit)
+	if err != nil {
+		return err
+	}
+	pending.timer.Stop()
+	delete(c.pending, commit.IPAddress)
+	return nil
+}
+
+func (c *SimulatedConfirmClient) CancelConfiguration(d Device, commit PendingCommit) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pending, err := c.pendingCommit(commit)
+	if err != nil {
+		return err
+	}
+	pending.timer.Stop()
+	c.revert(pending)
+	return nil
+}
+
+func (c *SimulatedConfirmClient) RunningConfiguration(d Device) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.running[d.IPAddress], nil
+}
+
+func (c *SimulatedConfirmClient) pendingCommit(commit PendingCommit) (*simulatedCommit, error) {
+	pending, ok := c.pending[commit.IPAddress]
+	if !ok || pending.commit.ID != commit.ID {
+		return nil, Permanent(fmt.Errorf("%w %s on device %s", ErrNoPendingCommit, commit.ID, commit.IPAddress))
+	}
+	return pending, nil
+}
+
+// revert restores the configuration from before a pending commit. c.mu must be held.
+func (c *SimulatedConfirmClient) revert(pending *simulatedCommit) {
+	if c.pending[pending.commit.IPAddress] != pending {
+		return
+	}
+	c.running[pending.commit.IPAddress] = pending.previous
+	delete(c.pending, pending.commit.IPAddress)
+}
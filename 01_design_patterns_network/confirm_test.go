@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommitConfirmed(t *testing.T) {
+	ctx := context.Background()
+	device := Device{IPAddress: "10.0.0.1"}
+
+	t.Run("confirms once monitoring passes", func(t *testing.T) {
+		client := NewSimulatedConfirmClient(map[string]string{"10.0.0.1": "old\n"})
+		handler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, client, MockMonitoringClient{}, DefaultRetryPolicy()).
+			WithConfirmTimeout(50 * time.Millisecond)
+
+		assert.NoError(t, handler.PerformNetworkOperation(ctx, "10.0.0.1"))
+		time.Sleep(100 * time.Millisecond)
+		running, _ := client.RunningConfiguration(device)
+		assert.Equal(t, "hostname 10.0.0.1\n", running, "a confirmed change must not revert")
+	})
+
+	t.Run("cancels the change when monitoring fails", func(t *testing.T) {
+		client := NewSimulatedConfirmClient(map[string]string{"10.0.0.1": "old\n"})
+		handler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, client, failingMonitoringClient{}, DefaultRetryPolicy())
+
+		result := handler.performOperation(ctx, "10.0.0.1")
+		assert.Equal(t, StageMonitor, result.FailedStage)
+		assert.True(t, result.Rollback.Succeeded())
+		running, _ := client.RunningConfiguration(device)
+		assert.Equal(t, "old\n", running)
+	})
+
+	t.Run("reverts by itself when never confirmed", func(t *testing.T) {
+		client := NewSimulatedConfirmClient(map[string]string{"10.0.0.1": "old\n"})
+
+		commit, err := client.ConfigureDeviceConfirmed(device, "new\n", 20*time.Millisecond)
+		assert.NoError(t, err)
+		running, _ := client.RunningConfiguration(device)
+		assert.Equal(t, "new\n", running)
+
+		time.Sleep(50 * time.Millisecond)
+		running, _ = client.RunningConfiguration(device)
+		assert.Equal(t, "old\n", running)
+		assert.ErrorIs(t, client.ConfirmConfiguration(device, commit), ErrNoPendingCommit)
+	})
+
+	t.Run("falls back to a plain commit when a driver lacks support", func(t *testing.T) {
+		registry := NewDriverRegistry()
+		registry.Register(PlatformEOS, Driver{ConfigurationClient: MockPlatformDriver{Platform: PlatformEOS}, MonitoringClient: MockMonitoringClient{}})
+		auditLog := NewJSONLinesAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"))
+		breakers := NewCircuitBreakers(BreakerSettings{FailureThreshold: 3, CoolDown: time.Minute}, nil)
+		handler := NewNetworkHandler(platformRepository{"10.0.0.1": PlatformEOS}, MockConfigRenderer{}, NewBreakerConfigurationClient(registry, breakers), registry, DefaultRetryPolicy()).
+			WithAuditLog(auditLog)
+
+		result := handler.performOperation(ctx, "10.0.0.1")
+		assert.True(t, result.Success, "%v", result.Err)
+		assert.False(t, errors.Is(result.Err, ErrCommitConfirmedNotSupported))
+		assert.Equal(t, 2, result.Attempts, "one configure and one monitor attempt")
+
+		entries, err := auditLog.Query(AuditQuery{OperationID: result.OperationID})
+		assert.NoError(t, err)
+		for _, e := range entries {
+			assert.True(t, e.Success, "%s attempt %d failed: %s", e.Stage, e.Attempt, e.Error)
+		}
+	})
+}
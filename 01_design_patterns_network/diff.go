@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+type diffOp int
+
+const (
+	diffEqual diffOp = iota
+	diffDelete
+	diffInsert
+)
+
+type diffLine struct {
+	op   diffOp
+	text string
+}
+
+// unifiedDiff returns a unified diff turning from into to, or an empty string
+// if they are the same.
+func unifiedDiff(fromName, toName, from, to string) string {
+	a, b := splitLines(from), splitLines(to)
+	lines := diffLines(a, b)
+
+	var hunks strings.Builder
+	for start := 0; start < len(lines); {
+		// Find the next change.
+		for start < len(lines) && lines[start].op == diffEqual {
+			start++
+		}
+		if start == len(lines) {
+			break
+		}
+
+		// Extend the hunk until there are more than 2*diffContext unchanged lines in a row.
+		end, equal := start, 0
+		for i := start; i < len(lines); i++ {
+			if lines[i].op == diffEqual {
+				equal++
+				if equal > 2*diffContext {
+					break
+				}
+				continue
+			}
+			equal = 0
+			end = i + 1
+		}
+
+		first := max(start-diffContext, 0)
+		last := min(end+diffContext, len(lines))
+		writeHunk(&hunks, lines, first, last)
+		start = last
+	}
+
+	if hunks.Len() == 0 {
+		return ""
+	}
+	return fmt.Sprintf("--- %s\n+++ %s\n%s", fromName, toName, hunks.String())
+}
+
+// writeHunk writes lines[first:last] as a unified diff hunk.
+func writeHunk(w *strings.Builder, lines []diffLine, first, last int) {
+	// Line numbers in the old and new text where the hunk starts (1-based).
+	fromLine, toLine := 1, 1
+	for _, l := range lines[:first] {
+		if l.op != diffInsert {
+			fromLine++
+		}
+		if l.op != diffDelete {
+			toLine++
+		}
+	}
+
+	fromCount, toCount := 0, 0
+	var body strings.Builder
+	for _, l := range lines[first:last] {
+		switch l.op {
+		case diffEqual:
+			fromCount++
+			toCount++
+			body.WriteString(" " + l.text + "\n")
+		case diffDelete:
+			fromCount++
+			body.WriteString("-" + l.text + "\n")
+		case diffInsert:
+			toCount++
+			body.WriteString("+" + l.text + "\n")
+		}
+	}
+
+	// An empty range starts at the line before it.
+	if fromCount == 0 {
+		fromLine--
+	}
+	if toCount == 0 {
+		toLine--
+	}
+	fmt.Fprintf(w, "@@ -%d,%d +%d,%d @@\n%s", fromLine, fromCount, toLine, toCount, body.String())
+}
+
+// diffLines computes a shortest edit script from a to b using Myers' algorithm.
+// The trace keeps only the diagonals -d..d that step d reads, so it grows with
+// the square of the number of edits rather than with the length of the inputs.
+func diffLines(a, b []string) []diffLine {
+	n, m := len(a), len(b)
+	maxD := n + m
+	offset := maxD + 1
+	v := make([]int, 2*maxD+3)
+	var trace [][]int
+
+	for d := 0; d <= maxD; d++ {
+		snapshot := make([]int, 2*d+1)
+		copy(snapshot, v[offset-d:offset+d+1])
+		trace = append(trace, snapshot)
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(trace, a, b, d)
+			}
+		}
+	}
+	return nil
+}
+
+// backtrack walks the Myers trace back from the end to build the edit script.
+// trace[d] holds diagonals -d..d, so diagonal k of step d is at trace[d][d+k].
+func backtrack(trace [][]int, a, b []string, d int) []diffLine {
+	x, y := len(a), len(b)
+	var reversed []diffLine
+
+	for ; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[d+k-1] < v[d+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[d+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			reversed = append(reversed, diffLine{op: diffEqual, text: a[x]})
+		}
+		if x == prevX {
+			y--
+			reversed = append(reversed, diffLine{op: diffInsert, text: b[y]})
+		} else {
+			x--
+			reversed = append(reversed, diffLine{op: diffDelete, text: a[x]})
+		}
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		reversed = append(reversed, diffLine{op: diffEqual, text: a[x]})
+	}
+
+	lines := make([]diffLine, len(reversed))
+	for i, l := range reversed {
+		lines[len(reversed)-1-i] = l
+	}
+	return lines
+}
+
+// splitLines splits text into lines without their trailing newlines.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// IntentStore remembers the configuration last applied to each device, so drift
+// can be measured against what was actually pushed rather than what the templates
+// would render today.
+type IntentStore interface {
+	SaveIntent(ipAddress, config string) error
+	// Intent returns the last applied configuration, or ok == false if there is none.
+	Intent(ipAddress string) (config string, ok bool, err error)
+}
+
+// MemoryIntentStore is an IntentStore for a single process.
+type MemoryIntentStore struct {
+	mu      sync.Mutex
+	intents map[string]string
+}
+
+// NewMemoryIntentStore is a constructor for the MemoryIntentStore struct.
+func NewMemoryIntentStore() *MemoryIntentStore {
+	return &MemoryIntentStore{intents: make(map[string]string)}
+}
+
+func (s *MemoryIntentStore) SaveIntent(ipAddress, config string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.intents[ipAddress] = config
+	return nil
+}
+
+func (s *MemoryIntentStore) Intent(ipAddress string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	config, ok := s.intents[ipAddress]
+	return config, ok, nil
+}
+
+// WithIntentStore returns a copy of the handler that saves every successfully
+// applied configuration to store, for DriftDetector to compare against.
+func (n NetworkHandler) WithIntentStore(store IntentStore) NetworkHandler {
+	n.intentStore = store
+	return n
+}
+
+func (n NetworkHandler) saveIntent(device Device, config string) {
+	if n.intentStore == nil {
+		return
+	}
+	if err := n.intentStore.SaveIntent(device.IPAddress, config); err != nil {
+		log.Printf("failed to save intended configuration of device %s: %v", device.IPAddress, err)
+	}
+}
+
+// previousIntent returns the configuration last applied to device, or an empty
+// string if there is no intent store or nothing has been applied yet.
+func (n NetworkHandler) previousIntent(device Device) string {
+	if n.intentStore == nil {
+		return ""
+	}
+	config, _, err := n.intentStore.Intent(device.IPAddress)
+	if err != nil {
+		log.Printf("failed to get intended configuration of device %s: %v", device.IPAddress, err)
+		return ""
+	}
+	return config
+}
+
+// DeviceLister lists every device in an inventory. FileDeviceRepository implements it.
+type DeviceLister interface {
+	Devices() []Device
+}
+
+// DriftOptions controls how often and how widely DriftDetector checks devices.
+type DriftOptions struct {
+	// Interval is the time between two checks of the whole inventory. Defaults to 15 minutes.
+	Interval time.Duration
+	// Concurrency is the maximum number of devices checked at the same time. Defaults to 1.
+	Concurrency int
+}
+
+// DriftReport is the outcome of one check of the inventory, in inventory order.
+// Each ConfigDiff goes from the intended to the running configuration.
+type DriftReport struct {
+	CheckID   string
+	CheckedAt time.Time
+	Diffs     []ConfigDiff
+	Drifted   int
+	InSync    int
+	// Skipped counts devices that were locked for a change while being checked.
+	Skipped int
+	Failed  int
+}
+
+// DriftDetector periodically compares the running configuration of every device
+// with the configuration last applied to it and publishes ConfigDriftDetected
+// when they differ. It uses the handler's configuration client, renderer, retry
+// policy, lock manager, intent store and event publisher.
+type DriftDetector struct {
+	handler NetworkHandler
+	devices DeviceLister
+	opts    DriftOptions
+}
+
+// NewDriftDetector is a constructor for the DriftDetector struct.
+func NewDriftDetector(handler NetworkHandler, devices DeviceLister, opts DriftOptions) DriftDetector {
+	if opts.Interval <= 0 {
+		opts.Interval = 15 * time.Minute
+	}
+	return DriftDetector{handler: handler, devices: devices, opts: opts}
+}
+
+// Run checks every device straight away and then once per Interval, until ctx is cancelled.
+func (d DriftDetector) Run(ctx context.Context) error {
+	ticker := time.NewTicker(d.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		report, err := d.Check(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("drift check %s failed: %v", report.CheckID, err)
+		}
+		log.Printf("drift check %s: %d device(s) drifted, %d in sync, %d skipped, %d failed",
+			report.CheckID, report.Drifted, report.InSync, report.Skipped, report.Failed)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check compares every device once. Devices locked by a running change are skipped,
+// since their running configuration is expected to differ from the last intent.
+func (d DriftDetector) Check(ctx context.Context) (DriftReport, error) {
+	devices := d.devices.Devices()
+	report := DriftReport{CheckID: newOperationID(), CheckedAt: time.Now(), Diffs: make([]ConfigDiff, len(devices))}
+	operator := OperatorFromContext(ctx)
+
+	ipAddresses := make([]string, len(devices))
+	for i, device := range devices {
+		ipAddresses[i] = device.IPAddress
+	}
+
+	bulkReport, err := runBulk(ctx, ipAddresses, BulkOptions{Concurrency: d.opts.Concurrency}, func(ctx context.Context, i int) DeviceResult {
+		diff := d.checkDevice(ctx, devices[i])
+		if diff.Changed() {
+			d.publishDrift(report.CheckID, operator, devices[i], diff)
+		}
+		report.Diffs[i] = diff
+		return DeviceResult{IPAddress: diff.IPAddress, Success: diff.Err == nil, Err: diff.Err}
+	})
+
+	for i, result := range bulkReport.Results {
+		switch {
+		case errors.Is(result.Err, ErrSkipped):
+			report.Diffs[i] = ConfigDiff{IPAddress: result.IPAddress, Err: result.Err}
+			report.Skipped++
+		case errors.Is(result.Err, ErrDeviceBusy):
+			report.Skipped++
+		case result.Err != nil:
+			report.Failed++
+		case report.Diffs[i].Changed():
+			report.Drifted++
+		default:
+			report.InSync++
+		}
+	}
+	return report, err
+}
+
+// checkDevice diffs the intended configuration of a device against its running one.
+func (d DriftDetector) checkDevice(ctx context.Context, device Device) ConfigDiff {
+	n := d.handler
+	diff := ConfigDiff{IPAddress: device.IPAddress, Hostname: device.Hostname}
+
+	client, ok := n.configurationClient.(DiffingConfigurationClient)
+	if !ok {
+		diff.Err = Permanent(ErrDryRunNotSupported)
+		return diff
+	}
+
+	// The check never takes the device lock, so it can't hold up a change. A device
+	// that is locked before the fetch is skipped, and so is one whose lock or intent
+	// changed during the fetch, since the running configuration may be mid-change.
+	if err := d.checkNotLocked(ctx, device); err != nil {
+		diff.Err = err
+		return diff
+	}
+
+	intended, err := d.intent(device)
+	if err != nil {
+		diff.Err = err
+		return diff
+	}
+
+	var running string
+	err = retry(ctx, n.retryPolicy, func() error {
+		var err error
+		running, err = client.RunningConfiguration(device)
+		return err
+	})
+	if err != nil {
+		diff.Err = fmt.Errorf("failed to fetch running configuration: %w", err)
+		return diff
+	}
+
+	if err := d.checkNotLocked(ctx, device); err != nil {
+		diff.Err = err
+		return diff
+	}
+	after, err := d.intent(device)
+	if err != nil {
+		diff.Err = err
+		return diff
+	}
+	if after != intended {
+		diff.Err = fmt.Errorf("%w: %s was changed while being checked", ErrDeviceBusy, device.IPAddress)
+		return diff
+	}
+
+	diff.Diff = unifiedDiff(device.IPAddress+" intended", device.IPAddress+" running", intended, running)
+	return diff
+}
+
+// checkNotLocked returns an error wrapping ErrDeviceBusy if a change holds the device lock.
+func (d DriftDetector) checkNotLocked(ctx context.Context, device Device) error {
+	if d.handler.lockManager == nil {
+		return nil
+	}
+	locked, err := d.handler.lockManager.IsLocked(ctx, device.IPAddress)
+	if err != nil {
+		return fmt.Errorf("failed to check device lock: %w", err)
+	}
+	if locked {
+		return fmt.Errorf("%w: %s is being changed", ErrDeviceBusy, device.IPAddress)
+	}
+	return nil
+}
+
+// intent returns the configuration last applied to a device, falling back to
+// rendering it when nothing has been recorded, e.g. after a restart.
+func (d DriftDetector) intent(device Device) (string, error) {
+	if d.handler.intentStore != nil {
+		config, ok, err := d.handler.intentStore.Intent(device.IPAddress)
+		if err != nil {
+			return "", fmt.Errorf("failed to get intended configuration: %w", err)
+		}
+		if ok {
+			return config, nil
+		}
+	}
+
+	config, err := d.handler.configRenderer.Render(device)
+	if err != nil {
+		return "", fmt.Errorf("failed to render device configuration: %w", err)
+	}
+	return config, nil
+}
+
+func (d DriftDetector) publishDrift(checkID, operator string, device Device, diff ConfigDiff) {
+	if d.handler.eventPublisher == nil {
+		return
+	}
+	event := newDeviceEvent(ConfigDriftDetected, checkID, operator, device)
+	event.Diff = diff.Diff
+	d.handler.publish(event)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/stretchr/testify/assert"
+)
+
+type staticDeviceLister []Device
+
+func (l staticDeviceLister) Devices() []Device {
+	return l
+}
+
+func TestDriftDetector(t *testing.T) {
+	ctx := context.Background()
+	devices := staticDeviceLister{{IPAddress: "10.0.0.1"}, {IPAddress: "10.0.0.2"}, {IPAddress: "10.0.0.3"}}
+
+	pubSub := gochannel.NewGoChannel(gochannel.Config{OutputChannelBuffer: 10}, watermill.NopLogger{})
+	defer pubSub.Close()
+	drifted, err := pubSub.Subscribe(ctx, ConfigDriftDetected.Topic())
+	assert.NoError(t, err)
+
+	client := NewSimulatedConfirmClient(nil)
+	locks := NewMemoryLockManager()
+	handler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, client, MockMonitoringClient{}, DefaultRetryPolicy()).
+		WithIntentStore(NewMemoryIntentStore()).
+		WithLocking(locks, LockOptions{TTL: time.Minute}).
+		WithEventPublisher(pubSub)
+
+	for _, device := range devices {
+		assert.NoError(t, handler.PerformNetworkOperation(ctx, device.IPAddress))
+	}
+
+	// Someone changes 10.0.0.2 by hand, and 10.0.0.3 is in the middle of a change.
+	assert.NoError(t, client.ConfigureDevice(devices[1], "hostname 10.0.0.2\nip domain-lookup\n"))
+	_, err = locks.TryLock(ctx, "10.0.0.3", "someone-else", time.Minute)
+	assert.NoError(t, err)
+
+	report, err := NewDriftDetector(handler, devices, DriftOptions{Concurrency: 2}).Check(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Drifted)
+	assert.Equal(t, 1, report.InSync)
+	assert.Equal(t, 1, report.Skipped)
+	assert.Equal(t, 0, report.Failed)
+	assert.ErrorIs(t, report.Diffs[2].Err, ErrDeviceBusy)
+	assert.Contains(t, report.Diffs[1].Diff, "+ip domain-lookup")
+
+	event, _ := receiveEvent(t, drifted)
+	assert.Equal(t, ConfigDriftDetected, event.EventType)
+	assert.Equal(t, "10.0.0.2", event.Device.IPAddress)
+	assert.Equal(t, report.CheckID, event.CorrelationID)
+	assert.Equal(t, report.Diffs[1].Diff, event.Diff)
+}
+
+// stallingConfirmClient reads the running configuration, then signals fetching
+// and blocks until release is closed before returning it.
+type stallingConfirmClient struct {
+	*SimulatedConfirmClient
+	fetching chan struct{}
+	release  chan struct{}
+}
+
+func (c stallingConfirmClient) RunningConfiguration(d Device) (string, error) {
+	running, err := c.SimulatedConfirmClient.RunningConfiguration(d)
+	close(c.fetching)
+	<-c.release
+	return running, err
+}
+
+func TestDriftDetectorDoesNotBlockChanges(t *testing.T) {
+	ctx := context.Background()
+	client := stallingConfirmClient{NewSimulatedConfirmClient(map[string]string{"10.0.0.1": "hostname old\n"}), make(chan struct{}), make(chan struct{})}
+	intents := NewMemoryIntentStore()
+	assert.NoError(t, intents.SaveIntent("10.0.0.1", "hostname old\n"))
+	handler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, client, MockMonitoringClient{}, DefaultRetryPolicy()).
+		WithIntentStore(intents).
+		WithLocking(NewMemoryLockManager(), LockOptions{TTL: time.Minute})
+
+	reports := make(chan DriftReport)
+	go func() {
+		report, _ := NewDriftDetector(handler, staticDeviceLister{{IPAddress: "10.0.0.1"}}, DriftOptions{}).Check(ctx)
+		reports <- report
+	}()
+
+	// A change runs while the drift check is fetching the running configuration.
+	<-client.fetching
+	assert.NoError(t, handler.PerformNetworkOperation(ctx, "10.0.0.1"))
+	close(client.release)
+
+	// The fetched configuration predates the change, so the device is skipped.
+	report := <-reports
+	assert.Equal(t, 1, report.Skipped)
+	assert.Equal(t, 0, report.InSync)
+	assert.ErrorIs(t, report.Diffs[0].Err, ErrDeviceBusy)
+}
+
+func TestDriftDetectorFallsBackToRenderedIntent(t *testing.T) {
+	client := NewSimulatedConfirmClient(map[string]string{"10.0.0.1": "hostname old\n"})
+	handler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, client, MockMonitoringClient{}, DefaultRetryPolicy())
+
+	report, err := NewDriftDetector(handler, staticDeviceLister{{IPAddress: "10.0.0.1"}}, DriftOptions{}).Check(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Drifted)
+	assert.Contains(t, report.Diffs[0].Diff, "-hostname 10.0.0.1\n+hostname old\n")
+}
+
+func TestNewDriftDetectorDefaultsInterval(t *testing.T) {
+	detector := NewDriftDetector(NetworkHandler{}, staticDeviceLister{}, DriftOptions{})
+	assert.Equal(t, 15*time.Minute, detector.opts.Interval)
+}
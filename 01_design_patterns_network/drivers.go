@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Platforms with a driver in this example.
+const (
+	PlatformIOSXE = "iosxe"
+	PlatformJunos = "junos"
+	PlatformEOS   = "eos"
+)
+
+// ErrNoDriver is returned when a device's platform has no registered driver.
+var ErrNoDriver = errors.New("no driver registered")
+
+// ErrRollbackNotSupported is returned by DriverRegistry snapshot calls when the
+// platform's driver can't roll back. NetworkHandler then carries on without a snapshot.
+var ErrRollbackNotSupported = errors.New("rollback not supported")
+
+// Driver bundles the clients that know how to talk to one platform.
+type Driver struct {
+	ConfigurationClient ConfigurationClient
+	MonitoringClient    MonitoringClient
+}
+
+// DriverRegistry dispatches configuration and monitoring calls to the driver
+// registered for each device's platform. It implements MonitoringClient and every
+// ConfigurationClient extension, reporting "not supported" errors for platforms
+// whose driver lacks one, so a single NetworkHandler can manage a mixed-vendor network.
+type DriverRegistry struct {
+	mu      sync.RWMutex
+	drivers map[string]Driver
+}
+
+// NewDriverRegistry is a constructor for an empty DriverRegistry.
+func NewDriverRegistry() *DriverRegistry {
+	return &DriverRegistry{drivers: make(map[string]Driver)}
+}
+
+// Register sets the driver for a platform, replacing any earlier registration.
+func (r *DriverRegistry) Register(platform string, driver Driver) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.drivers[platform] = driver
+}
+
+// Platforms returns the platforms that have a driver, sorted.
+func (r *DriverRegistry) Platforms() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	platforms := make([]string, 0, len(r.drivers))
+	for platform := range r.drivers {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+	return platforms
+}
+
+// driver returns the driver for a device. A missing driver is a permanent error,
+// as retrying won't make one appear.
+func (r *DriverRegistry) driver(d Device) (Driver, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	driver, ok := r.drivers[d.Platform]
+	if !ok {
+		return Driver{}, Permanent(fmt.Errorf("%w for platform %q of device %s", ErrNoDriver, d.Platform, d.IPAddress))
+	}
+	return driver, nil
+}
+
+func (r *DriverRegistry) ConfigureDevice(d Device, config string) error {
+	driver, err := r.driver(d)
+	if err != nil {
+		return err
+	}
+	if driver.ConfigurationClient == nil {
+		return Permanent(fmt.Errorf("%w: platform %q has no configuration client", ErrNoDriver, d.Platform))
+	}
+	return driver.ConfigurationClient.ConfigureDevice(d, config)
+}
+
+func (r *DriverRegistry) ConfigureDeviceFenced(d Device, config string, token int64) error {
+	driver, err := r.driver(d)
+	if err != nil {
+		return err
+	}
+	client, ok := driver.ConfigurationClient.(FencedConfigurationClient)
+	if !ok {
+		return Permanent(fmt.Errorf("%w by the %q driver", ErrFencingNotSupported, d.Platform))
+	}
+	return client.ConfigureDeviceFenced(d, config, token)
+}
+
+func (r *DriverRegistry) MonitorDevice(d Device) error {
+	driver, err := r.driver(d)
+	if err != nil {
+		return err
+	}
+	if driver.MonitoringClient == nil {
+		return Permanent(fmt.Errorf("%w: platform %q has no monitoring client", ErrNoDriver, d.Platform))
+	}
+	return driver.MonitoringClient.MonitorDevice(d)
+}
+
+func (r *DriverRegistry) SnapshotConfiguration(d Device) (ConfigSnapshot, error) {
+	client, err := r.rollbackableClient(d)
+	if err != nil {
+		return ConfigSnapshot{}, err
+	}
+	return client.SnapshotConfiguration(d)
+}
+
+func (r *DriverRegistry) RestoreConfiguration(d Device, snapshot ConfigSnapshot) error {
+	client, err := r.rollbackableClient(d)
+	if err != nil {
+		return err
+	}
+	return client.RestoreConfiguration(d, snapshot)
+}
+
+func (r *DriverRegistry) RunningConfiguration(d Device) (string, error) {
+	client, err := r.diffingClient(d)
+	if err != nil {
+		return "", err
+	}
+	return client.RunningConfiguration(d)
+}
+
+func (r *DriverRegistry) ConfigureDeviceConfirmed(d Device, config string, timeout time.Duration) (PendingCommit, error) {
+	client, err := r.confirmableClient(d)
+	if err != nil {
+		return PendingCommit{}, err
+	}
+	return client.ConfigureDeviceConfirmed(d, config, timeout)
+}
+
+func (r *DriverRegistry) ConfirmConfiguration(d Device, commit PendingCommit) error {
+	client, err := r.confirmableClient(d)
+	if err != nil {
+		return err
+	}
+	return client.ConfirmConfiguration(d, commit)
+}
+
+func (r *DriverRegistry) CancelConfiguration(d Device, commit PendingCommit) error {
+	client, err := r.confirmableClient(d)
+	if err != nil {
+		return err
+	}
+	return client.CancelConfiguration(d, commit)
+}
+
+// SupportsCommitConfirmed reports whether the device's driver supports commit confirmed.
+// Devices without a driver report true, so ConfigureDeviceConfirmed reports the missing driver.
+func (r *DriverRegistry) SupportsCommitConfirmed(d Device) bool {
+	_, err := r.confirmableClient(d)
+	return !errors.Is(err, ErrCommitConfirmedNotSupported)
+}
+
+// confirmableClient returns the platform's configuration client if it supports commit confirmed.
+func (r *DriverRegistry) confirmableClient(d Device) (ConfirmableConfigurationClient, error) {
+	driver, err := r.driver(d)
+	if err != nil {
+		return nil, err
+	}
+	client, ok := driver.ConfigurationClient.(ConfirmableConfigurationClient)
+	if !ok {
+		return nil, Permanent(fmt.Errorf("%w by the %q driver", ErrCommitConfirmedNotSupported, d.Platform))
+	}
+	return client, nil
+}
+
+// diffingClient returns the platform's configuration client if it can preview changes.
+func (r *DriverRegistry) diffingClient(d Device) (DiffingConfigurationClient, error) {
+	driver, err := r.driver(d)
+	if err != nil {
+		return nil, err
+	}
+	client, ok := driver.ConfigurationClient.(DiffingConfigurationClient)
+	if !ok {
+		return nil, Permanent(fmt.Errorf("%w by the %q driver", ErrDryRunNotSupported, d.Platform))
+	}
+	return client, nil
+}
+
+// rollbackableClient returns the platform's configuration client if it can roll back.
+// Without a driver there's nothing to roll back either; ConfigureDevice reports the missing driver.
+func (r *DriverRegistry) rollbackableClient(d Device) (RollbackableConfigurationClient, error) {
+	driver, err := r.driver(d)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrRollbackNotSupported, err)
+	}
+	client, ok := driver.ConfigurationClient.(RollbackableConfigurationClient)
+	if !ok {
+		return nil, Permanent(fmt.Errorf("%w by the %q driver", ErrRollbackNotSupported, d.Platform))
+	}
+	return client, nil
+}
+
+// MockPlatformDriver is a mock configuration and monitoring client for a single platform.
+type MockPlatformDriver struct {
+	Platform string
+}
+
+func (m MockPlatformDriver) ConfigureDevice(d Device, config string) error {
+	// Mock implementation
+	log.Printf("[%s] Configuring %s %s (%s) with %d bytes of configuration", m.Platform, d.Vendor, d.Hostname, d.IPAddress, len(config))
+	return nil
+}
+
+func (m MockPlatformDriver) SnapshotConfiguration(d Device) (ConfigSnapshot, error) {
+	// Mock implementation
+	log.Printf("[%s] Saving running configuration of %s (%s)", m.Platform, d.Hostname, d.IPAddress)
+	return ConfigSnapshot{IPAddress: d.IPAddress, TakenAt: time.Now()}, nil
+}
+
+func (m MockPlatformDriver) RestoreConfiguration(d Device, snapshot ConfigSnapshot) error {
+	// Mock implementation
+	log.Printf("[%s] Restoring configuration of %s (%s)", m.Platform, d.Hostname, d.IPAddress)
+	return nil
+}
+
+func (m MockPlatformDriver) MonitorDevice(d Device) error {
+	// Mock implementation
+	log.Printf("[%s] Monitoring %s (%s)", m.Platform, d.Hostname, d.IPAddress)
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type platformRepository map[string]string
+
+func (r platformRepository) GetDevice(ipAddress string) (Device, error) {
+	return Device{IPAddress: ipAddress, Platform: r[ipAddress]}, nil
+}
+
+func TestDriverRegistry(t *testing.T) {
+	junosMonitor := &recordingMonitoringClient{}
+	eosMonitor := &recordingMonitoringClient{}
+
+	registry := NewDriverRegistry()
+	registry.Register(PlatformJunos, Driver{ConfigurationClient: &flakyConfigurationClient{}, MonitoringClient: junosMonitor})
+	registry.Register(PlatformEOS, Driver{ConfigurationClient: MockPlatformDriver{Platform: PlatformEOS}, MonitoringClient: eosMonitor})
+	assert.Equal(t, []string{PlatformEOS, PlatformJunos}, registry.Platforms())
+
+	repo := platformRepository{"10.0.0.1": PlatformJunos, "10.0.0.2": PlatformEOS, "10.0.0.3": "nxos"}
+	handler := NewNetworkHandler(repo, MockConfigRenderer{}, registry, registry, DefaultRetryPolicy())
+
+	assert.NoError(t, handler.PerformNetworkOperation(context.Background(), "10.0.0.1"))
+	assert.NoError(t, handler.PerformNetworkOperation(context.Background(), "10.0.0.2"))
+	assert.Equal(t, []string{"10.0.0.1"}, junosMonitor.monitored)
+	assert.Equal(t, []string{"10.0.0.2"}, eosMonitor.monitored)
+
+	result := handler.performOperation(context.Background(), "10.0.0.3")
+	assert.ErrorIs(t, result.Err, ErrNoDriver)
+	assert.ErrorIs(t, result.Err, ErrPermanent)
+	assert.Equal(t, 1, result.Attempts)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrDryRunNotSupported is returned when the configuration client can't preview changes.
+var ErrDryRunNotSupported = errors.New("dry run not supported")
+
+// DiffingConfigurationClient is an optional extension of ConfigurationClient for
+// clients that can fetch the configuration currently on a device, so the rendered
+// configuration can be compared with it before anything is applied.
+type DiffingConfigurationClient interface {
+	ConfigurationClient
+	RunningConfiguration(d Device) (string, error)
+}
+
+// ConfigDiff is the preview of a configuration change on one device.
+type ConfigDiff struct {
+	IPAddress string
+	Hostname  string
+	// Diff is a unified diff from the running to the intended configuration.
+	Diff string
+	Err  error
+}
+
+// Changed reports whether applying the configuration would change the device.
+func (d ConfigDiff) Changed() bool {
+	return d.Diff != ""
+}
+
+// ChangeReport aggregates the previews of a bulk dry run, in request order.
+type ChangeReport struct {
+	GeneratedAt time.Time
+	Diffs       []ConfigDiff
+	Changed     int
+	Unchanged   int
+	Failed      int
+}
+
+// WriteTo writes the report as plain text, ready to attach to a change ticket.
+func (r ChangeReport) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Change report generated %s\n", r.GeneratedAt.Format(time.RFC3339))
+	fmt.Fprintf(&b, "%d device(s) changed, %d unchanged, %d failed\n", r.Changed, r.Unchanged, r.Failed)
+
+	for _, d := range r.Diffs {
+		name := d.IPAddress
+		if d.Hostname != "" {
+			name = fmt.Sprintf("%s (%s)", d.Hostname, d.IPAddress)
+		}
+
+		fmt.Fprintf(&b, "\n=== %s ===\n", name)
+		switch {
+		case d.Err != nil:
+			fmt.Fprintf(&b, "ERROR: %v\n", d.Err)
+		case !d.Changed():
+			b.WriteString("no changes\n")
+		default:
+			b.WriteString(d.Diff)
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// DryRun shows what PerformNetworkOperation would change on a device without applying it.
+func (n NetworkHandler) DryRun(ctx context.Context, ipAddress string) (ConfigDiff, error) {
+	diff := n.previewOperation(ctx, ipAddress)
+	return diff, diff.Err
+}
+
+// DryRunBulk previews many devices in parallel and aggregates the result into a ChangeReport.
+// MaxFailures in opts works as in PerformBulkOperation.
+func (n NetworkHandler) DryRunBulk(ctx context.Context, ipAddresses []string, opts BulkOptions) (ChangeReport, error) {
+	report := ChangeReport{GeneratedAt: time.Now(), Diffs: make([]ConfigDiff, len(ipAddresses))}
+
+	bulkReport, err := runBulk(ctx, ipAddresses, opts, func(ctx context.Context, i int) DeviceResult {
+		diff := n.previewOperation(ctx, ipAddresses[i])
+		report.Diffs[i] = diff
+		return DeviceResult{IPAddress: diff.IPAddress, Success: diff.Err == nil, Err: diff.Err}
+	})
+
+	for i, result := range bulkReport.Results {
+		switch {
+		case errors.Is(result.Err, ErrSkipped):
+			report.Diffs[i] = ConfigDiff{IPAddress: result.IPAddress, Err: result.Err}
+			report.Failed++
+		case result.Err != nil:
+			report.Failed++
+		case report.Diffs[i].Changed():
+			report.Changed++
+		default:
+			report.Unchanged++
+		}
+	}
+	return report, err
+}
+
+// previewOperation renders the intended configuration and diffs it against the running one.
+func (n NetworkHandler) previewOperation(ctx context.Context, ipAddress string) ConfigDiff {
+	diff := ConfigDiff{IPAddress: ipAddress}
+
+	client, ok := n.configurationClient.(DiffingConfigurationClient)
+	if !ok {
+		diff.Err = Permanent(ErrDryRunNotSupported)
+		return diff
+	}
+
+	device, err := n.deviceRepository.GetDevice(ipAddress)
+	if err != nil {
+		diff.Err = fmt.Errorf("failed to get device: %w", err)
+		return diff
+	}
+	diff.Hostname = device.Hostname
+
+	intended, err := n.configRenderer.Render(device)
+	if err != nil {
+		diff.Err = fmt.Errorf("failed to render device configuration: %w", err)
+		return diff
+	}
+
+	var running string
+	err = retry(ctx, n.retryPolicy, func() error {
+		var err error
+		running, err = client.RunningConfiguration(device)
+		return err
+	})
+	if err != nil {
+		diff.Err = fmt.Errorf("failed to fetch running configuration: %w", err)
+		return diff
+	}
+
+	diff.Diff = unifiedDiff(ipAddress+" running", ipAddress+" intended", running, intended)
+	return diff
+}
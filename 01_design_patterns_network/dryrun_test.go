@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	running := "hostname r1\ninterface Gi1\n description uplink\n mtu 1500\n!\nend\n"
+	intended := "hostname r1\ninterface Gi1\n description core uplink\n mtu 9000\n!\nend\n"
+
+	expected := `--- running
++++ intended
+@@ -1,6 +1,6 @@
+ hostname r1
+ interface Gi1
+- description uplink
+- mtu 1500
++ description core uplink
++ mtu 9000
+ !
+ end
+`
+	assert.Equal(t, expected, unifiedDiff("running", "intended", running, intended))
+	assert.Empty(t, unifiedDiff("running", "intended", running, running))
+
+	long := strings.Repeat("line\n", 20)
+	assert.Equal(t, "--- a\n+++ b\n@@ -18,3 +18,4 @@\n line\n line\n line\n+extra\n", unifiedDiff("a", "b", long, long+"extra\n"))
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  []string
+		edits int
+	}{
+		{"both empty", nil, nil, 0},
+		{"all inserted", nil, []string{"a", "b"}, 2},
+		{"all deleted", []string{"a", "b"}, nil, 2},
+		{"replaced", []string{"a", "b", "c"}, []string{"a", "x", "c"}, 2},
+		{"interleaved", []string{"a", "b", "c", "a", "b", "b", "a"}, []string{"c", "b", "a", "b", "a", "c"}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var a, b []string
+			edits := 0
+			for _, l := range diffLines(tt.a, tt.b) {
+				if l.op != diffInsert {
+					a = append(a, l.text)
+				}
+				if l.op != diffDelete {
+					b = append(b, l.text)
+				}
+				if l.op != diffEqual {
+					edits++
+				}
+			}
+			assert.Equal(t, tt.a, a)
+			assert.Equal(t, tt.b, b)
+			assert.Equal(t, tt.edits, edits)
+		})
+	}
+}
+
+// previewConfigurationClient reports a fixed running configuration per device.
+type previewConfigurationClient struct {
+	MockConfigurationClient
+	running map[string]string
+}
+
+func (c previewConfigurationClient) RunningConfiguration(d Device) (string, error) {
+	running, ok := c.running[d.IPAddress]
+	if !ok {
+		return "", Permanent(errors.New("connection refused"))
+	}
+	return running, nil
+}
+
+func TestDryRunBulk(t *testing.T) {
+	client := previewConfigurationClient{running: map[string]string{
+		"10.0.0.1": "hostname 10.0.0.1\n",
+		"10.0.0.2": "hostname old-name\n",
+	}}
+	handler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, client, MockMonitoringClient{}, DefaultRetryPolicy())
+
+	report, err := handler.DryRunBulk(context.Background(), []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, BulkOptions{Concurrency: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Changed)
+	assert.Equal(t, 1, report.Unchanged)
+	assert.Equal(t, 1, report.Failed)
+	assert.Contains(t, report.Diffs[1].Diff, "-hostname old-name\n+hostname 10.0.0.2\n")
+
+	var text strings.Builder
+	_, err = report.WriteTo(&text)
+	assert.NoError(t, err)
+	assert.Contains(t, text.String(), "1 device(s) changed, 1 unchanged, 1 failed")
+	assert.Contains(t, text.String(), "=== 10.0.0.1 ===\nno changes\n")
+	assert.Contains(t, text.String(), "=== 10.0.0.3 ===\nERROR:")
+
+	_, err = NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, &flakyConfigurationClient{}, MockMonitoringClient{}, DefaultRetryPolicy()).
+		DryRun(context.Background(), "10.0.0.1")
+	assert.ErrorIs(t, err, ErrDryRunNotSupported)
+}
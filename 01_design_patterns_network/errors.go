@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Error classes understood by retry. ConfigurationClient and MonitoringClient
+// implementations wrap their errors with Permanent, Transient or Throttled so the
+// NetworkHandler knows whether another attempt can help.
+var (
+	// ErrPermanent marks failures that will not go away by retrying, such as
+	// rejected credentials or a syntax error in the configuration.
+	ErrPermanent = errors.New("permanent failure")
+	// ErrTransient marks failures that are expected to clear up, such as timeouts.
+	ErrTransient = errors.New("transient failure")
+	// ErrThrottled marks a device or controller asking us to slow down.
+	ErrThrottled = errors.New("throttled")
+)
+
+// ClassifiedError attaches one of the error classes to an underlying error.
+type ClassifiedError struct {
+	// Class is ErrPermanent, ErrTransient or ErrThrottled.
+	Class error
+	// Err is the underlying error reported by the client.
+	Err error
+	// RetryAfter is how long the device asked us to wait. Only set for ErrThrottled.
+	RetryAfter time.Duration
+}
+
+func (e *ClassifiedError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%v (retry after %s): %v", e.Class, e.RetryAfter, e.Err)
+	}
+	return fmt.Sprintf("%v: %v", e.Class, e.Err)
+}
+
+// Unwrap lets errors.Is match both the class and the underlying error.
+func (e *ClassifiedError) Unwrap() []error {
+	return []error{e.Class, e.Err}
+}
+
+// Permanent marks err as not worth retrying.
+func Permanent(err error) error {
+	return &ClassifiedError{Class: ErrPermanent, Err: err}
+}
+
+// Transient marks err as worth retrying.
+func Transient(err error) error {
+	return &ClassifiedError{Class: ErrTransient, Err: err}
+}
+
+// Throttled marks err as a request to back off for at least retryAfter.
+func Throttled(err error, retryAfter time.Duration) error {
+	return &ClassifiedError{Class: ErrThrottled, Err: err, RetryAfter: retryAfter}
+}
+
+// IsRetryable reports whether retry should try again after err.
+// Errors without a class are treated as transient.
+func IsRetryable(err error) bool {
+	return !errors.Is(err, ErrPermanent)
+}
+
+// retryAfter returns the delay a throttled error asked for, or zero.
+func retryAfter(err error) time.Duration {
+	var classified *ClassifiedError
+	if errors.As(err, &classified) && classified.Class == ErrThrottled {
+		return classified.RetryAfter
+	}
+	return 0
+}
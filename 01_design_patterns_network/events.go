@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+)
+
+// DeviceEventSchemaVersion is bumped whenever a field of DeviceEvent changes meaning or is removed.
+const DeviceEventSchemaVersion = 1
+
+// DeviceEventType names a domain event published by NetworkHandler.
+type DeviceEventType string
+
+const (
+	// DeviceConfigured is published when a device was configured and passed monitoring.
+	DeviceConfigured DeviceEventType = "DeviceConfigured"
+	// DeviceConfigurationFailed is published when an operation on a device failed at any stage.
+	DeviceConfigurationFailed DeviceEventType = "DeviceConfigurationFailed"
+	// DeviceMonitoringStarted is published when the new configuration is in place and monitoring begins.
+	DeviceMonitoringStarted DeviceEventType = "DeviceMonitoringStarted"
+	// ConfigDriftDetected is published by DriftDetector when a running configuration no longer matches its intent.
+	ConfigDriftDetected DeviceEventType = "ConfigDriftDetected"
+)
+
+// deviceEventTopics maps every event type to the topic it is published on.
+var deviceEventTopics = map[DeviceEventType]string{
+	DeviceConfigured:          "device-configured",
+	DeviceConfigurationFailed: "device-configuration-failed",
+	DeviceMonitoringStarted:   "device-monitoring-started",
+	ConfigDriftDetected:       "config-drift-detected",
+}
+
+// Topic returns the topic events of this type are published on.
+func (t DeviceEventType) Topic() string {
+	return deviceEventTopics[t]
+}
+
+// EventDevice identifies the device an event is about.
+type EventDevice struct {
+	IPAddress string `json:"ip_address"`
+	Hostname  string `json:"hostname,omitempty"`
+	Vendor    string `json:"vendor,omitempty"`
+	Platform  string `json:"platform,omitempty"`
+	Site      string `json:"site,omitempty"`
+	Role      string `json:"role,omitempty"`
+}
+
+// DeviceEvent is the JSON payload of every event published by NetworkHandler.
+// CorrelationID is the operation ID, so events can be joined with each other and
+// with the audit trail; it is also set as the Watermill correlation ID metadata.
+// For drift events it identifies the drift check instead.
+type DeviceEvent struct {
+	SchemaVersion int             `json:"schema_version"`
+	EventID       string          `json:"event_id"`
+	EventType     DeviceEventType `json:"event_type"`
+	OccurredAt    time.Time       `json:"occurred_at"`
+	CorrelationID string          `json:"correlation_id"`
+	Operator      string          `json:"operator"`
+	Device        EventDevice     `json:"device"`
+	// Stage is the stage the event happened at; for failures, the stage that failed.
+	Stage      Stage  `json:"stage"`
+	Attempts   int    `json:"attempts"`
+	ConfigHash string `json:"config_hash,omitempty"`
+	DiffHash   string `json:"diff_hash,omitempty"`
+	Error      string `json:"error,omitempty"`
+	RolledBack bool   `json:"rolled_back"`
+	// Diff is set on ConfigDriftDetected, from the intended to the running configuration.
+	Diff string `json:"diff,omitempty"`
+}
+
+// WithEventPublisher returns a copy of the handler that publishes DeviceEvents
+// through publisher. Failing to publish is logged but doesn't stop the change.
+func (n NetworkHandler) WithEventPublisher(publisher message.Publisher) NetworkHandler {
+	n.eventPublisher = publisher
+	return n
+}
+
+// publishMonitoringStarted publishes DeviceMonitoringStarted for the operation in ctx.
+func (n NetworkHandler) publishMonitoringStarted(ctx context.Context, result *DeviceResult) {
+	op := operationFromContext(ctx)
+	if n.eventPublisher == nil || op == nil {
+		return
+	}
+
+	event := op.event(DeviceMonitoringStarted)
+	event.Stage = StageMonitor
+	event.Attempts = result.Attempts
+	n.publish(event)
+}
+
+// publishResult publishes DeviceConfigured or DeviceConfigurationFailed for a finished operation.
+func (n NetworkHandler) publishResult(op *operation, result DeviceResult) {
+	if n.eventPublisher == nil {
+		return
+	}
+
+	event := op.event(DeviceConfigured)
+	if !result.Success {
+		event = op.event(DeviceConfigurationFailed)
+		event.Stage = result.FailedStage
+		event.RolledBack = result.Rollback.Succeeded()
+		if result.Err != nil {
+			event.Error = result.Err.Error()
+		}
+	}
+	event.Attempts = result.Attempts
+	n.publish(event)
+}
+
+func (n NetworkHandler) publish(event DeviceEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("failed to encode %s event for device %s: %v", event.EventType, event.Device.IPAddress, err)
+		return
+	}
+
+	msg := message.NewMessage(event.EventID, payload)
+	middleware.SetCorrelationID(event.CorrelationID, msg)
+	msg.Metadata.Set("event_type", string(event.EventType))
+
+	if err := n.eventPublisher.Publish(event.EventType.Topic(), msg); err != nil {
+		log.Printf("failed to publish %s event for device %s: %v", event.EventType, event.Device.IPAddress, err)
+	}
+}
+
+func (op *operation) event(eventType DeviceEventType) DeviceEvent {
+	event := newDeviceEvent(eventType, op.id, op.operator, op.device)
+	event.ConfigHash = op.configHash
+	event.DiffHash = op.diffHash
+	return event
+}
+
+func newDeviceEvent(eventType DeviceEventType, correlationID, operator string, device Device) DeviceEvent {
+	return DeviceEvent{
+		SchemaVersion: DeviceEventSchemaVersion,
+		EventID:       watermill.NewUUID(),
+		EventType:     eventType,
+		OccurredAt:    time.Now(),
+		CorrelationID: correlationID,
+		Operator:      operator,
+		Device: EventDevice{
+			IPAddress: device.IPAddress,
+			Hostname:  device.Hostname,
+			Vendor:    device.Vendor,
+			Platform:  device.Platform,
+			Site:      device.Site,
+			Role:      device.Role,
+		},
+	}
+}
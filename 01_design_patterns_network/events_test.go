@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/stretchr/testify/assert"
+)
+
+func receiveEvent(t *testing.T, messages <-chan *message.Message) (DeviceEvent, *message.Message) {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		msg.Ack()
+		var event DeviceEvent
+		assert.NoError(t, json.Unmarshal(msg.Payload, &event))
+		return event, msg
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+		return DeviceEvent{}, nil
+	}
+}
+
+func TestDeviceEvents(t *testing.T) {
+	ctx := context.Background()
+	pubSub := gochannel.NewGoChannel(gochannel.Config{OutputChannelBuffer: 10}, watermill.NopLogger{})
+	defer pubSub.Close()
+
+	configured, err := pubSub.Subscribe(ctx, DeviceConfigured.Topic())
+	assert.NoError(t, err)
+	failed, err := pubSub.Subscribe(ctx, DeviceConfigurationFailed.Topic())
+	assert.NoError(t, err)
+	monitoring, err := pubSub.Subscribe(ctx, DeviceMonitoringStarted.Topic())
+	assert.NoError(t, err)
+
+	t.Run("publishes monitoring started and configured", func(t *testing.T) {
+		handler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, MockConfigurationClient{}, MockMonitoringClient{}, DefaultRetryPolicy()).
+			WithEventPublisher(pubSub)
+
+		result := handler.performOperation(WithOperator(ctx, "alice"), "10.0.0.1")
+		assert.True(t, result.Success)
+
+		started, _ := receiveEvent(t, monitoring)
+		assert.Equal(t, DeviceMonitoringStarted, started.EventType)
+		assert.Equal(t, StageMonitor, started.Stage)
+
+		event, msg := receiveEvent(t, configured)
+		assert.Equal(t, DeviceConfigured, event.EventType)
+		assert.Equal(t, DeviceEventSchemaVersion, event.SchemaVersion)
+		assert.Equal(t, "10.0.0.1", event.Device.IPAddress)
+		assert.Equal(t, "alice", event.Operator)
+		assert.Equal(t, result.OperationID, event.CorrelationID)
+		assert.Equal(t, result.OperationID, started.CorrelationID)
+		assert.Equal(t, result.OperationID, middleware.MessageCorrelationID(msg))
+		assert.Equal(t, event.EventID, msg.UUID)
+	})
+
+	t.Run("publishes failures with the failed stage", func(t *testing.T) {
+		handler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, &snapshottingConfigurationClient{running: map[string]string{"10.0.0.2": "old"}}, failingMonitoringClient{}, DefaultRetryPolicy()).
+			WithEventPublisher(pubSub)
+
+		result := handler.performOperation(ctx, "10.0.0.2")
+		assert.False(t, result.Success)
+
+		receiveEvent(t, monitoring)
+		event, _ := receiveEvent(t, failed)
+		assert.Equal(t, DeviceConfigurationFailed, event.EventType)
+		assert.Equal(t, StageMonitor, event.Stage)
+		assert.True(t, event.RolledBack)
+		assert.NotEmpty(t, event.Error)
+	})
+
+	t.Run("publishes failed lookups", func(t *testing.T) {
+		handler := NewNetworkHandler(missingDeviceRepository{}, MockConfigRenderer{}, MockConfigurationClient{}, MockMonitoringClient{}, DefaultRetryPolicy()).
+			WithEventPublisher(pubSub)
+
+		result := handler.performOperation(ctx, "10.0.0.9")
+		assert.False(t, result.Success)
+
+		event, _ := receiveEvent(t, failed)
+		assert.Equal(t, StageLookup, event.Stage)
+		assert.Equal(t, "10.0.0.9", event.Device.IPAddress)
+		assert.Equal(t, result.OperationID, event.CorrelationID)
+	})
+}
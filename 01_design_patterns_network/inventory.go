@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrDeviceNotFound is returned by a DeviceRepository that doesn't know the requested IP address.
+var ErrDeviceNotFound = errors.New("device not found")
+
+// FileDeviceRepository is a DeviceRepository backed by an inventory file.
+// The format is picked from the file extension: .yaml/.yml, .json or .csv.
+//
+// YAML and JSON files hold a list of devices. CSV files have a header row using
+// the same field names, with tags separated by semicolons.
+type FileDeviceRepository struct {
+	path string
+
+	mu      sync.RWMutex
+	devices map[string]Device
+	modTime time.Time
+	size    int64
+}
+
+// NewFileDeviceRepository loads the inventory at path.
+func NewFileDeviceRepository(path string) (*FileDeviceRepository, error) {
+	r := &FileDeviceRepository{path: path}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetDevice returns the device with the given IP address, or ErrDeviceNotFound.
+func (r *FileDeviceRepository) GetDevice(ipAddress string) (Device, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	d, ok := r.devices[ipAddress]
+	if !ok {
+		return Device{}, fmt.Errorf("%w: %s", ErrDeviceNotFound, ipAddress)
+	}
+	return d, nil
+}
+
+// Devices returns every device in the inventory, ordered by IP address.
+func (r *FileDeviceRepository) Devices() []Device {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	devices := make([]Device, 0, len(r.devices))
+	for _, d := range r.devices {
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].IPAddress < devices[j].IPAddress
+	})
+	return devices
+}
+
+// Reload reads the inventory file again. On error the previously loaded devices are kept.
+func (r *FileDeviceRepository) Reload() error {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return fmt.Errorf("failed to read inventory: %w", err)
+	}
+
+	devices, err := loadInventory(r.path)
+	if err != nil {
+		return fmt.Errorf("failed to load inventory %s: %w", r.path, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.devices = devices
+	r.modTime = info.ModTime()
+	r.size = info.Size()
+	return nil
+}
+
+// Watch polls the inventory file every interval and reloads it when it changes,
+// until ctx is cancelled. The interval defaults to 30 seconds. A file that fails
+// to load is logged once and the previous inventory stays in use until the file
+// changes again.
+func (r *FileDeviceRepository) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// The last version of the file seen, whether it loaded or not.
+	r.mu.RLock()
+	seenModTime, seenSize := r.modTime, r.size
+	r.mu.RUnlock()
+	statFailed := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(r.path)
+		if err != nil {
+			if !statFailed {
+				log.Printf("failed to check inventory %s: %v", r.path, err)
+			}
+			statFailed = true
+			continue
+		}
+		statFailed = false
+
+		if info.ModTime().Equal(seenModTime) && info.Size() == seenSize {
+			continue
+		}
+		seenModTime, seenSize = info.ModTime(), info.Size()
+
+		if err := r.Reload(); err != nil {
+			log.Printf("keeping previous inventory: %v", err)
+			continue
+		}
+		log.Printf("Reloaded inventory %s", r.path)
+	}
+}
+
+// loadInventory parses an inventory file and indexes it by IP address.
+func loadInventory(path string) (map[string]Device, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var devices []Device
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.NewDecoder(f).Decode(&devices)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	case ".json":
+		err = json.NewDecoder(f).Decode(&devices)
+	case ".csv":
+		devices, err = decodeCSVInventory(f)
+	default:
+		return nil, fmt.Errorf("unsupported inventory format %q", ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	byIP := make(map[string]Device, len(devices))
+	for i, d := range devices {
+		if net.ParseIP(d.IPAddress) == nil {
+			return nil, fmt.Errorf("device %d has invalid IP address %q", i+1, d.IPAddress)
+		}
+		if _, ok := byIP[d.IPAddress]; ok {
+			return nil, fmt.Errorf("device %s is listed more than once", d.IPAddress)
+		}
+		byIP[d.IPAddress] = d
+	}
+	return byIP, nil
+}
+
+// decodeCSVInventory reads devices from CSV with a header row.
+func decodeCSVInventory(r io.Reader) ([]Device, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	columns := make(map[string]int, len(records[0]))
+	for i, name := range records[0] {
+		columns[strings.TrimSpace(name)] = i
+	}
+	if _, ok := columns["ip_address"]; !ok {
+		return nil, errors.New("missing ip_address column")
+	}
+
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	devices := make([]Device, 0, len(records)-1)
+	for _, record := range records[1:] {
+		d := Device{
+			IPAddress:      field(record, "ip_address"),
+			Hostname:       field(record, "hostname"),
+			Vendor:         field(record, "vendor"),
+			Platform:       field(record, "platform"),
+			OSVersion:      field(record, "os_version"),
+			Model:          field(record, "model"),
+			Site:           field(record, "site"),
+			Role:           field(record, "role"),
+			CredentialsRef: field(record, "credentials_ref"),
+		}
+		if tags := field(record, "tags"); tags != "" {
+			for _, tag := range strings.Split(tags, ";") {
+				d.Tags = append(d.Tags, strings.TrimSpace(tag))
+			}
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
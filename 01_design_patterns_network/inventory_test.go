@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const yamlInventory = `
+- ip_address: 10.0.0.1
+  hostname: lon-pe-01
+  vendor: cisco
+  platform: iosxe
+  site: lon
+  role: pe
+  tags: [production, mpls]
+- ip_address: 10.0.0.2
+  hostname: ams-pe-01
+  vendor: juniper
+  platform: junos
+  site: ams
+  role: pe
+`
+
+const jsonInventory = `[
+  {"ip_address": "10.0.0.1", "hostname": "lon-pe-01", "vendor": "cisco", "platform": "iosxe", "site": "lon", "role": "pe", "tags": ["production", "mpls"]},
+  {"ip_address": "10.0.0.2", "hostname": "ams-pe-01", "vendor": "juniper", "platform": "junos", "site": "ams", "role": "pe"}
+]`
+
+const csvInventory = `ip_address,hostname,vendor,platform,site,role,tags
+10.0.0.1,lon-pe-01,cisco,iosxe,lon,pe,production;mpls
+10.0.0.2,ams-pe-01,juniper,junos,ams,pe,
+`
+
+func writeInventory(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+func TestFileDeviceRepository(t *testing.T) {
+	for name, content := range map[string]string{
+		"inventory.yaml": yamlInventory,
+		"inventory.json": jsonInventory,
+		"inventory.csv":  csvInventory,
+	} {
+		t.Run(name, func(t *testing.T) {
+			repo, err := NewFileDeviceRepository(writeInventory(t, name, content))
+			assert.NoError(t, err)
+
+			d, err := repo.GetDevice("10.0.0.1")
+			assert.NoError(t, err)
+			assert.Equal(t, Device{
+				IPAddress: "10.0.0.1",
+				Hostname:  "lon-pe-01",
+				Vendor:    "cisco",
+				Platform:  "iosxe",
+				Site:      "lon",
+				Role:      "pe",
+				Tags:      []string{"production", "mpls"},
+			}, d)
+			assert.Len(t, repo.Devices(), 2)
+
+			_, err = repo.GetDevice("192.0.2.1")
+			assert.ErrorIs(t, err, ErrDeviceNotFound)
+		})
+	}
+
+	t.Run("rejects invalid inventories", func(t *testing.T) {
+		_, err := NewFileDeviceRepository(writeInventory(t, "inventory.json", `[{"ip_address": "not-an-ip"}]`))
+		assert.Error(t, err)
+
+		_, err = NewFileDeviceRepository(writeInventory(t, "inventory.txt", ""))
+		assert.Error(t, err)
+	})
+}
+
+func TestFileDeviceRepositoryWatch(t *testing.T) {
+	path := writeInventory(t, "inventory.json", `[{"ip_address": "10.0.0.1"}]`)
+	repo, err := NewFileDeviceRepository(path)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go repo.Watch(ctx, 10*time.Millisecond)
+
+	assert.NoError(t, os.WriteFile(path, []byte(`[{"ip_address": "10.0.0.1"}, {"ip_address": "10.0.0.2"}]`), 0o644))
+	assert.Eventually(t, func() bool {
+		_, err := repo.GetDevice("10.0.0.2")
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	// A broken file keeps the last good inventory, and is only reported once.
+	logs := captureLog(t)
+	assert.NoError(t, os.WriteFile(path, []byte(`not json`), 0o644))
+	time.Sleep(100 * time.Millisecond)
+	_, err = repo.GetDevice("10.0.0.2")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(logs.String(), "keeping previous inventory"))
+}
+
+// syncBuffer is a bytes.Buffer that can be written and read from different goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog sends the standard logger's output to a buffer until the test ends.
+func captureLog(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return buf
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrDeviceBusy is returned when another operation holds the lock on a device.
+var ErrDeviceBusy = errors.New("device busy")
+
+// ErrLockNotHeld is returned when releasing a lock that expired or was taken over.
+var ErrLockNotHeld = errors.New("lock not held")
+
+// ErrStaleFencingToken is returned by a FencedConfigurationClient for a write made
+// under a lease that has since been granted to someone else.
+var ErrStaleFencingToken = errors.New("stale fencing token")
+
+// ErrFencingNotSupported is returned by ConfigurationClient wrappers whose wrapped
+// client doesn't take fencing tokens.
+var ErrFencingNotSupported = errors.New("fencing tokens not supported")
+
+// DeviceLock is a lease on a device. Token is a fencing token that increases with
+// every lock granted, so a client that still acts on an expired lease can be told
+// apart from the current holder. NetworkHandler passes it to clients that
+// implement FencedConfigurationClient.
+type DeviceLock struct {
+	IPAddress string
+	Owner     string
+	Token     int64
+	ExpiresAt time.Time
+}
+
+// FencedConfigurationClient is a ConfigurationClient that takes the fencing token
+// of the device lock with each write. It should remember the highest token seen for
+// a device, or pass it on to a device that does, and refuse writes with a lower
+// one with ErrStaleFencingToken. Commit confirmed writes and rollbacks aren't fenced.
+type FencedConfigurationClient interface {
+	ConfigurationClient
+	ConfigureDeviceFenced(d Device, config string, token int64) error
+}
+
+// LockManager hands out exclusive, expiring locks on devices.
+type LockManager interface {
+	// TryLock takes the lock on a device or fails straight away with ErrDeviceBusy.
+	TryLock(ctx context.Context, ipAddress, owner string, ttl time.Duration) (DeviceLock, error)
+	// Renew extends a lease by ttl from now. It returns ErrLockNotHeld if the lease
+	// is no longer ours.
+	Renew(ctx context.Context, lock DeviceLock, ttl time.Duration) (DeviceLock, error)
+	// Unlock releases a lock. It returns ErrLockNotHeld if the lease is no longer ours.
+	Unlock(ctx context.Context, lock DeviceLock) error
+	// IsLocked reports whether anyone currently holds the lock on a device.
+	IsLocked(ctx context.Context, ipAddress string) (bool, error)
+}
+
+// LockOptions controls how NetworkHandler locks devices.
+type LockOptions struct {
+	// Owner identifies this process in lock diagnostics. Defaults to hostname and PID.
+	Owner string
+	// TTL is the lease length. The lease is renewed every third of the TTL while the
+	// operation runs. Defaults to 5 minutes.
+	TTL time.Duration
+	// Wait is how long to wait for a busy device. Zero fails straight away with ErrDeviceBusy.
+	Wait time.Duration
+	// PollInterval is how often a busy device is checked while waiting. Defaults to 500ms.
+	PollInterval time.Duration
+}
+
+// WithLocking returns a copy of the handler that holds a device lock around the
+// configure and monitor sequence, so two operations never change the same device at once.
+// If the lease is lost, e.g. because renewing it failed for longer than the TTL, the
+// operation is cancelled.
+func (n NetworkHandler) WithLocking(locks LockManager, opts LockOptions) NetworkHandler {
+	if opts.Owner == "" {
+		hostname, _ := os.Hostname()
+		opts.Owner = fmt.Sprintf("%s:%d", hostname, os.Getpid())
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 5 * time.Minute
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 500 * time.Millisecond
+	}
+	n.lockManager = locks
+	n.lockOptions = opts
+	return n
+}
+
+// lockDevice takes the device lock, waiting up to opts.Wait for it to become free.
+func (n NetworkHandler) lockDevice(ctx context.Context, ipAddress string) (DeviceLock, error) {
+	opts := n.lockOptions
+	deadline := time.Now().Add(opts.Wait)
+
+	for {
+		lock, err := n.lockManager.TryLock(ctx, ipAddress, opts.Owner, opts.TTL)
+		if !errors.Is(err, ErrDeviceBusy) || !time.Now().Add(opts.PollInterval).Before(deadline) {
+			return lock, err
+		}
+
+		timer := time.NewTimer(opts.PollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return DeviceLock{}, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// holdLock renews lock every third of the TTL until the returned stop function is
+// called. If the lease is lost, the returned context is cancelled with an error
+// wrapping ErrLockNotHeld, so the operation stops instead of carrying on under a
+// lease someone else may have been granted. Writes already in flight are what
+// the fencing token is for.
+func (n NetworkHandler) holdLock(ctx context.Context, lock DeviceLock) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(n.lockOptions.TTL / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			renewed, err := n.lockManager.Renew(ctx, lock, n.lockOptions.TTL)
+			if err == nil {
+				lock = renewed
+				continue
+			}
+			if errors.Is(err, ErrLockNotHeld) || !time.Now().Before(lock.ExpiresAt) {
+				cancel(fmt.Errorf("%w: lost the lease on device %s: %w", ErrLockNotHeld, lock.IPAddress, err))
+				return
+			}
+			log.Printf("failed to renew lock on device %s: %v", lock.IPAddress, err)
+		}
+	}()
+
+	return ctx, func() {
+		close(done)
+		wg.Wait()
+		cancel(nil)
+	}
+}
+
+// configure writes config to the device, passing the fencing token of the device
+// lock to clients that take one.
+func (n NetworkHandler) configure(ctx context.Context, device Device, config string) error {
+	if token := fencingToken(ctx); token != 0 {
+		if client, ok := n.configurationClient.(FencedConfigurationClient); ok {
+			err := client.ConfigureDeviceFenced(device, config, token)
+			if !errors.Is(err, ErrFencingNotSupported) {
+				return err
+			}
+		}
+	}
+	return n.configurationClient.ConfigureDevice(device, config)
+}
+
+// fencingToken returns the fencing token of the device lock held by the operation
+// in ctx, or zero if it holds none.
+func fencingToken(ctx context.Context) int64 {
+	if op := operationFromContext(ctx); op != nil {
+		return op.fencingToken
+	}
+	return 0
+}
+
+// MemoryLockManager is a LockManager for a single process.
+type MemoryLockManager struct {
+	mu        sync.Mutex
+	locks     map[string]DeviceLock
+	lastToken int64
+	now       func() time.Time
+}
+
+// NewMemoryLockManager is a constructor for the MemoryLockManager struct.
+func NewMemoryLockManager() *MemoryLockManager {
+	return &MemoryLockManager{locks: make(map[string]DeviceLock), now: time.Now}
+}
+
+func (m *MemoryLockManager) TryLock(ctx context.Context, ipAddress, owner string, ttl time.Duration) (DeviceLock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	if held, ok := m.locks[ipAddress]; ok && now.Before(held.ExpiresAt) {
+		return DeviceLock{}, fmt.Errorf("%w: %s is locked by %s until %s", ErrDeviceBusy, ipAddress, held.Owner, held.ExpiresAt.Format(time.RFC3339))
+	}
+
+	m.lastToken++
+	lock := DeviceLock{IPAddress: ipAddress, Owner: owner, Token: m.lastToken, ExpiresAt: now.Add(ttl)}
+	m.locks[ipAddress] = lock
+	return lock, nil
+}
+
+func (m *MemoryLockManager) Renew(ctx context.Context, lock DeviceLock, ttl time.Duration) (DeviceLock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	held, ok := m.locks[lock.IPAddress]
+	if !ok || held.Token != lock.Token || !now.Before(held.ExpiresAt) {
+		return DeviceLock{}, fmt.Errorf("%w: %s", ErrLockNotHeld, lock.IPAddress)
+	}
+	held.ExpiresAt = now.Add(ttl)
+	m.locks[lock.IPAddress] = held
+	return held, nil
+}
+
+func (m *MemoryLockManager) Unlock(ctx context.Context, lock DeviceLock) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	held, ok := m.locks[lock.IPAddress]
+	if !ok || held.Token != lock.Token || !m.now().Before(held.ExpiresAt) {
+		return fmt.Errorf("%w: %s", ErrLockNotHeld, lock.IPAddress)
+	}
+	delete(m.locks, lock.IPAddress)
+	return nil
+}
+
+func (m *MemoryLockManager) IsLocked(ctx context.Context, ipAddress string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	held, ok := m.locks[ipAddress]
+	return ok && m.now().Before(held.ExpiresAt), nil
+}
+
+// RedisLockManager is a LockManager shared by every instance using the same Redis.
+// Each lock is a key with a TTL holding "<token>:<owner>"; fencing tokens come from
+// a single counter key.
+type RedisLockManager struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisLockManager is a constructor for the RedisLockManager struct.
+func NewRedisLockManager(client *redis.Client) RedisLockManager {
+	return RedisLockManager{client: client, prefix: "device-lock:"}
+}
+
+// unlockScript deletes the lock only if it still holds our value.
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// renewScript extends the lock only if it still holds our value.
+var renewScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+func (r RedisLockManager) TryLock(ctx context.Context, ipAddress, owner string, ttl time.Duration) (DeviceLock, error) {
+	token, err := r.client.Incr(ctx, r.prefix+"fencing-token").Result()
+	if err != nil {
+		return DeviceLock{}, fmt.Errorf("failed to get fencing token: %w", err)
+	}
+
+	lock := DeviceLock{IPAddress: ipAddress, Owner: owner, Token: token, ExpiresAt: time.Now().Add(ttl)}
+	ok, err := r.client.SetNX(ctx, r.prefix+ipAddress, lockValue(lock), ttl).Result()
+	if err != nil {
+		return DeviceLock{}, fmt.Errorf("failed to lock device %s: %w", ipAddress, err)
+	}
+	if !ok {
+		holder, _ := r.client.Get(ctx, r.prefix+ipAddress).Result()
+		_, holderOwner, _ := strings.Cut(holder, ":")
+		return DeviceLock{}, fmt.Errorf("%w: %s is locked by %s", ErrDeviceBusy, ipAddress, holderOwner)
+	}
+
+	return lock, nil
+}
+
+func (r RedisLockManager) Renew(ctx context.Context, lock DeviceLock, ttl time.Duration) (DeviceLock, error) {
+	expiresAt := time.Now().Add(ttl)
+	renewed, err := renewScript.Run(ctx, r.client, []string{r.prefix + lock.IPAddress}, lockValue(lock), ttl.Milliseconds()).Int()
+	if err != nil {
+		return DeviceLock{}, fmt.Errorf("failed to renew lock on device %s: %w", lock.IPAddress, err)
+	}
+	if renewed == 0 {
+		return DeviceLock{}, fmt.Errorf("%w: %s", ErrLockNotHeld, lock.IPAddress)
+	}
+	lock.ExpiresAt = expiresAt
+	return lock, nil
+}
+
+func (r RedisLockManager) Unlock(ctx context.Context, lock DeviceLock) error {
+	deleted, err := unlockScript.Run(ctx, r.client, []string{r.prefix + lock.IPAddress}, lockValue(lock)).Int()
+	if err != nil {
+		return fmt.Errorf("failed to unlock device %s: %w", lock.IPAddress, err)
+	}
+	if deleted == 0 {
+		return fmt.Errorf("%w: %s", ErrLockNotHeld, lock.IPAddress)
+	}
+	return nil
+}
+
+// lockValue is what a lock key holds while the lock is ours.
+func lockValue(lock DeviceLock) string {
+	return strconv.FormatInt(lock.Token, 10) + ":" + lock.Owner
+}
+
+func (r RedisLockManager) IsLocked(ctx context.Context, ipAddress string) (bool, error) {
+	n, err := r.client.Exists(ctx, r.prefix+ipAddress).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check lock on device %s: %w", ipAddress, err)
+	}
+	return n > 0, nil
+}
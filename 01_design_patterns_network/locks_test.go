@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryLockManager(t *testing.T) {
+	ctx := context.Background()
+	locks := NewMemoryLockManager()
+	now := time.Now()
+	locks.now = func() time.Time { return now }
+
+	first, err := locks.TryLock(ctx, "10.0.0.1", "change-1", time.Minute)
+	assert.NoError(t, err)
+
+	_, err = locks.TryLock(ctx, "10.0.0.1", "change-2", time.Minute)
+	assert.ErrorIs(t, err, ErrDeviceBusy)
+	assert.ErrorContains(t, err, "change-1")
+
+	locked, _ := locks.IsLocked(ctx, "10.0.0.1")
+	assert.True(t, locked)
+
+	// Once the lease expires the device can be taken over, with a newer fencing token.
+	now = now.Add(2 * time.Minute)
+	second, err := locks.TryLock(ctx, "10.0.0.1", "change-2", time.Minute)
+	assert.NoError(t, err)
+	assert.Greater(t, second.Token, first.Token)
+
+	assert.ErrorIs(t, locks.Unlock(ctx, first), ErrLockNotHeld)
+	_, err = locks.Renew(ctx, first, time.Minute)
+	assert.ErrorIs(t, err, ErrLockNotHeld)
+
+	// Renewing moves the expiry on from now.
+	now = now.Add(30 * time.Second)
+	second, err = locks.Renew(ctx, second, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(time.Minute), second.ExpiresAt)
+	now = now.Add(45 * time.Second)
+	locked, _ = locks.IsLocked(ctx, "10.0.0.1")
+	assert.True(t, locked)
+
+	assert.NoError(t, locks.Unlock(ctx, second))
+	locked, _ = locks.IsLocked(ctx, "10.0.0.1")
+	assert.False(t, locked)
+}
+
+func TestRedisLockManager(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	locks := NewRedisLockManager(redis.NewClient(&redis.Options{Addr: server.Addr()}))
+
+	first, err := locks.TryLock(ctx, "10.0.0.1", "change-1", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, "1:change-1", mustGet(t, server, "device-lock:10.0.0.1"))
+
+	_, err = locks.TryLock(ctx, "10.0.0.1", "change-2", time.Minute)
+	assert.ErrorIs(t, err, ErrDeviceBusy)
+	assert.ErrorContains(t, err, "change-1")
+
+	locked, err := locks.IsLocked(ctx, "10.0.0.1")
+	assert.NoError(t, err)
+	assert.True(t, locked)
+
+	// Once the lease expires the device can be taken over, with a newer fencing token.
+	server.FastForward(2 * time.Minute)
+	second, err := locks.TryLock(ctx, "10.0.0.1", "change-2", time.Minute)
+	assert.NoError(t, err)
+	assert.Greater(t, second.Token, first.Token)
+
+	// The stale holder can neither release nor renew the new lease.
+	assert.ErrorIs(t, locks.Unlock(ctx, first), ErrLockNotHeld)
+	_, err = locks.Renew(ctx, first, time.Minute)
+	assert.ErrorIs(t, err, ErrLockNotHeld)
+	locked, _ = locks.IsLocked(ctx, "10.0.0.1")
+	assert.True(t, locked)
+
+	server.FastForward(30 * time.Second)
+	_, err = locks.Renew(ctx, second, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, server.TTL("device-lock:10.0.0.1"))
+
+	assert.NoError(t, locks.Unlock(ctx, second))
+	locked, _ = locks.IsLocked(ctx, "10.0.0.1")
+	assert.False(t, locked)
+}
+
+func mustGet(t *testing.T, server *miniredis.Miniredis, key string) string {
+	t.Helper()
+	value, err := server.Get(key)
+	assert.NoError(t, err)
+	return value
+}
+
+func TestNetworkHandlerLocking(t *testing.T) {
+	ctx := context.Background()
+	locks := NewMemoryLockManager()
+	handler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, MockConfigurationClient{}, MockMonitoringClient{}, DefaultRetryPolicy()).
+		WithLocking(locks, LockOptions{Owner: "test", TTL: time.Minute})
+
+	assert.NoError(t, handler.PerformNetworkOperation(ctx, "10.0.0.1"))
+	locked, _ := locks.IsLocked(ctx, "10.0.0.1")
+	assert.False(t, locked, "lock should be released after the operation")
+
+	held, err := locks.TryLock(ctx, "10.0.0.1", "someone-else", time.Minute)
+	assert.NoError(t, err)
+
+	result := handler.performOperation(ctx, "10.0.0.1")
+	assert.Equal(t, StageLock, result.FailedStage)
+	assert.ErrorIs(t, result.Err, ErrDeviceBusy)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		locks.Unlock(ctx, held)
+	}()
+	waiting := handler.WithLocking(locks, LockOptions{Owner: "test", TTL: time.Minute, Wait: time.Second, PollInterval: 10 * time.Millisecond})
+	assert.NoError(t, waiting.PerformNetworkOperation(ctx, "10.0.0.1"))
+
+	t.Run("defaults the lease", func(t *testing.T) {
+		defaulted := handler.WithLocking(locks, LockOptions{Owner: "test"})
+		assert.Equal(t, 5*time.Minute, defaulted.lockOptions.TTL)
+	})
+}
+
+// fencedConfigurationClient refuses writes with a lower fencing token than it has seen.
+type fencedConfigurationClient struct {
+	mu     sync.Mutex
+	tokens map[string]int64
+}
+
+func (c *fencedConfigurationClient) ConfigureDevice(d Device, config string) error {
+	return errors.New("unfenced write")
+}
+
+func (c *fencedConfigurationClient) ConfigureDeviceFenced(d Device, config string, token int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if token < c.tokens[d.IPAddress] {
+		return Permanent(fmt.Errorf("%w: %d for device %s", ErrStaleFencingToken, token, d.IPAddress))
+	}
+	c.tokens[d.IPAddress] = token
+	return nil
+}
+
+// leaseCheckingMonitoringClient runs check once the lease it was called under would
+// have expired without renewal.
+type leaseCheckingMonitoringClient struct {
+	wait  time.Duration
+	check func(d Device) error
+}
+
+func (c leaseCheckingMonitoringClient) MonitorDevice(d Device) error {
+	time.Sleep(c.wait)
+	return c.check(d)
+}
+
+func TestNetworkHandlerLockLeases(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("passes the fencing token to the client", func(t *testing.T) {
+		locks := NewMemoryLockManager()
+		client := &fencedConfigurationClient{tokens: map[string]int64{}}
+		handler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, NewBreakerConfigurationClient(client, NewCircuitBreakers(BreakerSettings{}, nil)), MockMonitoringClient{}, DefaultRetryPolicy()).
+			WithLocking(locks, LockOptions{Owner: "test", TTL: time.Minute})
+
+		assert.NoError(t, handler.PerformNetworkOperation(ctx, "10.0.0.1"))
+		assert.Equal(t, locks.lastToken, client.tokens["10.0.0.1"])
+
+		// A write under a lease that has since been granted again is refused.
+		assert.ErrorIs(t, client.ConfigureDeviceFenced(Device{IPAddress: "10.0.0.1"}, "", locks.lastToken-1), ErrStaleFencingToken)
+	})
+
+	t.Run("renews the lease while the operation runs", func(t *testing.T) {
+		locks := NewMemoryLockManager()
+		monitoring := leaseCheckingMonitoringClient{wait: 100 * time.Millisecond, check: func(d Device) error {
+			if locked, _ := locks.IsLocked(ctx, d.IPAddress); !locked {
+				return Permanent(errors.New("lease expired"))
+			}
+			return nil
+		}}
+		handler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, MockConfigurationClient{}, monitoring, DefaultRetryPolicy()).
+			WithLocking(locks, LockOptions{Owner: "test", TTL: 30 * time.Millisecond})
+
+		assert.NoError(t, handler.PerformNetworkOperation(ctx, "10.0.0.1"))
+	})
+
+	t.Run("stops the operation when the lease is lost", func(t *testing.T) {
+		locks := NewMemoryLockManager()
+		monitoring := leaseCheckingMonitoringClient{wait: 50 * time.Millisecond, check: func(d Device) error {
+			return Transient(errors.New("device still converging"))
+		}}
+		policy := RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Millisecond}
+		handler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, MockConfigurationClient{}, monitoring, policy).
+			WithLocking(locks, LockOptions{Owner: "test", TTL: 30 * time.Millisecond})
+
+		go func() {
+			// Take the device over as if the lease had expired.
+			time.Sleep(20 * time.Millisecond)
+			locks.mu.Lock()
+			delete(locks.locks, "10.0.0.1")
+			locks.mu.Unlock()
+			locks.TryLock(ctx, "10.0.0.1", "someone-else", time.Minute)
+		}()
+
+		result := handler.performOperation(ctx, "10.0.0.1")
+		assert.Equal(t, StageMonitor, result.FailedStage)
+		assert.ErrorIs(t, result.Err, ErrLockNotHeld)
+		assert.Less(t, result.Attempts, 5)
+	})
+}
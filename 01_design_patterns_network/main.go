@@ -1,14 +1,40 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
 	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
 )
 
 // Device struct represents a network device in the system.
 type Device struct {
-	IPAddress string
+	IPAddress string   `json:"ip_address" yaml:"ip_address"`
+	Hostname  string   `json:"hostname" yaml:"hostname"`
+	Vendor    string   `json:"vendor" yaml:"vendor"`
+	Platform  string   `json:"platform" yaml:"platform"`
+	OSVersion string   `json:"os_version" yaml:"os_version"`
+	Model     string   `json:"model" yaml:"model"`
+	Site      string   `json:"site" yaml:"site"`
+	Role      string   `json:"role" yaml:"role"`
+	Tags      []string `json:"tags" yaml:"tags"`
+	// CredentialsRef names the credentials to log in with, e.g. a vault path.
+	// The secret itself never lives in the inventory.
+	CredentialsRef string `json:"credentials_ref" yaml:"credentials_ref"`
+}
+
+// HasTag reports whether the device carries the given tag.
+func (d Device) HasTag(tag string) bool {
+	for _, t := range d.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
 }
 
 // DeviceRepository interface represents a component responsible for fetching device information.
@@ -17,8 +43,9 @@ type DeviceRepository interface {
 }
 
 // ConfigurationClient interface represents a component responsible for configuring devices.
+// The configuration to apply is rendered by a ConfigRenderer and passed in.
 type ConfigurationClient interface {
-	ConfigureDevice(d Device) error
+	ConfigureDevice(d Device, config string) error
 }
 
 // MonitoringClient interface represents a component responsible for monitoring devices.
@@ -28,46 +55,220 @@ type MonitoringClient interface {
 
 // NetworkHandler struct is used to handle network operations by interacting with the corresponding components.
 type NetworkHandler struct {
-	deviceRepository   DeviceRepository
+	deviceRepository    DeviceRepository
+	configRenderer      ConfigRenderer
 	configurationClient ConfigurationClient
 	monitoringClient    MonitoringClient
+	retryPolicy         RetryPolicy
+	confirmTimeout      time.Duration
+	lockManager         LockManager
+	lockOptions         LockOptions
+	auditLog            AuditLog
+	eventPublisher      message.Publisher
+	intentStore         IntentStore
+	maintenancePolicy   *MaintenancePolicy
+	windowMode          WindowMode
 }
 
 // NewNetworkHandler is a constructor for the NetworkHandler struct.
 func NewNetworkHandler(
 	deviceRepository DeviceRepository,
+	configRenderer ConfigRenderer,
 	configurationClient ConfigurationClient,
 	monitoringClient MonitoringClient,
+	retryPolicy RetryPolicy,
 ) NetworkHandler {
 	return NetworkHandler{
-		deviceRepository:   deviceRepository,
+		deviceRepository:    deviceRepository,
+		configRenderer:      configRenderer,
 		configurationClient: configurationClient,
 		monitoringClient:    monitoringClient,
+		retryPolicy:         retryPolicy,
 	}
 }
 
 // PerformNetworkOperation method is responsible for performing network operations on a device.
-func (n NetworkHandler) PerformNetworkOperation(ipAddress string) error {
-	device, err := n.deviceRepository.GetDevice(ipAddress)
+// Cancelling ctx stops any pending retries.
+func (n NetworkHandler) PerformNetworkOperation(ctx context.Context, ipAddress string) error {
+	return n.performOperation(ctx, ipAddress).Err
+}
+
+// Stage names a step of a network operation.
+type Stage string
+
+const (
+	StageLookup    Stage = "lookup"
+	StageRender    Stage = "render"
+	StageLock      Stage = "lock"
+	StageSnapshot  Stage = "snapshot"
+	StageConfigure Stage = "configure"
+	StageMonitor   Stage = "monitor"
+	StageConfirm   Stage = "confirm"
+	StageRollback  Stage = "rollback"
+	StageWindow    Stage = "window"
+)
+
+// DeviceResult describes the outcome of a network operation on a single device.
+type DeviceResult struct {
+	IPAddress string
+	// OperationID identifies the operation in the audit trail.
+	OperationID string
+	Success     bool
+	// FailedStage is the stage that failed, empty on success.
+	FailedStage Stage
+	// Attempts counts configuration and monitoring calls, including retries.
+	Attempts int
+	Duration time.Duration
+	Err      error
+	// Rollback reports the compensating rollback run after a failed configure or
+	// monitoring stage.
+	Rollback RollbackResult
+	// MaintenanceOverride is the reason given for changing the device outside its
+	// maintenance window, empty if no override was needed.
+	MaintenanceOverride string
+}
+
+// performOperation looks up the device and then configures and monitors it. The
+// lookup is part of the operation, so a device that can't be found is audited
+// and published like any other failure.
+func (n NetworkHandler) performOperation(ctx context.Context, ipAddress string) DeviceResult {
+	start := time.Now()
+	return n.runOperation(ctx, Device{IPAddress: ipAddress}, func(ctx context.Context, op *operation) DeviceResult {
+		device, err := n.deviceRepository.GetDevice(ipAddress)
+		if err != nil {
+			return DeviceResult{
+				IPAddress:   ipAddress,
+				OperationID: op.id,
+				FailedStage: StageLookup,
+				Duration:    time.Since(start),
+				Err:         fmt.Errorf("failed to get device: %w", err),
+			}
+		}
+		op.device = device
+
+		result := n.applyDevice(ctx, op, device)
+		result.Duration = time.Since(start)
+		return result
+	})
+}
+
+// operateDevice renders, configures and then monitors an already resolved device.
+func (n NetworkHandler) operateDevice(ctx context.Context, device Device) DeviceResult {
+	return n.runOperation(ctx, device, func(ctx context.Context, op *operation) DeviceResult {
+		return n.applyDevice(ctx, op, device)
+	})
+}
+
+// runOperation starts an operation on device, runs f and then records and
+// publishes its result.
+func (n NetworkHandler) runOperation(ctx context.Context, device Device, f func(context.Context, *operation) DeviceResult) (result DeviceResult) {
+	ctx, op := startOperation(ctx, device)
+	defer func() {
+		n.finishOperation(op, result)
+		n.publishResult(op, result)
+	}()
+	return f(ctx, op)
+}
+
+// applyDevice renders, configures and then monitors device as part of op.
+// If the configuration client supports commit confirmed, the change is only
+// confirmed once monitoring succeeds. Otherwise, if the client can roll back, a
+// failed configure or monitoring stage restores the configuration the device had before.
+func (n NetworkHandler) applyDevice(ctx context.Context, op *operation, device Device) DeviceResult {
+	start := time.Now()
+	result := DeviceResult{IPAddress: device.IPAddress, OperationID: op.id}
+	fail := func(stage Stage, err error) DeviceResult {
+		result.FailedStage = stage
+		result.Err = err
+		result.Duration = time.Since(start)
+		return result
+	}
+
+	if n.maintenancePolicy != nil {
+		override, err := n.awaitMaintenanceWindow(ctx, device)
+		if err != nil {
+			return fail(StageWindow, err)
+		}
+		result.MaintenanceOverride = override
+		op.override = override
+	}
+
+	config, err := n.configRenderer.Render(device)
 	if err != nil {
-		return fmt.Errorf("failed to get device: %v", err)
+		return fail(StageRender, fmt.Errorf("failed to render device configuration: %w", err))
 	}
+	op.configHash = configHash(config)
+	op.diffHash = configHash(unifiedDiff("intended", "rendered", n.previousIntent(device), config))
 
-	err = retry(func() error {
-		return n.configurationClient.ConfigureDevice(device)
-	})
+	if n.lockManager != nil {
+		lock, err := n.lockDevice(ctx, device.IPAddress)
+		if err != nil {
+			return fail(StageLock, fmt.Errorf("failed to lock device: %w", err))
+		}
+		defer func() {
+			if err := n.lockManager.Unlock(context.WithoutCancel(ctx), lock); err != nil {
+				log.Printf("failed to unlock device %s: %v", device.IPAddress, err)
+			}
+		}()
+		op.fencingToken = lock.Token
+
+		var stopRenewing func()
+		ctx, stopRenewing = n.holdLock(ctx, lock)
+		defer stopRenewing()
+	}
+
+	var stage Stage
+	if client, ok := n.configurationClient.(ConfirmableConfigurationClient); ok && supportsCommitConfirmed(client, device) {
+		stage, err = n.applyConfirmed(ctx, client, device, config, &result)
+	} else {
+		stage, err = n.applyWithRollback(ctx, device, config, &result)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to configure device after retries: %v", err)
+		return fail(stage, err)
 	}
+	n.saveIntent(device, config)
 
-	err = retry(func() error {
-		return n.monitoringClient.MonitorDevice(device)
-	})
+	result.Success = true
+	result.Duration = time.Since(start)
+	return result
+}
+
+// applyWithRollback snapshots the device if possible, configures it and checks it
+// with the monitoring client. It returns the stage that failed, if any.
+func (n NetworkHandler) applyWithRollback(ctx context.Context, device Device, config string, result *DeviceResult) (Stage, error) {
+	snapshot, canRollback, err := n.snapshot(ctx, device)
 	if err != nil {
-		return fmt.Errorf("failed to monitor device after retries: %v", err)
+		return StageSnapshot, fmt.Errorf("failed to snapshot device configuration: %w", err)
 	}
 
-	return nil
+	err = retry(ctx, n.retryPolicy, n.attempt(ctx, StageConfigure, func() error {
+		result.Attempts++
+		return n.configure(ctx, device, config)
+	}))
+	if err != nil {
+		// A failed write may still have changed part of the configuration.
+		err = fmt.Errorf("failed to configure device after retries: %w", err)
+		if canRollback {
+			result.Rollback = n.rollback(ctx, device, snapshot)
+			err = withRollback(err, result.Rollback)
+		}
+		return StageConfigure, err
+	}
+
+	n.publishMonitoringStarted(ctx, result)
+	err = retry(ctx, n.retryPolicy, n.attempt(ctx, StageMonitor, func() error {
+		result.Attempts++
+		return n.monitoringClient.MonitorDevice(device)
+	}))
+	if err != nil {
+		err = fmt.Errorf("failed to monitor device after retries: %w", err)
+		if canRollback {
+			result.Rollback = n.rollback(ctx, device, snapshot)
+			err = withRollback(err, result.Rollback)
+		}
+		return StageMonitor, err
+	}
+	return "", nil
 }
 
 // Mock implementations for the interfaces
@@ -78,42 +279,50 @@ func (m MockDeviceRepository) GetDevice(ipAddress string) (Device, error) {
 	return Device{IPAddress: ipAddress}, nil
 }
 
+type MockConfigRenderer struct{}
+
+func (m MockConfigRenderer) Render(d Device) (string, error) {
+	// Mock implementation
+	return fmt.Sprintf("hostname %s\n", d.IPAddress), nil
+}
+
 type MockConfigurationClient struct{}
 
-func (m MockConfigurationClient) ConfigureDevice(d Device) error {
+func (m MockConfigurationClient) ConfigureDevice(d Device, config string) error {
 	// Mock implementation
-	log.Printf("Configuring device with IP: %s", d.IPAddress)
+	log.Printf("Configuring device with IP: %s (%d bytes of configuration)", d.IPAddress, len(config))
 	return nil
 }
 
-type MockMonitoringClient struct{}
+func (m MockConfigurationClient) SnapshotConfiguration(d Device) (ConfigSnapshot, error) {
+	// Mock implementation
+	log.Printf("Taking configuration snapshot of device with IP: %s", d.IPAddress)
+	return ConfigSnapshot{IPAddress: d.IPAddress, TakenAt: time.Now()}, nil
+}
 
-func (m MockMonitoringClient) MonitorDevice(d Device) error {
+func (m MockConfigurationClient) RestoreConfiguration(d Device, snapshot ConfigSnapshot) error {
 	// Mock implementation
-	log.Printf("Monitoring device with IP: %s", d.IPAddress)
+	log.Printf("Restoring configuration of device with IP: %s from %s", d.IPAddress, snapshot.TakenAt.Format(time.RFC3339))
 	return nil
 }
 
+type MockMonitoringClient struct{}
 
-// retry function to handle operation retries
-func retry(f func() error) error {
-	maxRetries := 3
-	for i := 0; i < maxRetries; i++ {
-		if err := f(); err != nil {
-			time.Sleep(time.Second * 2) // Sleep for 2 seconds before retrying
-			continue
-		}
-		return nil
-	}
-	return fmt.Errorf("reached maximum retries")
+func (m MockMonitoringClient) MonitorDevice(d Device) error {
+	// Mock implementation
+	log.Printf("Monitoring device with IP: %s", d.IPAddress)
+	return nil
 }
 
-
 func main() {
-	networkHandler := NewNetworkHandler(MockDeviceRepository{}, MockConfigurationClient{}, MockMonitoringClient{})
+	networkHandler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, MockConfigurationClient{}, MockMonitoringClient{}, DefaultRetryPolicy())
 	ipAddress := "192.168.1.1"
 
-	if err := networkHandler.PerformNetworkOperation(ipAddress); err != nil {
+	// Ctrl-C aborts the operation, including any retries still waiting to run.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := networkHandler.PerformNetworkOperation(ctx, ipAddress); err != nil {
 		log.Fatalf("Failed to perform network operation: %v", err)
 	}
 }
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrOutsideMaintenanceWindow is returned when a device may not be changed right now.
+var ErrOutsideMaintenanceWindow = errors.New("outside maintenance window")
+
+// ErrChangeFreeze is returned when a change freeze covers the device.
+var ErrChangeFreeze = errors.New("change freeze in effect")
+
+// MaintenanceWindow is a recurring period in which devices may be changed.
+// Sites and Roles select the devices it applies to; empty means all of them.
+type MaintenanceWindow struct {
+	Name  string   `yaml:"name"`
+	Sites []string `yaml:"sites"`
+	Roles []string `yaml:"roles"`
+	// Schedule is a five-field cron expression (minute hour day-of-month month
+	// day-of-week) for when the window opens, e.g. "0 22 * * 6" for Saturdays at 22:00.
+	Schedule string        `yaml:"schedule"`
+	Duration time.Duration `yaml:"duration"`
+	// TimeZone is the IANA time zone the schedule is in. Defaults to UTC.
+	TimeZone string `yaml:"time_zone"`
+
+	cron     cronSchedule
+	location *time.Location
+}
+
+// ChangeFreeze forbids changes between Start and End, even inside a maintenance window.
+type ChangeFreeze struct {
+	Name   string    `yaml:"name"`
+	Sites  []string  `yaml:"sites"`
+	Roles  []string  `yaml:"roles"`
+	Start  time.Time `yaml:"start"`
+	End    time.Time `yaml:"end"`
+	Reason string    `yaml:"reason"`
+}
+
+// MaintenancePolicy decides when each device may be changed. Devices that no
+// window applies to can be changed at any time, unless a freeze covers them.
+type MaintenancePolicy struct {
+	Windows []MaintenanceWindow `yaml:"windows"`
+	Freezes []ChangeFreeze      `yaml:"freezes"`
+}
+
+// MaintenanceDecision is the outcome of checking a device against a MaintenancePolicy.
+type MaintenanceDecision struct {
+	Open bool
+	// Window is the open window that allows the change, if any.
+	Window string
+	// Freeze is the freeze that forbids the change, if any.
+	Freeze string
+	// NextOpen is when the device may next be changed. It is zero if it is open,
+	// or if no window opens within a year.
+	NextOpen time.Time
+}
+
+// Err returns the error for a closed decision, or nil if the device may be changed.
+func (d MaintenanceDecision) Err(ipAddress string) error {
+	switch {
+	case d.Open:
+		return nil
+	case d.Freeze != "":
+		return fmt.Errorf("%w for device %s: %s", ErrChangeFreeze, ipAddress, d.Freeze)
+	case d.NextOpen.IsZero():
+		return fmt.Errorf("%w for device %s: no window opens within a year", ErrOutsideMaintenanceWindow, ipAddress)
+	default:
+		return fmt.Errorf("%w for device %s: next window opens at %s", ErrOutsideMaintenanceWindow, ipAddress, d.NextOpen.Format(time.RFC3339))
+	}
+}
+
+// NewMaintenancePolicy is a constructor for the MaintenancePolicy struct. It
+// validates every window's schedule and time zone.
+func NewMaintenancePolicy(windows []MaintenanceWindow, freezes []ChangeFreeze) (*MaintenancePolicy, error) {
+	p := &MaintenancePolicy{Windows: windows, Freezes: freezes}
+	if err := p.compile(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// LoadMaintenancePolicy reads a MaintenancePolicy from a YAML file.
+func LoadMaintenancePolicy(path string) (*MaintenancePolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read maintenance policy: %w", err)
+	}
+
+	var p MaintenancePolicy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse maintenance policy %s: %w", path, err)
+	}
+	if err := p.compile(); err != nil {
+		return nil, fmt.Errorf("invalid maintenance policy %s: %w", path, err)
+	}
+	return &p, nil
+}
+
+func (p *MaintenancePolicy) compile() error {
+	for i := range p.Windows {
+		w := &p.Windows[i]
+		if w.Duration <= 0 {
+			return fmt.Errorf("window %q: duration must be positive", w.Name)
+		}
+
+		cron, err := parseCron(w.Schedule)
+		if err != nil {
+			return fmt.Errorf("window %q: %w", w.Name, err)
+		}
+		w.cron = cron
+
+		w.location = time.UTC
+		if w.TimeZone != "" {
+			if w.location, err = time.LoadLocation(w.TimeZone); err != nil {
+				return fmt.Errorf("window %q: %w", w.Name, err)
+			}
+		}
+	}
+	for _, f := range p.Freezes {
+		if !f.End.After(f.Start) {
+			return fmt.Errorf("freeze %q: end must be after start", f.Name)
+		}
+	}
+	return nil
+}
+
+// Check decides whether a device may be changed at the given time.
+func (p *MaintenancePolicy) Check(d Device, at time.Time) MaintenanceDecision {
+	for _, f := range p.Freezes {
+		if appliesTo(f.Sites, f.Roles, d) && !at.Before(f.Start) && at.Before(f.End) {
+			decision := p.Check(d, f.End)
+			if decision.Open {
+				decision = MaintenanceDecision{NextOpen: f.End}
+			}
+			decision.Open = false
+			decision.Window = ""
+			decision.Freeze = f.Name
+			if f.Reason != "" {
+				decision.Freeze += " (" + f.Reason + ")"
+			}
+			return decision
+		}
+	}
+
+	var decision MaintenanceDecision
+	restricted := false
+	for _, w := range p.Windows {
+		if !appliesTo(w.Sites, w.Roles, d) {
+			continue
+		}
+		restricted = true
+		if w.isOpen(at) {
+			return MaintenanceDecision{Open: true, Window: w.Name}
+		}
+		next := w.cron.next(at.In(w.location))
+		if !next.IsZero() && (decision.NextOpen.IsZero() || next.Before(decision.NextOpen)) {
+			decision.NextOpen = next
+		}
+	}
+	decision.Open = !restricted
+	return decision
+}
+
+// isOpen reports whether the window has opened within Duration before at.
+func (w MaintenanceWindow) isOpen(at time.Time) bool {
+	local := at.In(w.location).Truncate(time.Minute)
+	for t := local; at.Sub(t) < w.Duration; t = t.Add(-time.Minute) {
+		if w.cron.matches(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func appliesTo(sites, roles []string, d Device) bool {
+	return (len(sites) == 0 || slices.Contains(sites, d.Site)) &&
+		(len(roles) == 0 || slices.Contains(roles, d.Role))
+}
+
+// WindowMode is what NetworkHandler does with an operation outside a maintenance window.
+type WindowMode int
+
+const (
+	// WindowRefuse fails the operation straight away.
+	WindowRefuse WindowMode = iota
+	// WindowQueue waits for the next window to open, or until ctx is cancelled.
+	WindowQueue
+)
+
+// WithMaintenancePolicy returns a copy of the handler that only changes devices
+// while the policy allows it. Operations run with WithMaintenanceOverride bypass it.
+func (n NetworkHandler) WithMaintenancePolicy(policy *MaintenancePolicy, mode WindowMode) NetworkHandler {
+	n.maintenancePolicy = policy
+	n.windowMode = mode
+	return n
+}
+
+type maintenanceOverrideKey struct{}
+
+// WithMaintenanceOverride returns a context whose operations may change devices
+// outside maintenance windows and during freezes. The reason is recorded in the
+// audit trail and in DeviceResult of every operation that needed the override.
+// An override without a reason is ignored.
+func WithMaintenanceOverride(ctx context.Context, reason string) context.Context {
+	return context.WithValue(ctx, maintenanceOverrideKey{}, reason)
+}
+
+func maintenanceOverrideFromContext(ctx context.Context) (string, bool) {
+	reason, _ := ctx.Value(maintenanceOverrideKey{}).(string)
+	reason = strings.TrimSpace(reason)
+	return reason, reason != ""
+}
+
+// awaitMaintenanceWindow returns once the device may be changed. It returns the
+// override reason if the policy was bypassed.
+func (n NetworkHandler) awaitMaintenanceWindow(ctx context.Context, device Device) (string, error) {
+	for {
+		decision := n.maintenancePolicy.Check(device, time.Now())
+		if decision.Open {
+			return "", nil
+		}
+
+		if reason, ok := maintenanceOverrideFromContext(ctx); ok {
+			log.Printf("Changing device %s outside its maintenance window, overridden by %s: %s", device.IPAddress, OperatorFromContext(ctx), reason)
+			return reason, nil
+		}
+		if n.windowMode != WindowQueue || decision.NextOpen.IsZero() {
+			return "", decision.Err(device.IPAddress)
+		}
+
+		timer := time.NewTimer(time.Until(decision.NextOpen))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return "", fmt.Errorf("%w: %w", decision.Err(device.IPAddress), ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// cronSchedule is a parsed five-field cron expression. Each field is a bit set of allowed values.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domRestricted and dowRestricted follow cron: if both day fields are
+	// restricted, a day matches when either of them does.
+	domRestricted, dowRestricted bool
+}
+
+func parseCron(expr string) (cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("schedule %q must have 5 fields", expr)
+	}
+
+	var s cronSchedule
+	var err error
+	bounds := []struct {
+		set      *uint64
+		min, max int
+	}{{&s.minute, 0, 59}, {&s.hour, 0, 23}, {&s.dom, 1, 31}, {&s.month, 1, 12}, {&s.dow, 0, 7}}
+	for i, b := range bounds {
+		if *b.set, err = parseCronField(fields[i], b.min, b.max); err != nil {
+			return cronSchedule{}, fmt.Errorf("schedule %q: %w", expr, err)
+		}
+	}
+
+	// Sunday is both 0 and 7.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domRestricted = fields[2] != "*"
+	s.dowRestricted = fields[4] != "*"
+	return s, nil
+}
+
+// parseCronField parses a comma-separated list of "*", "n", "n-m", each optionally with a "/step".
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+
+		lo, hi := min, max
+		if rangePart != "*" {
+			from, to, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", part)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func (s cronSchedule) matches(t time.Time) bool {
+	return s.minute&(1<<t.Minute()) != 0 &&
+		s.hour&(1<<t.Hour()) != 0 &&
+		s.month&(1<<int(t.Month())) != 0 &&
+		s.dayMatches(t)
+}
+
+func (s cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<int(t.Weekday())) != 0
+	if s.domRestricted && s.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// next returns the first time after t that matches the schedule, in t's location,
+// or the zero time if there is none within a year.
+func (s cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(1, 0, 0)
+
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<int(t.Month())) == 0 || !s.dayMatches(t):
+			y, m, d := t.Date()
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<t.Hour()) == 0:
+			y, m, d := t.Date()
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, expr := range []string{"0 22 * * 6", "*/15 0-6 1,15 * 1-5", "30 2 * 1-3/2 7"} {
+		_, err := parseCron(expr)
+		assert.NoError(t, err, expr)
+	}
+	for _, expr := range []string{"", "0 22 * *", "60 * * * *", "0 22 * * 8", "*/0 * * * *", "5-1 * * * *"} {
+		_, err := parseCron(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestMaintenancePolicy(t *testing.T) {
+	amsterdam, err := time.LoadLocation("Europe/Amsterdam")
+	assert.NoError(t, err)
+
+	policy, err := NewMaintenancePolicy([]MaintenanceWindow{{
+		Name:     "ams-core-weekend",
+		Sites:    []string{"ams1"},
+		Roles:    []string{"core"},
+		Schedule: "0 22 * * 6",
+		Duration: 4 * time.Hour,
+		TimeZone: "Europe/Amsterdam",
+	}}, []ChangeFreeze{{
+		Name:   "year-end",
+		Start:  time.Date(2024, 12, 20, 0, 0, 0, 0, time.UTC),
+		End:    time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC),
+		Reason: "holidays",
+	}})
+	assert.NoError(t, err)
+
+	core := Device{IPAddress: "10.0.0.1", Site: "ams1", Role: "core"}
+	edge := Device{IPAddress: "10.0.0.2", Site: "ams1", Role: "edge"}
+
+	// Saturday 4 May 2024, 22:30 in Amsterdam is 20:30 UTC.
+	decision := policy.Check(core, time.Date(2024, 5, 4, 20, 30, 0, 0, time.UTC))
+	assert.True(t, decision.Open)
+	assert.Equal(t, "ams-core-weekend", decision.Window)
+
+	decision = policy.Check(core, time.Date(2024, 5, 5, 1, 59, 0, 0, amsterdam))
+	assert.True(t, decision.Open)
+
+	decision = policy.Check(core, time.Date(2024, 5, 5, 2, 0, 0, 0, amsterdam))
+	assert.False(t, decision.Open)
+	assert.True(t, decision.NextOpen.Equal(time.Date(2024, 5, 11, 22, 0, 0, 0, amsterdam)))
+	assert.ErrorIs(t, decision.Err(core.IPAddress), ErrOutsideMaintenanceWindow)
+
+	decision = policy.Check(edge, time.Date(2024, 5, 5, 2, 0, 0, 0, amsterdam))
+	assert.True(t, decision.Open, "devices without a window are unrestricted")
+
+	decision = policy.Check(edge, time.Date(2024, 12, 24, 12, 0, 0, 0, time.UTC))
+	assert.False(t, decision.Open)
+	assert.Equal(t, "year-end (holidays)", decision.Freeze)
+	assert.True(t, decision.NextOpen.Equal(time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC)))
+	assert.ErrorIs(t, decision.Err(edge.IPAddress), ErrChangeFreeze)
+
+	decision = policy.Check(core, time.Date(2024, 12, 28, 22, 30, 0, 0, amsterdam))
+	assert.False(t, decision.Open, "a freeze closes an open window")
+	assert.True(t, decision.NextOpen.Equal(time.Date(2025, 1, 11, 22, 0, 0, 0, amsterdam)))
+}
+
+func TestLoadMaintenancePolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "maintenance.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`
+windows:
+  - name: nightly
+    roles: [edge]
+    schedule: "0 1 * * *"
+    duration: 2h
+    time_zone: America/New_York
+freezes:
+  - name: launch
+    sites: [nyc1]
+    start: 2024-06-01T00:00:00Z
+    end: 2024-06-03T00:00:00Z
+`), 0o644))
+
+	policy, err := LoadMaintenancePolicy(path)
+	assert.NoError(t, err)
+	assert.Len(t, policy.Windows, 1)
+	assert.Equal(t, 2*time.Hour, policy.Windows[0].Duration)
+	assert.Equal(t, "launch", policy.Freezes[0].Name)
+
+	assert.NoError(t, os.WriteFile(path, []byte("windows:\n  - name: bad\n    schedule: \"0 1 * *\"\n    duration: 1h\n"), 0o644))
+	_, err = LoadMaintenancePolicy(path)
+	assert.Error(t, err)
+}
+
+func TestMaintenanceEnforcement(t *testing.T) {
+	ctx := context.Background()
+	newHandler := func(freezeEnd time.Time, mode WindowMode) NetworkHandler {
+		policy, err := NewMaintenancePolicy(nil, []ChangeFreeze{{Name: "incident", Start: time.Now().Add(-time.Hour), End: freezeEnd}})
+		assert.NoError(t, err)
+		return NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, MockConfigurationClient{}, MockMonitoringClient{}, DefaultRetryPolicy()).
+			WithMaintenancePolicy(policy, mode)
+	}
+
+	t.Run("refuses outside a window", func(t *testing.T) {
+		result := newHandler(time.Now().Add(time.Hour), WindowRefuse).performOperation(ctx, "10.0.0.1")
+		assert.Equal(t, StageWindow, result.FailedStage)
+		assert.ErrorIs(t, result.Err, ErrChangeFreeze)
+	})
+
+	t.Run("records overrides", func(t *testing.T) {
+		auditLog := NewJSONLinesAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"))
+		handler := newHandler(time.Now().Add(time.Hour), WindowRefuse).WithAuditLog(auditLog)
+
+		result := handler.performOperation(WithMaintenanceOverride(ctx, "INC-1234 outage fix"), "10.0.0.1")
+		assert.True(t, result.Success)
+		assert.Equal(t, "INC-1234 outage fix", result.MaintenanceOverride)
+
+		entries, err := auditLog.Query(AuditQuery{OperationID: result.OperationID})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, entries)
+		for _, e := range entries {
+			assert.Equal(t, "INC-1234 outage fix", e.Override)
+		}
+	})
+
+	t.Run("ignores overrides without a reason", func(t *testing.T) {
+		result := newHandler(time.Now().Add(time.Hour), WindowRefuse).performOperation(WithMaintenanceOverride(ctx, "  "), "10.0.0.1")
+		assert.Equal(t, StageWindow, result.FailedStage)
+		assert.ErrorIs(t, result.Err, ErrChangeFreeze)
+		assert.Empty(t, result.MaintenanceOverride)
+	})
+
+	t.Run("queues until the window opens", func(t *testing.T) {
+		start := time.Now()
+		result := newHandler(time.Now().Add(100*time.Millisecond), WindowQueue).performOperation(ctx, "10.0.0.1")
+		assert.True(t, result.Success)
+		assert.Empty(t, result.MaintenanceOverride)
+		assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	})
+
+	t.Run("gives up queueing when ctx is cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		result := newHandler(time.Now().Add(time.Hour), WindowQueue).performOperation(ctx, "10.0.0.1")
+		assert.Equal(t, StageWindow, result.FailedStage)
+		assert.ErrorIs(t, result.Err, ErrChangeFreeze)
+		assert.ErrorIs(t, result.Err, context.DeadlineExceeded)
+	})
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// NETCONF base capabilities and namespace (RFC 6241).
+const (
+	netconfNamespace    = "urn:ietf:params:xml:ns:netconf:base:1.0"
+	netconfBase10       = "urn:ietf:params:netconf:base:1.0"
+	netconfBase11       = "urn:ietf:params:netconf:base:1.1"
+	netconfCandidateCap = "urn:ietf:params:netconf:capability:candidate:1.0"
+)
+
+// ErrNetconfProtocol is returned when a device breaks the NETCONF protocol, e.g.
+// with a malformed reply or a reply to the wrong message.
+var ErrNetconfProtocol = errors.New("netconf protocol error")
+
+// RPCError is an <rpc-error> reported by a NETCONF device (RFC 6241, section 4.3).
+// The client returns it classified by its error-tag, so errors.As finds it and
+// errors.Is(err, ErrPermanent) tells whether retrying can help.
+type RPCError struct {
+	Type     string       `xml:"error-type"`
+	Tag      string       `xml:"error-tag"`
+	Severity string       `xml:"error-severity"`
+	AppTag   string       `xml:"error-app-tag,omitempty"`
+	Path     string       `xml:"error-path,omitempty"`
+	Message  string       `xml:"error-message,omitempty"`
+	Info     RPCErrorInfo `xml:"error-info"`
+}
+
+// RPCErrorInfo holds the standard contents of <error-info>.
+type RPCErrorInfo struct {
+	BadAttribute string `xml:"bad-attribute,omitempty"`
+	BadElement   string `xml:"bad-element,omitempty"`
+	BadNamespace string `xml:"bad-namespace,omitempty"`
+	SessionID    string `xml:"session-id,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	msg := fmt.Sprintf("netconf %s error %s", e.Type, e.Tag)
+	if e.Path != "" {
+		msg += " at " + strings.TrimSpace(e.Path)
+	}
+	if e.Message != "" {
+		msg += ": " + strings.TrimSpace(e.Message)
+	}
+	return msg
+}
+
+// transientRPCErrorTags are the error-tags that describe a temporary condition.
+// Everything else means the request itself is wrong, so it is permanent.
+var transientRPCErrorTags = map[string]bool{
+	"in-use":            true,
+	"lock-denied":       true,
+	"resource-denied":   true,
+	"rollback-failed":   true,
+	"partial-operation": true,
+}
+
+// classify wraps the error with the class its error-tag implies.
+func (e *RPCError) classify() error {
+	if transientRPCErrorTags[e.Tag] {
+		return Transient(e)
+	}
+	return Permanent(e)
+}
+
+// NetconfConfig configures a NetconfClient.
+type NetconfConfig struct {
+	// Port is the NETCONF over SSH port. Defaults to 830.
+	Port int
+	// ClientConfig returns the SSH configuration to log in to a device with, e.g.
+	// by looking up its CredentialsRef. It must set a HostKeyCallback.
+	ClientConfig func(d Device) (*ssh.ClientConfig, error)
+	// DefaultOperation is the edit-config default-operation. Defaults to "merge".
+	DefaultOperation string
+	// Timeout bounds connecting and every RPC. Defaults to 30s.
+	Timeout time.Duration
+}
+
+// NetconfClient is a ConfigurationClient for devices that speak NETCONF over SSH
+// (RFC 6241, RFC 6242). The rendered configuration must be the XML content of a
+// <config> element.
+//
+// Devices with the candidate capability are changed by locking the candidate
+// datastore, editing it and committing it; the others are edited in running. It
+// also implements DiffingConfigurationClient, using get-config on running.
+type NetconfClient struct {
+	config NetconfConfig
+}
+
+// NewNetconfClient is a constructor for the NetconfClient struct.
+func NewNetconfClient(config NetconfConfig) NetconfClient {
+	if config.Port == 0 {
+		config.Port = 830
+	}
+	if config.DefaultOperation == "" {
+		config.DefaultOperation = "merge"
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 30 * time.Second
+	}
+	return NetconfClient{config: config}
+}
+
+func (c NetconfClient) ConfigureDevice(d Device, config string) error {
+	if err := checkXML(config); err != nil {
+		return Permanent(fmt.Errorf("configuration for device %s is not valid XML: %w", d.IPAddress, err))
+	}
+
+	s, err := c.open(d)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	if !s.hasCapability(netconfCandidateCap) {
+		_, err := s.rpc(c.editConfig("running", config))
+		return err
+	}
+
+	if _, err := s.rpc("<lock><target><candidate/></target></lock>"); err != nil {
+		return err
+	}
+	defer s.rpc("<unlock><target><candidate/></target></unlock>")
+
+	if _, err := s.rpc(c.editConfig("candidate", config)); err != nil {
+		s.rpc("<discard-changes/>")
+		return err
+	}
+	if _, err := s.rpc("<commit/>"); err != nil {
+		s.rpc("<discard-changes/>")
+		return err
+	}
+	return nil
+}
+
+func (c NetconfClient) RunningConfiguration(d Device) (string, error) {
+	s, err := c.open(d)
+	if err != nil {
+		return "", err
+	}
+	defer s.close()
+
+	reply, err := s.rpc("<get-config><source><running/></source></get-config>")
+	if err != nil {
+		return "", err
+	}
+	return reply.Data.Content, nil
+}
+
+func (c NetconfClient) editConfig(target, config string) string {
+	return fmt.Sprintf("<edit-config><target><%s/></target><default-operation>%s</default-operation><config>%s</config></edit-config>",
+		target, c.config.DefaultOperation, config)
+}
+
+// open connects to the device and exchanges hellos.
+func (c NetconfClient) open(d Device) (*netconfSession, error) {
+	if c.config.ClientConfig == nil {
+		return nil, Permanent(errors.New("netconf client has no SSH configuration"))
+	}
+	sshConfig, err := c.config.ClientConfig(d)
+	if err != nil {
+		return nil, Permanent(fmt.Errorf("failed to get SSH configuration for device %s: %w", d.IPAddress, err))
+	}
+
+	addr := net.JoinHostPort(d.IPAddress, strconv.Itoa(c.config.Port))
+	conn, err := net.DialTimeout("tcp", addr, c.config.Timeout)
+	if err != nil {
+		return nil, Transient(fmt.Errorf("failed to connect to %s: %w", addr, err))
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(c.config.Timeout)); err != nil {
+		conn.Close()
+		return nil, Transient(fmt.Errorf("failed to set deadline on connection to %s: %w", addr, err))
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+	if err != nil {
+		conn.Close()
+		return nil, classifyHandshakeError(fmt.Errorf("SSH handshake with %s failed: %w", addr, err))
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+
+	s := &netconfSession{conn: conn, client: client, timeout: c.config.Timeout}
+	if err := s.start(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// classifyHandshakeError classifies a failed SSH handshake. A connection that
+// timed out, was reset or dropped halfway through might be fine next time.
+// Everything else, such as rejected credentials or an unknown host key, won't be
+// fixed by retrying.
+func classifyHandshakeError(err error) error {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, os.ErrDeadlineExceeded),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EPIPE),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return Transient(err)
+	default:
+		return Permanent(err)
+	}
+}
+
+// netconfSession is one NETCONF session over an SSH "netconf" subsystem.
+type netconfSession struct {
+	conn         net.Conn
+	client       *ssh.Client
+	session      *ssh.Session
+	framer       *netconfFramer
+	capabilities []string
+	lastID       int
+	timeout      time.Duration
+}
+
+type netconfHello struct {
+	XMLName      xml.Name `xml:"hello"`
+	Capabilities []string `xml:"capabilities>capability"`
+	SessionID    int      `xml:"session-id,omitempty"`
+}
+
+type rpcReply struct {
+	XMLName   xml.Name   `xml:"rpc-reply"`
+	MessageID string     `xml:"message-id,attr"`
+	Errors    []RPCError `xml:"rpc-error"`
+	Data      struct {
+		Content string `xml:",innerxml"`
+	} `xml:"data"`
+}
+
+func (s *netconfSession) start() error {
+	session, err := s.client.NewSession()
+	if err != nil {
+		return Transient(fmt.Errorf("failed to open SSH session: %w", err))
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := session.RequestSubsystem("netconf"); err != nil {
+		return Permanent(fmt.Errorf("device refused the netconf subsystem: %w", err))
+	}
+	s.session = session
+	s.framer = newNetconfFramer(stdout, stdin)
+
+	hello, err := xml.Marshal(netconfHello{
+		XMLName:      xml.Name{Space: netconfNamespace, Local: "hello"},
+		Capabilities: []string{netconfBase10, netconfBase11},
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.framer.writeMessage(hello); err != nil {
+		return Transient(fmt.Errorf("failed to send hello: %w", err))
+	}
+
+	msg, err := s.framer.readMessage()
+	if err != nil {
+		return Transient(fmt.Errorf("failed to read hello: %w", err))
+	}
+	var serverHello netconfHello
+	if err := xml.Unmarshal(msg, &serverHello); err != nil {
+		return Permanent(fmt.Errorf("%w: invalid hello: %w", ErrNetconfProtocol, err))
+	}
+	s.capabilities = serverHello.Capabilities
+
+	switch {
+	case s.hasCapability(netconfBase11):
+		s.framer.chunked = true
+	case !s.hasCapability(netconfBase10):
+		return Permanent(fmt.Errorf("%w: device supports neither base:1.0 nor base:1.1", ErrNetconfProtocol))
+	}
+
+	// The handshake deadline covered the hello; from now on each RPC gets its own.
+	if err := s.conn.SetDeadline(time.Time{}); err != nil {
+		return Transient(fmt.Errorf("failed to clear handshake deadline: %w", err))
+	}
+	return nil
+}
+
+func (s *netconfSession) hasCapability(capability string) bool {
+	for _, c := range s.capabilities {
+		// Capabilities may carry parameters, e.g. "...:candidate:1.0?module=...".
+		if c == capability || strings.HasPrefix(c, capability+"?") {
+			return true
+		}
+	}
+	return false
+}
+
+// rpc sends one operation and waits for its reply. An <rpc-error> with severity
+// "error" is returned as a classified *RPCError; warnings are ignored.
+func (s *netconfSession) rpc(operation string) (rpcReply, error) {
+	s.lastID++
+	id := strconv.Itoa(s.lastID)
+	msg := fmt.Sprintf(`<rpc message-id="%s" xmlns="%s">%s</rpc>`, id, netconfNamespace, operation)
+
+	if err := s.conn.SetDeadline(time.Now().Add(s.timeout)); err != nil {
+		return rpcReply{}, Transient(fmt.Errorf("failed to set rpc deadline: %w", err))
+	}
+	// Clearing the deadline only fails once the connection is closed, and then the
+	// next rpc fails to set its own deadline anyway.
+	defer s.conn.SetDeadline(time.Time{})
+
+	if err := s.framer.writeMessage([]byte(msg)); err != nil {
+		return rpcReply{}, Transient(fmt.Errorf("failed to send rpc: %w", err))
+	}
+	data, err := s.framer.readMessage()
+	if err != nil {
+		return rpcReply{}, Transient(fmt.Errorf("failed to read rpc-reply: %w", err))
+	}
+
+	var reply rpcReply
+	if err := xml.Unmarshal(data, &reply); err != nil {
+		return rpcReply{}, Permanent(fmt.Errorf("%w: invalid rpc-reply: %w", ErrNetconfProtocol, err))
+	}
+	if reply.MessageID != id {
+		return rpcReply{}, Permanent(fmt.Errorf("%w: got reply to message %q, want %q", ErrNetconfProtocol, reply.MessageID, id))
+	}
+	for i := range reply.Errors {
+		if reply.Errors[i].Severity != "warning" {
+			return reply, reply.Errors[i].classify()
+		}
+	}
+	return reply, nil
+}
+
+func (s *netconfSession) close() {
+	s.rpc("<close-session/>")
+	s.session.Close()
+	s.client.Close()
+}
+
+// checkXML reports whether config is well-formed XML content.
+func checkXML(config string) error {
+	d := xml.NewDecoder(strings.NewReader(config))
+	for {
+		_, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// netconfFramer reads and writes NETCONF messages. Sessions start with the
+// end-of-message framing of base:1.0 and switch to the chunked framing of
+// base:1.1 after the hellos if both sides support it (RFC 6242).
+type netconfFramer struct {
+	r       *bufio.Reader
+	w       io.Writer
+	chunked bool
+	// maxMessageSize bounds a message, and so every chunk of it, since RFC 6242
+	// allows chunks of up to 4 GiB.
+	maxMessageSize int
+}
+
+var netconfEOM = []byte("]]>]]>")
+
+// netconfMaxMessageSize is the largest message a framer reads. It is far above any
+// configuration we push or read back.
+const netconfMaxMessageSize = 64 << 20
+
+func newNetconfFramer(r io.Reader, w io.Writer) *netconfFramer {
+	return &netconfFramer{r: bufio.NewReader(r), w: w, maxMessageSize: netconfMaxMessageSize}
+}
+
+func (f *netconfFramer) writeMessage(msg []byte) error {
+	var b bytes.Buffer
+	if f.chunked {
+		fmt.Fprintf(&b, "\n#%d\n", len(msg))
+		b.Write(msg)
+		b.WriteString("\n##\n")
+	} else {
+		b.Write(msg)
+		b.Write(netconfEOM)
+	}
+	_, err := f.w.Write(b.Bytes())
+	return err
+}
+
+func (f *netconfFramer) readMessage() ([]byte, error) {
+	if f.chunked {
+		return f.readChunked()
+	}
+
+	var msg []byte
+	for !bytes.HasSuffix(msg, netconfEOM) {
+		if len(msg) >= f.maxMessageSize+len(netconfEOM) {
+			return nil, fmt.Errorf("%w: message larger than %d bytes", ErrNetconfProtocol, f.maxMessageSize)
+		}
+		b, err := f.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		msg = append(msg, b)
+	}
+	return bytes.TrimSpace(msg[:len(msg)-len(netconfEOM)]), nil
+}
+
+func (f *netconfFramer) readChunked() ([]byte, error) {
+	var msg []byte
+	for {
+		header, err := f.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if header == "\n" {
+			// The newline that starts the chunk header.
+			header, err = f.r.ReadString('\n')
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		size := strings.TrimSuffix(strings.TrimPrefix(header, "#"), "\n")
+		if size == "#" {
+			return msg, nil
+		}
+		n, err := strconv.ParseUint(size, 10, 32)
+		if err != nil || n == 0 || !strings.HasPrefix(header, "#") {
+			return nil, fmt.Errorf("%w: invalid chunk header %q", ErrNetconfProtocol, header)
+		}
+		if n > uint64(f.maxMessageSize-len(msg)) {
+			return nil, fmt.Errorf("%w: chunk of %d bytes makes the message larger than %d bytes", ErrNetconfProtocol, n, f.maxMessageSize)
+		}
+
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(f.r, chunk); err != nil {
+			return nil, err
+		}
+		msg = append(msg, chunk...)
+	}
+}
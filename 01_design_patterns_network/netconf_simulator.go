@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// NetconfSimulatorOptions configures a NetconfSimulator.
+type NetconfSimulatorOptions struct {
+	Username string
+	Password string
+	// Running is the initial running configuration.
+	Running string
+	// NoCandidate makes the device edit running directly, without a candidate datastore.
+	NoCandidate bool
+	// Base10Only makes the device only support the end-of-message framing of base:1.0.
+	Base10Only bool
+	// HandshakeDelay stalls every connection before the SSH handshake, like an overloaded device.
+	HandshakeDelay time.Duration
+}
+
+// NetconfSimulator is an in-process NETCONF over SSH server, for trying
+// NetconfClient without hardware. It supports hello, lock, unlock, edit-config,
+// get-config, commit, discard-changes and close-session. Unlike a real device it
+// doesn't merge configuration: edit-config replaces the target datastore.
+type NetconfSimulator struct {
+	opts     NetconfSimulatorOptions
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.PublicKey
+
+	mu          sync.Mutex
+	running     string
+	candidate   string
+	lockedBy    int
+	lastSession int
+	failures    map[string]RPCError
+}
+
+// NewNetconfSimulator is a constructor for a NetconfSimulator listening on a
+// random local port. Close must be called to stop it.
+func NewNetconfSimulator(opts NetconfSimulatorOptions) (*NetconfSimulator, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &NetconfSimulator{
+		opts:      opts,
+		listener:  listener,
+		hostKey:   signer.PublicKey(),
+		running:   opts.Running,
+		candidate: opts.Running,
+		failures:  make(map[string]RPCError),
+	}
+	s.config = &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == opts.Username && string(password) == opts.Password {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("invalid credentials for %s", conn.User())
+		},
+	}
+	s.config.AddHostKey(signer)
+
+	go s.serve()
+	return s, nil
+}
+
+// Port returns the port the simulator listens on.
+func (s *NetconfSimulator) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// ClientConfig returns an SSH configuration that logs in with the given
+// credentials and only trusts the simulator's host key.
+func (s *NetconfSimulator) ClientConfig(username, password string) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: ssh.FixedHostKey(s.hostKey),
+	}
+}
+
+// Running returns the running configuration.
+func (s *NetconfSimulator) Running() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+// FailNext makes the next RPC with the given operation name, e.g. "commit", fail with rpcErr.
+func (s *NetconfSimulator) FailNext(operation string, rpcErr RPCError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[operation] = rpcErr
+}
+
+// Close stops accepting connections.
+func (s *NetconfSimulator) Close() error {
+	return s.listener.Close()
+}
+
+func (s *NetconfSimulator) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *NetconfSimulator) serveConn(conn net.Conn) {
+	time.Sleep(s.opts.HandshakeDelay)
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveSession(channel, requests)
+	}
+}
+
+func (s *NetconfSimulator) serveSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for req := range requests {
+		if req.Type != "subsystem" || subsystemName(req.Payload) != "netconf" {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		go ssh.DiscardRequests(requests)
+
+		if err := s.serveNetconf(channel); err != nil && err != io.EOF {
+			log.Printf("netconf simulator: %v", err)
+		}
+		return
+	}
+}
+
+// subsystemName decodes the payload of a "subsystem" request: a uint32 length and the name.
+func subsystemName(payload []byte) string {
+	if len(payload) < 4 {
+		return ""
+	}
+	n := binary.BigEndian.Uint32(payload)
+	if uint32(len(payload)-4) < n {
+		return ""
+	}
+	return string(payload[4 : 4+n])
+}
+
+type datastoreRef struct {
+	Candidate *struct{} `xml:"candidate"`
+	Running   *struct{} `xml:"running"`
+}
+
+func (d datastoreRef) name() string {
+	switch {
+	case d.Candidate != nil:
+		return "candidate"
+	case d.Running != nil:
+		return "running"
+	default:
+		return ""
+	}
+}
+
+type rpcRequest struct {
+	XMLName   xml.Name `xml:"rpc"`
+	MessageID string   `xml:"message-id,attr"`
+	Operation struct {
+		XMLName xml.Name
+		Target  datastoreRef `xml:"target"`
+		Source  datastoreRef `xml:"source"`
+		Config  struct {
+			Content string `xml:",innerxml"`
+		} `xml:"config"`
+	} `xml:",any"`
+}
+
+func (s *NetconfSimulator) serveNetconf(channel ssh.Channel) error {
+	s.mu.Lock()
+	s.lastSession++
+	sessionID := s.lastSession
+	s.mu.Unlock()
+	defer s.endSession(sessionID)
+
+	capabilities := []string{netconfBase10}
+	if !s.opts.Base10Only {
+		capabilities = append(capabilities, netconfBase11)
+	}
+	if !s.opts.NoCandidate {
+		capabilities = append(capabilities, netconfCandidateCap)
+	}
+	hello, err := xml.Marshal(netconfHello{
+		XMLName:      xml.Name{Space: netconfNamespace, Local: "hello"},
+		Capabilities: capabilities,
+		SessionID:    sessionID,
+	})
+	if err != nil {
+		return err
+	}
+
+	framer := newNetconfFramer(channel, channel)
+	if err := framer.writeMessage(hello); err != nil {
+		return err
+	}
+	msg, err := framer.readMessage()
+	if err != nil {
+		return err
+	}
+	var clientHello netconfHello
+	if err := xml.Unmarshal(msg, &clientHello); err != nil {
+		return fmt.Errorf("invalid client hello: %w", err)
+	}
+	for _, c := range clientHello.Capabilities {
+		if c == netconfBase11 && !s.opts.Base10Only {
+			framer.chunked = true
+		}
+	}
+
+	for {
+		msg, err := framer.readMessage()
+		if err != nil {
+			return err
+		}
+
+		var req rpcRequest
+		var reply string
+		if err := xml.Unmarshal(msg, &req); err != nil {
+			reply = rpcErrorReply(RPCError{Type: "rpc", Tag: "malformed-message", Severity: "error", Message: err.Error()})
+		} else {
+			reply = s.handle(sessionID, req)
+		}
+
+		out := fmt.Sprintf(`<rpc-reply message-id="%s" xmlns="%s">%s</rpc-reply>`, req.MessageID, netconfNamespace, reply)
+		if err := framer.writeMessage([]byte(out)); err != nil {
+			return err
+		}
+		if req.Operation.XMLName.Local == "close-session" {
+			return nil
+		}
+	}
+}
+
+// handle runs one operation and returns the contents of its rpc-reply.
+func (s *NetconfSimulator) handle(sessionID int, req rpcRequest) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	op := req.Operation
+	name := op.XMLName.Local
+	if rpcErr, ok := s.failures[name]; ok {
+		delete(s.failures, name)
+		return rpcErrorReply(rpcErr)
+	}
+
+	lockDenied := func() string {
+		return rpcErrorReply(RPCError{
+			Type: "protocol", Tag: "lock-denied", Severity: "error",
+			Message: "candidate is locked by another session",
+			Info:    RPCErrorInfo{SessionID: strconv.Itoa(s.lockedBy)},
+		})
+	}
+	lockedByOther := s.lockedBy != 0 && s.lockedBy != sessionID
+
+	switch name {
+	case "get-config":
+		config := s.running
+		if op.Source.name() == "candidate" {
+			config = s.candidate
+		}
+		return "<data>" + config + "</data>"
+
+	case "edit-config":
+		switch op.Target.name() {
+		case "candidate":
+			if s.opts.NoCandidate {
+				return operationNotSupported(name)
+			}
+			if lockedByOther {
+				return rpcErrorReply(RPCError{Type: "protocol", Tag: "in-use", Severity: "error", Message: "candidate is locked by another session"})
+			}
+			s.candidate = op.Config.Content
+		case "running":
+			if !s.opts.NoCandidate {
+				return operationNotSupported(name)
+			}
+			s.running = op.Config.Content
+		default:
+			return rpcErrorReply(RPCError{Type: "protocol", Tag: "missing-element", Severity: "error", Info: RPCErrorInfo{BadElement: "target"}})
+		}
+
+	case "commit":
+		if s.opts.NoCandidate {
+			return operationNotSupported(name)
+		}
+		if lockedByOther {
+			return lockDenied()
+		}
+		s.running = s.candidate
+
+	case "discard-changes":
+		if lockedByOther {
+			return lockDenied()
+		}
+		s.candidate = s.running
+
+	case "lock":
+		if lockedByOther {
+			return lockDenied()
+		}
+		s.lockedBy = sessionID
+
+	case "unlock":
+		if s.lockedBy != sessionID {
+			return rpcErrorReply(RPCError{Type: "protocol", Tag: "operation-failed", Severity: "error", Message: "candidate is not locked by this session"})
+		}
+		s.lockedBy = 0
+
+	case "close-session":
+
+	default:
+		return operationNotSupported(name)
+	}
+	return "<ok/>"
+}
+
+// endSession releases the session's lock, discarding its uncommitted changes.
+func (s *NetconfSimulator) endSession(sessionID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lockedBy == sessionID {
+		s.lockedBy = 0
+		s.candidate = s.running
+	}
+}
+
+func operationNotSupported(operation string) string {
+	return rpcErrorReply(RPCError{Type: "protocol", Tag: "operation-not-supported", Severity: "error", Message: operation + " is not supported"})
+}
+
+func rpcErrorReply(rpcErr RPCError) string {
+	if rpcErr.Severity == "" {
+		rpcErr.Severity = "error"
+	}
+	out, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"rpc-error"`
+		RPCError
+	}{RPCError: rpcErr})
+	if err != nil {
+		return ""
+	}
+	return string(out)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+type xmlConfigRenderer struct{}
+
+func (xmlConfigRenderer) Render(d Device) (string, error) {
+	return fmt.Sprintf("<system><hostname>%s</hostname></system>", d.Hostname), nil
+}
+
+type hostnameRepository struct{}
+
+func (hostnameRepository) GetDevice(ipAddress string) (Device, error) {
+	return Device{IPAddress: ipAddress, Hostname: "edge-1"}, nil
+}
+
+func newNetconfTest(t *testing.T, opts NetconfSimulatorOptions) (*NetconfSimulator, NetconfClient) {
+	t.Helper()
+	opts.Username, opts.Password = "admin", "secret"
+	sim, err := NewNetconfSimulator(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sim.Close() })
+
+	client := NewNetconfClient(NetconfConfig{
+		Port:    sim.Port(),
+		Timeout: 5 * time.Second,
+		ClientConfig: func(d Device) (*ssh.ClientConfig, error) {
+			return sim.ClientConfig("admin", "secret"), nil
+		},
+	})
+	return sim, client
+}
+
+func TestNetconfClient(t *testing.T) {
+	device := Device{IPAddress: "127.0.0.1"}
+
+	t.Run("configures a device through NetworkHandler", func(t *testing.T) {
+		sim, client := newNetconfTest(t, NetconfSimulatorOptions{Running: "<system><hostname>old</hostname></system>"})
+		handler := NewNetworkHandler(hostnameRepository{}, xmlConfigRenderer{}, client, MockMonitoringClient{}, DefaultRetryPolicy())
+
+		assert.NoError(t, handler.PerformNetworkOperation(context.Background(), "127.0.0.1"))
+		assert.Equal(t, "<system><hostname>edge-1</hostname></system>", sim.Running())
+
+		running, err := client.RunningConfiguration(device)
+		assert.NoError(t, err)
+		assert.Equal(t, sim.Running(), running)
+	})
+
+	t.Run("edits running on devices without candidate and base:1.1", func(t *testing.T) {
+		sim, client := newNetconfTest(t, NetconfSimulatorOptions{NoCandidate: true, Base10Only: true})
+
+		assert.NoError(t, client.ConfigureDevice(device, "<system/>"))
+		assert.Equal(t, "<system/>", sim.Running())
+	})
+
+	t.Run("maps rpc-errors to classified errors", func(t *testing.T) {
+		sim, client := newNetconfTest(t, NetconfSimulatorOptions{Running: "<old/>"})
+
+		sim.FailNext("commit", RPCError{Type: "application", Tag: "operation-failed", Path: "/system/hostname", Message: "commit check failed"})
+		err := client.ConfigureDevice(device, "<new/>")
+		assert.ErrorIs(t, err, ErrPermanent)
+		var rpcErr *RPCError
+		if assert.ErrorAs(t, err, &rpcErr) {
+			assert.Equal(t, "operation-failed", rpcErr.Tag)
+			assert.Equal(t, "/system/hostname", rpcErr.Path)
+			assert.Equal(t, "commit check failed", rpcErr.Message)
+		}
+		assert.Equal(t, "<old/>", sim.Running(), "a failed commit must not change running")
+
+		sim.FailNext("lock", RPCError{Type: "protocol", Tag: "lock-denied", Info: RPCErrorInfo{SessionID: "7"}})
+		err = client.ConfigureDevice(device, "<new/>")
+		assert.ErrorIs(t, err, ErrTransient)
+		if assert.ErrorAs(t, err, &rpcErr) {
+			assert.Equal(t, "7", rpcErr.Info.SessionID)
+		}
+
+		assert.NoError(t, client.ConfigureDevice(device, "<new/>"))
+		assert.Equal(t, "<new/>", sim.Running())
+	})
+
+	t.Run("rejects configuration that isn't XML", func(t *testing.T) {
+		_, client := newNetconfTest(t, NetconfSimulatorOptions{})
+		assert.ErrorIs(t, client.ConfigureDevice(device, "hostname edge-1\n<"), ErrPermanent)
+	})
+
+	t.Run("rejected credentials are permanent", func(t *testing.T) {
+		sim, _ := newNetconfTest(t, NetconfSimulatorOptions{})
+		client := NewNetconfClient(NetconfConfig{
+			Port: sim.Port(),
+			ClientConfig: func(d Device) (*ssh.ClientConfig, error) {
+				return sim.ClientConfig("admin", "wrong"), nil
+			},
+		})
+		assert.ErrorIs(t, client.ConfigureDevice(device, "<system/>"), ErrPermanent)
+	})
+
+	t.Run("unreachable devices are transient", func(t *testing.T) {
+		sim, client := newNetconfTest(t, NetconfSimulatorOptions{})
+		sim.Close()
+		assert.ErrorIs(t, client.ConfigureDevice(device, "<system/>"), ErrTransient)
+	})
+
+	t.Run("a stalled handshake is transient", func(t *testing.T) {
+		sim, _ := newNetconfTest(t, NetconfSimulatorOptions{HandshakeDelay: time.Second})
+		client := NewNetconfClient(NetconfConfig{
+			Port:    sim.Port(),
+			Timeout: 50 * time.Millisecond,
+			ClientConfig: func(d Device) (*ssh.ClientConfig, error) {
+				return sim.ClientConfig("admin", "secret"), nil
+			},
+		})
+		err := client.ConfigureDevice(device, "<system/>")
+		assert.ErrorIs(t, err, ErrTransient)
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+}
+
+func TestNetconfChunkedFraming(t *testing.T) {
+	in := bytes.NewBufferString("\n#4\n<rpc\n#17\n message-id=\"1\"/>\n##\n")
+	framer := newNetconfFramer(in, &bytes.Buffer{})
+	framer.chunked = true
+
+	msg, err := framer.readMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, `<rpc message-id="1"/>`, string(msg))
+
+	_, err = newNetconfFramer(bytes.NewBufferString("\n#x\n"), nil).readChunked()
+	assert.True(t, errors.Is(err, ErrNetconfProtocol))
+
+	t.Run("refuses oversized messages", func(t *testing.T) {
+		_, err := newNetconfFramer(bytes.NewBufferString("\n#4294967295\n"), nil).readChunked()
+		assert.ErrorIs(t, err, ErrNetconfProtocol)
+
+		framer := newNetconfFramer(bytes.NewBufferString("\n#8\n<rpc/>  \n#8\n<rpc/>  \n##\n"), nil)
+		framer.maxMessageSize = 12
+		_, err = framer.readChunked()
+		assert.ErrorIs(t, err, ErrNetconfProtocol)
+
+		framer = newNetconfFramer(bytes.NewBufferString("<rpc message-id=\"1\"/>]]>]]>"), nil)
+		framer.maxMessageSize = 12
+		_, err = framer.readMessage()
+		assert.ErrorIs(t, err, ErrNetconfProtocol)
+	})
+}
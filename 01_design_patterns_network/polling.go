@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PollTarget is a device enrolled for periodic telemetry collection.
+type PollTarget struct {
+	IPAddress string
+	Hostname  string
+	// SysName is the name the device reports over SNMP, used as its device ID in telemetry.
+	SysName    string
+	EnrolledAt time.Time
+}
+
+// PollEnroller accepts devices for periodic telemetry collection.
+type PollEnroller interface {
+	Enrol(target PollTarget)
+}
+
+// PollScheduler hands every enrolled device to collect once per interval. collect
+// is the bridge to a telemetry pipeline, e.g. TelemetryCollector feeding a
+// TelemetryWorker like the one of 03_worker_pools. It should not block for long.
+type PollScheduler struct {
+	interval time.Duration
+	collect  func(PollTarget)
+
+	mu      sync.Mutex
+	targets map[string]PollTarget
+}
+
+// NewPollScheduler is a constructor for the PollScheduler struct.
+// The interval defaults to one minute.
+func NewPollScheduler(interval time.Duration, collect func(PollTarget)) *PollScheduler {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return &PollScheduler{interval: interval, collect: collect, targets: make(map[string]PollTarget)}
+}
+
+// Enrol adds a device to the schedule, or updates it if it is already enrolled.
+func (s *PollScheduler) Enrol(target PollTarget) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.targets[target.IPAddress]; ok {
+		target.EnrolledAt = existing.EnrolledAt
+	}
+	s.targets[target.IPAddress] = target
+}
+
+// Unenrol removes a device from the schedule.
+func (s *PollScheduler) Unenrol(ipAddress string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.targets, ipAddress)
+}
+
+// Targets returns the enrolled devices, sorted by IP address.
+func (s *PollScheduler) Targets() []PollTarget {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	targets := make([]PollTarget, 0, len(s.targets))
+	for _, t := range s.targets {
+		targets = append(targets, t)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].IPAddress < targets[j].IPAddress })
+	return targets
+}
+
+// Run polls every enrolled device once per interval until ctx is cancelled.
+func (s *PollScheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, target := range s.Targets() {
+				s.collect(target)
+			}
+		}
+	}
+}
+
+// DataType represents the type of telemetry data. The values match the DataType
+// of 03_worker_pools.
+type DataType int
+
+// Define constants for each data type.
+const (
+	BroadcastsPkts DataType = iota
+	InputDrops
+	CrcErrors
+)
+
+// TelemetryTask represents a task to collect a certain type of telemetry data
+// from a device. It has the same shape as the TelemetryTask of 03_worker_pools.
+type TelemetryTask struct {
+	DeviceID string
+	DataType DataType
+}
+
+// TelemetrySender queues telemetry tasks. The TelemetryWorker of 03_worker_pools
+// implements it with its Send method.
+type TelemetrySender interface {
+	Send(task TelemetryTask)
+}
+
+// TelemetryCollector returns a collect function for NewPollScheduler that sends a
+// TelemetryTask per data type to sender, all data types if none are given. The
+// device ID is the sysName the device reported, or its IP address if it had none.
+func TelemetryCollector(sender TelemetrySender, dataTypes ...DataType) func(PollTarget) {
+	if len(dataTypes) == 0 {
+		dataTypes = []DataType{BroadcastsPkts, InputDrops, CrcErrors}
+	}
+	return func(target PollTarget) {
+		deviceID := target.SysName
+		if deviceID == "" {
+			deviceID = target.IPAddress
+		}
+		for _, dataType := range dataTypes {
+			sender.Send(TelemetryTask{DeviceID: deviceID, DataType: dataType})
+		}
+	}
+}
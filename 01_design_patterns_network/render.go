@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrNoTemplate is returned when no template matches a device.
+var ErrNoTemplate = errors.New("no configuration template")
+
+// ConfigRenderer produces the configuration a device should have.
+type ConfigRenderer interface {
+	Render(d Device) (string, error)
+}
+
+// RenderVariables holds the variables available to templates, from least to most specific.
+// A device sees the merge of All, its site, its role and its own variables; later
+// levels override earlier ones key by key.
+type RenderVariables struct {
+	All     map[string]any            `yaml:"all"`
+	Sites   map[string]map[string]any `yaml:"sites"`
+	Roles   map[string]map[string]any `yaml:"roles"`
+	Devices map[string]map[string]any `yaml:"devices"` // keyed by IP address
+}
+
+// For returns the merged variables for a device.
+func (v RenderVariables) For(d Device) map[string]any {
+	vars := make(map[string]any)
+	maps.Copy(vars, v.All)
+	maps.Copy(vars, v.Sites[d.Site])
+	maps.Copy(vars, v.Roles[d.Role])
+	maps.Copy(vars, v.Devices[d.IPAddress])
+	return vars
+}
+
+// TemplateData is what a configuration template is executed with.
+type TemplateData struct {
+	Device Device
+	Vars   map[string]any
+}
+
+// TemplateRenderer renders device configuration from Go text/template files.
+//
+// The template for a device is the first that exists of "<platform>-<role>.tmpl",
+// "<platform>.tmpl" and "default.tmpl". Templates reference device attributes as
+// {{ .Device.Hostname }} and variables as {{ .Vars.ntp_servers }}. A variable that
+// doesn't resolve is an error rather than an empty value in the configuration.
+type TemplateRenderer struct {
+	templates *template.Template
+	vars      RenderVariables
+}
+
+// NewTemplateRenderer is a constructor for the TemplateRenderer struct.
+func NewTemplateRenderer(templates *template.Template, vars RenderVariables) TemplateRenderer {
+	return TemplateRenderer{
+		templates: templates.Option("missingkey=error"),
+		vars:      vars,
+	}
+}
+
+// LoadTemplateRenderer parses every *.tmpl file in templateDir and the YAML variables in varsFile.
+func LoadTemplateRenderer(templateDir, varsFile string) (TemplateRenderer, error) {
+	templates, err := template.ParseGlob(filepath.Join(templateDir, "*.tmpl"))
+	if err != nil {
+		return TemplateRenderer{}, fmt.Errorf("failed to parse templates: %w", err)
+	}
+
+	var vars RenderVariables
+	if varsFile != "" {
+		data, err := os.ReadFile(varsFile)
+		if err != nil {
+			return TemplateRenderer{}, fmt.Errorf("failed to read variables: %w", err)
+		}
+		if err := yaml.Unmarshal(data, &vars); err != nil {
+			return TemplateRenderer{}, fmt.Errorf("failed to parse variables %s: %w", varsFile, err)
+		}
+	}
+
+	return NewTemplateRenderer(templates, vars), nil
+}
+
+// Render executes the device's template. Rendering problems are permanent errors:
+// retrying won't fix a missing variable.
+func (r TemplateRenderer) Render(d Device) (string, error) {
+	tmpl := r.templateFor(d)
+	if tmpl == nil {
+		return "", Permanent(fmt.Errorf("%w for device %s (platform %q, role %q)", ErrNoTemplate, d.IPAddress, d.Platform, d.Role))
+	}
+
+	var out strings.Builder
+	if err := tmpl.Execute(&out, TemplateData{Device: d, Vars: r.vars.For(d)}); err != nil {
+		return "", Permanent(fmt.Errorf("failed to render %s for device %s: %w", tmpl.Name(), d.IPAddress, err))
+	}
+	return out.String(), nil
+}
+
+// templateFor picks the most specific template for a device.
+func (r TemplateRenderer) templateFor(d Device) *template.Template {
+	candidates := []string{
+		d.Platform + "-" + d.Role + ".tmpl",
+		d.Platform + ".tmpl",
+		"default.tmpl",
+	}
+	for _, name := range candidates {
+		if tmpl := r.templates.Lookup(name); tmpl != nil {
+			return tmpl
+		}
+	}
+	return nil
+}
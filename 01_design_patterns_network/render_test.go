@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const iosxeTemplate = `hostname {{ .Device.Hostname }}
+snmp-server location {{ .Vars.location }}
+{{- range .Vars.ntp_servers }}
+ntp server {{ . }}
+{{- end }}
+{{- range .Vars.interfaces }}
+interface {{ .name }}
+ description {{ .description }}
+{{- end }}
+`
+
+const renderVariables = `
+all:
+  ntp_servers: [10.1.1.1, 10.1.1.2]
+sites:
+  lon:
+    location: London
+roles:
+  pe:
+    ntp_servers: [10.9.9.9]
+devices:
+  10.0.0.1:
+    interfaces:
+      - name: Gi1
+        description: core uplink
+`
+
+func TestTemplateRenderer(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "iosxe.tmpl"), []byte(iosxeTemplate), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "default.tmpl"), []byte("hostname {{ .Device.Hostname }}\n"), 0o644))
+	varsFile := filepath.Join(dir, "vars.yaml")
+	assert.NoError(t, os.WriteFile(varsFile, []byte(renderVariables), 0o644))
+
+	renderer, err := LoadTemplateRenderer(dir, varsFile)
+	assert.NoError(t, err)
+
+	t.Run("merges variables from most to least specific", func(t *testing.T) {
+		config, err := renderer.Render(Device{IPAddress: "10.0.0.1", Hostname: "lon-pe-01", Platform: PlatformIOSXE, Site: "lon", Role: "pe"})
+		assert.NoError(t, err)
+		assert.Equal(t, "hostname lon-pe-01\nsnmp-server location London\nntp server 10.9.9.9\ninterface Gi1\n description core uplink\n", config)
+	})
+
+	t.Run("fails on unresolved variables", func(t *testing.T) {
+		_, err := renderer.Render(Device{IPAddress: "10.0.0.2", Hostname: "ams-p-01", Platform: PlatformIOSXE, Site: "ams", Role: "p"})
+		assert.ErrorIs(t, err, ErrPermanent)
+		assert.ErrorContains(t, err, "location")
+	})
+
+	t.Run("falls back to the default template", func(t *testing.T) {
+		config, err := renderer.Render(Device{IPAddress: "10.0.0.3", Hostname: "ams-pe-01", Platform: PlatformJunos})
+		assert.NoError(t, err)
+		assert.Equal(t, "hostname ams-pe-01\n", config)
+	})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Jitter selects how much randomness is applied to each backoff delay.
+type Jitter int
+
+const (
+	// NoJitter sleeps for exactly the computed backoff.
+	NoJitter Jitter = iota
+	// FullJitter sleeps for a random duration between zero and the computed backoff.
+	FullJitter
+	// EqualJitter sleeps for half the computed backoff plus a random duration up to the other half.
+	EqualJitter
+)
+
+// ErrMaxAttemptsReached is returned (wrapped in a RetryError) when every attempt has failed.
+var ErrMaxAttemptsReached = errors.New("reached maximum retries")
+
+// ErrMaxElapsedTimeReached is returned (wrapped in a RetryError) when the next attempt would exceed MaxElapsedTime.
+var ErrMaxElapsedTimeReached = errors.New("reached maximum elapsed time")
+
+// RetryPolicy describes how an operation is retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+	// InitialBackoff is the delay before the second attempt.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between two attempts. Zero means no cap.
+	MaxBackoff time.Duration
+	// Multiplier grows the delay after every failed attempt.
+	Multiplier float64
+	// Jitter randomises the delay so many devices don't retry in lockstep.
+	Jitter Jitter
+	// MaxElapsedTime bounds the whole retry loop. Zero means no bound.
+	MaxElapsedTime time.Duration
+}
+
+// DefaultRetryPolicy returns the policy used when nothing else is configured:
+// three attempts starting at a 2 second backoff.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 2 * time.Second,
+		MaxBackoff:     30 * time.Second,
+		Multiplier:     2,
+		Jitter:         FullJitter,
+	}
+}
+
+// backoff returns the delay to wait after the given (1-based) failed attempt.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+
+	d := time.Duration(delay)
+	if d <= 0 {
+		return 0
+	}
+
+	switch p.Jitter {
+	case FullJitter:
+		return time.Duration(rand.Int63n(int64(d) + 1))
+	case EqualJitter:
+		half := d / 2
+		return half + time.Duration(rand.Int63n(int64(d-half)+1))
+	default:
+		return d
+	}
+}
+
+// RetryError is returned when an operation did not succeed within its RetryPolicy.
+// It keeps the cause of every failed attempt so errors.Is and errors.As can see them.
+type RetryError struct {
+	// Attempts holds the error returned by each attempt, in order.
+	Attempts []error
+	// Reason explains why retrying stopped, e.g. ErrMaxAttemptsReached, ErrPermanent or a context error.
+	Reason error
+}
+
+func (e *RetryError) Error() string {
+	causes := make([]string, len(e.Attempts))
+	for i, err := range e.Attempts {
+		causes[i] = fmt.Sprintf("attempt %d: %v", i+1, err)
+	}
+	return fmt.Sprintf("%v after %d attempt(s): [%s]", e.Reason, len(e.Attempts), strings.Join(causes, "; "))
+}
+
+// Unwrap exposes the stop reason and every attempt's cause.
+func (e *RetryError) Unwrap() []error {
+	return append([]error{e.Reason}, e.Attempts...)
+}
+
+// LastError returns the error from the final attempt, or nil if no attempt was made.
+func (e *RetryError) LastError() error {
+	if len(e.Attempts) == 0 {
+		return nil
+	}
+	return e.Attempts[len(e.Attempts)-1]
+}
+
+// retry function to handle operation retries according to the given policy.
+// It stops early when ctx is cancelled, reporting the cause of the cancellation,
+// or when f returns a permanent error, and
+// waits at least as long as a throttled error asks for.
+func retry(ctx context.Context, policy RetryPolicy, f func() error) error {
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	start := time.Now()
+	retryErr := &RetryError{}
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if ctx.Err() != nil {
+			retryErr.Reason = context.Cause(ctx)
+			return retryErr
+		}
+
+		err := f()
+		if err == nil {
+			return nil
+		}
+		retryErr.Attempts = append(retryErr.Attempts, err)
+
+		if !IsRetryable(err) {
+			retryErr.Reason = ErrPermanent
+			return retryErr
+		}
+
+		if attempt == maxAttempts {
+			break
+		}
+
+		delay := policy.backoff(attempt)
+		if wait := retryAfter(err); wait > delay {
+			delay = wait
+		}
+		if policy.MaxElapsedTime > 0 && time.Since(start)+delay > policy.MaxElapsedTime {
+			retryErr.Reason = ErrMaxElapsedTimeReached
+			return retryErr
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			retryErr.Reason = context.Cause(ctx)
+			return retryErr
+		case <-timer.C:
+		}
+	}
+
+	retryErr.Reason = ErrMaxAttemptsReached
+	return retryErr
+}
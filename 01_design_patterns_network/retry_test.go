@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetry(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		Multiplier:     2,
+		Jitter:         EqualJitter,
+	}
+
+	t.Run("succeeds after transient failures", func(t *testing.T) {
+		calls := 0
+		err := retry(context.Background(), policy, func() error {
+			calls++
+			if calls < 3 {
+				return errors.New("timeout")
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, calls)
+	})
+
+	t.Run("keeps every attempt's cause", func(t *testing.T) {
+		errA := errors.New("connection refused")
+		errB := errors.New("timeout")
+		calls := 0
+		err := retry(context.Background(), policy, func() error {
+			calls++
+			if calls == 1 {
+				return errA
+			}
+			return errB
+		})
+
+		var retryErr *RetryError
+		assert.ErrorAs(t, err, &retryErr)
+		assert.Len(t, retryErr.Attempts, 3)
+		assert.ErrorIs(t, err, ErrMaxAttemptsReached)
+		assert.ErrorIs(t, err, errA)
+		assert.ErrorIs(t, err, errB)
+		assert.Equal(t, errB, retryErr.LastError())
+	})
+
+	t.Run("fails fast on permanent errors", func(t *testing.T) {
+		authErr := errors.New("authentication failed")
+		calls := 0
+		err := retry(context.Background(), policy, func() error {
+			calls++
+			return Permanent(authErr)
+		})
+		assert.Equal(t, 1, calls)
+		assert.ErrorIs(t, err, ErrPermanent)
+		assert.ErrorIs(t, err, authErr)
+		assert.NotErrorIs(t, err, ErrMaxAttemptsReached)
+	})
+
+	t.Run("waits for throttled errors", func(t *testing.T) {
+		calls := 0
+		start := time.Now()
+		err := retry(context.Background(), policy, func() error {
+			calls++
+			if calls == 1 {
+				return Throttled(errors.New("rate limited"), 50*time.Millisecond)
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	})
+
+	t.Run("stops when the context is cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		slow := RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Hour}
+		calls := 0
+		err := retry(ctx, slow, func() error {
+			calls++
+			cancel()
+			return errors.New("timeout")
+		})
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("respects the maximum elapsed time", func(t *testing.T) {
+		bounded := RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Hour, MaxElapsedTime: time.Second}
+		err := retry(context.Background(), bounded, func() error {
+			return errors.New("timeout")
+		})
+		assert.ErrorIs(t, err, ErrMaxElapsedTimeReached)
+	})
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second, Multiplier: 2}
+
+	assert.Equal(t, time.Second, policy.backoff(1))
+	assert.Equal(t, 2*time.Second, policy.backoff(2))
+	assert.Equal(t, 4*time.Second, policy.backoff(3))
+	assert.Equal(t, 5*time.Second, policy.backoff(4))
+
+	policy.Jitter = FullJitter
+	for i := 0; i < 100; i++ {
+		assert.LessOrEqual(t, policy.backoff(3), 4*time.Second)
+	}
+
+	policy.Jitter = EqualJitter
+	for i := 0; i < 100; i++ {
+		d := policy.backoff(3)
+		assert.GreaterOrEqual(t, d, 2*time.Second)
+		assert.LessOrEqual(t, d, 4*time.Second)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ConfigSnapshot is a copy of a device's configuration taken before it is changed.
+type ConfigSnapshot struct {
+	IPAddress string
+	Config    string
+	TakenAt   time.Time
+}
+
+// RollbackableConfigurationClient is an optional extension of ConfigurationClient.
+// When the configured client implements it, NetworkHandler snapshots the device
+// before configuring it and restores the snapshot if a later stage fails.
+type RollbackableConfigurationClient interface {
+	ConfigurationClient
+	SnapshotConfiguration(d Device) (ConfigSnapshot, error)
+	RestoreConfiguration(d Device, snapshot ConfigSnapshot) error
+}
+
+// RollbackResult describes a compensating rollback.
+type RollbackResult struct {
+	// Attempted is true when a rollback was started.
+	Attempted bool
+	// Err is nil when the previous configuration was restored.
+	Err error
+}
+
+// Succeeded reports whether the previous configuration was restored.
+func (r RollbackResult) Succeeded() bool {
+	return r.Attempted && r.Err == nil
+}
+
+// snapshot takes a configuration snapshot when the client supports it.
+// ok is false when the client can't roll back.
+func (n NetworkHandler) snapshot(ctx context.Context, device Device) (snapshot ConfigSnapshot, ok bool, err error) {
+	client, ok := n.configurationClient.(RollbackableConfigurationClient)
+	if !ok {
+		return ConfigSnapshot{}, false, nil
+	}
+
+	err = retry(ctx, n.retryPolicy, n.attempt(ctx, StageSnapshot, func() error {
+		var err error
+		snapshot, err = client.SnapshotConfiguration(device)
+		return err
+	}))
+	if errors.Is(err, ErrRollbackNotSupported) {
+		return ConfigSnapshot{}, false, nil
+	}
+	return snapshot, err == nil, err
+}
+
+// rollback restores a snapshot after a later stage failed. It runs even when ctx
+// has been cancelled, so an aborted operation doesn't leave the device half changed.
+func (n NetworkHandler) rollback(ctx context.Context, device Device, snapshot ConfigSnapshot) RollbackResult {
+	client := n.configurationClient.(RollbackableConfigurationClient)
+
+	err := retry(context.WithoutCancel(ctx), n.retryPolicy, n.attempt(ctx, StageRollback, func() error {
+		return client.RestoreConfiguration(device, snapshot)
+	}))
+	if err != nil {
+		return RollbackResult{Attempted: true, Err: fmt.Errorf("failed to roll back device configuration: %w", err)}
+	}
+	return RollbackResult{Attempted: true}
+}
+
+// withRollback adds the outcome of a rollback to the error of the stage that caused it.
+func withRollback(err error, rollback RollbackResult) error {
+	if rollback.Err != nil {
+		return errors.Join(err, rollback.Err)
+	}
+	return fmt.Errorf("%w (configuration rolled back)", err)
+}
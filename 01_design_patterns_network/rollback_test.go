@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// snapshottingConfigurationClient keeps a fake running configuration per device.
+type snapshottingConfigurationClient struct {
+	running    map[string]string
+	restoreErr error
+	// configureErr is returned by ConfigureDevice after half-applying the change.
+	configureErr error
+}
+
+func (c *snapshottingConfigurationClient) ConfigureDevice(d Device, config string) error {
+	if c.configureErr != nil {
+		c.running[d.IPAddress] = "partial"
+		return c.configureErr
+	}
+	c.running[d.IPAddress] = "new"
+	return nil
+}
+
+func (c *snapshottingConfigurationClient) SnapshotConfiguration(d Device) (ConfigSnapshot, error) {
+	return ConfigSnapshot{IPAddress: d.IPAddress, Config: c.running[d.IPAddress], TakenAt: time.Now()}, nil
+}
+
+func (c *snapshottingConfigurationClient) RestoreConfiguration(d Device, snapshot ConfigSnapshot) error {
+	if c.restoreErr != nil {
+		return c.restoreErr
+	}
+	c.running[d.IPAddress] = snapshot.Config
+	return nil
+}
+
+type failingMonitoringClient struct{}
+
+func (failingMonitoringClient) MonitorDevice(d Device) error {
+	return Permanent(errors.New("SNMP community rejected"))
+}
+
+func TestRollbackAfterMonitoringFailure(t *testing.T) {
+	t.Run("restores the previous configuration", func(t *testing.T) {
+		client := &snapshottingConfigurationClient{running: map[string]string{"10.0.0.1": "old"}}
+		handler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, client, failingMonitoringClient{}, DefaultRetryPolicy())
+
+		result := handler.performOperation(context.Background(), "10.0.0.1")
+		assert.Equal(t, StageMonitor, result.FailedStage)
+		assert.True(t, result.Rollback.Succeeded())
+		assert.Equal(t, "old", client.running["10.0.0.1"])
+		assert.ErrorIs(t, result.Err, ErrPermanent)
+	})
+
+	t.Run("reports a failed rollback", func(t *testing.T) {
+		restoreErr := Permanent(errors.New("device unreachable"))
+		client := &snapshottingConfigurationClient{running: map[string]string{"10.0.0.1": "old"}, restoreErr: restoreErr}
+		handler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, client, failingMonitoringClient{}, DefaultRetryPolicy())
+
+		result := handler.performOperation(context.Background(), "10.0.0.1")
+		assert.True(t, result.Rollback.Attempted)
+		assert.False(t, result.Rollback.Succeeded())
+		assert.ErrorIs(t, result.Err, restoreErr)
+		assert.Equal(t, "new", client.running["10.0.0.1"])
+	})
+}
+
+func TestRollbackAfterConfigureFailure(t *testing.T) {
+	t.Run("restores the previous configuration", func(t *testing.T) {
+		configureErr := Permanent(errors.New("commit failed halfway"))
+		client := &snapshottingConfigurationClient{running: map[string]string{"10.0.0.1": "old"}, configureErr: configureErr}
+		handler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, client, MockMonitoringClient{}, DefaultRetryPolicy())
+
+		result := handler.performOperation(context.Background(), "10.0.0.1")
+		assert.Equal(t, StageConfigure, result.FailedStage)
+		assert.True(t, result.Rollback.Succeeded())
+		assert.Equal(t, "old", client.running["10.0.0.1"])
+		assert.ErrorIs(t, result.Err, configureErr)
+	})
+
+	t.Run("doesn't roll back clients without snapshots", func(t *testing.T) {
+		handler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, &transientOnceConfigurationClient{calls: map[string]int{}}, MockMonitoringClient{}, RetryPolicy{MaxAttempts: 1})
+
+		result := handler.performOperation(context.Background(), "10.0.0.1")
+		assert.Equal(t, StageConfigure, result.FailedStage)
+		assert.False(t, result.Rollback.Attempted)
+	})
+}
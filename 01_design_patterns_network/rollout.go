@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// ErrRolloutHalted is returned by Rollout when a wave's failure rate exceeds the threshold.
+var ErrRolloutHalted = errors.New("rollout halted")
+
+// Wave is a group of devices that are changed together.
+type Wave struct {
+	Name    string
+	Devices []Device
+}
+
+// WavePlanner splits devices into the waves of a rollout.
+type WavePlanner interface {
+	PlanWaves(devices []Device) ([]Wave, error)
+}
+
+// ExplicitWaves plans one wave per list of IP addresses, e.g. a hand-picked canary set.
+// Devices that are not listed go into a final "remainder" wave.
+type ExplicitWaves struct {
+	Waves [][]string
+}
+
+func (p ExplicitWaves) PlanWaves(devices []Device) ([]Wave, error) {
+	byIP := make(map[string]Device, len(devices))
+	for _, d := range devices {
+		byIP[d.IPAddress] = d
+	}
+
+	var waves []Wave
+	planned := make(map[string]bool, len(devices))
+	for i, ips := range p.Waves {
+		wave := Wave{Name: fmt.Sprintf("wave-%d", i+1)}
+		for _, ip := range ips {
+			d, ok := byIP[ip]
+			if !ok {
+				return nil, fmt.Errorf("wave %d lists unknown device %s", i+1, ip)
+			}
+			if planned[ip] {
+				return nil, fmt.Errorf("device %s is listed in more than one wave", ip)
+			}
+			planned[ip] = true
+			wave.Devices = append(wave.Devices, d)
+		}
+		waves = append(waves, wave)
+	}
+
+	remainder := Wave{Name: "remainder"}
+	for _, d := range devices {
+		if !planned[d.IPAddress] {
+			remainder.Devices = append(remainder.Devices, d)
+		}
+	}
+	if len(remainder.Devices) > 0 {
+		waves = append(waves, remainder)
+	}
+	return waves, nil
+}
+
+// PercentageWaves plans waves that grow to cumulative percentages of the fleet,
+// e.g. []int{1, 10, 50, 100} for a 1% canary followed by 10%, 50% and everything.
+// Any devices left after the last percentage go into a final wave.
+type PercentageWaves struct {
+	Percentages []int
+}
+
+func (p PercentageWaves) PlanWaves(devices []Device) ([]Wave, error) {
+	var waves []Wave
+	done, previous := 0, 0
+	for _, pct := range p.Percentages {
+		if pct <= previous || pct > 100 {
+			return nil, fmt.Errorf("percentages must increase and stay within 1-100, got %d after %d", pct, previous)
+		}
+		previous = pct
+
+		upTo := int(math.Ceil(float64(len(devices)) * float64(pct) / 100))
+		if upTo <= done {
+			continue
+		}
+		waves = append(waves, Wave{Name: fmt.Sprintf("%d%%", pct), Devices: devices[done:upTo]})
+		done = upTo
+	}
+
+	if done < len(devices) {
+		waves = append(waves, Wave{Name: "100%", Devices: devices[done:]})
+	}
+	return waves, nil
+}
+
+// AttributeWaves plans one wave per distinct value of a device attribute such as its site.
+// Values listed in Order go first, in that order; the rest follow alphabetically.
+type AttributeWaves struct {
+	Attribute func(d Device) string
+	Order     []string
+}
+
+func (p AttributeWaves) PlanWaves(devices []Device) ([]Wave, error) {
+	if p.Attribute == nil {
+		return nil, errors.New("no attribute to group devices by")
+	}
+
+	groups := make(map[string][]Device)
+	for _, d := range devices {
+		value := p.Attribute(d)
+		groups[value] = append(groups[value], d)
+	}
+
+	var waves []Wave
+	for _, value := range p.Order {
+		if group, ok := groups[value]; ok {
+			waves = append(waves, Wave{Name: value, Devices: group})
+			delete(groups, value)
+		}
+	}
+
+	rest := make([]string, 0, len(groups))
+	for value := range groups {
+		rest = append(rest, value)
+	}
+	sort.Strings(rest)
+	for _, value := range rest {
+		waves = append(waves, Wave{Name: value, Devices: groups[value]})
+	}
+	return waves, nil
+}
+
+// RolloutOptions controls how Rollout moves from one wave to the next.
+type RolloutOptions struct {
+	// Concurrency is the maximum number of devices changed at once within a wave.
+	Concurrency int
+	// SoakTime is how long to wait after a wave before checking it and starting the next one.
+	SoakTime time.Duration
+	// MaxFailureRate halts the rollout when the fraction of failed devices in a wave
+	// is above it, e.g. 0.05 for 5%. Zero tolerates no failures.
+	MaxFailureRate float64
+}
+
+// WaveReport is the outcome of a single wave.
+type WaveReport struct {
+	Wave   Wave
+	Report BulkReport
+	// SoakFailures holds the monitoring check failures found after the soak period.
+	SoakFailures []DeviceResult
+	FailureRate  float64
+}
+
+// RolloutReport is the outcome of a whole rollout.
+type RolloutReport struct {
+	Waves []WaveReport
+	// Halted is true when the rollout stopped before every wave ran.
+	Halted bool
+}
+
+// Rollout configures and monitors devices wave by wave. After every wave but the
+// last it waits for the soak time and then runs the monitoring check again on the
+// devices that succeeded. If a wave's failure rate exceeds MaxFailureRate the
+// rollout stops and ErrRolloutHalted is returned.
+func (n NetworkHandler) Rollout(ctx context.Context, devices []Device, planner WavePlanner, opts RolloutOptions) (RolloutReport, error) {
+	waves, err := planner.PlanWaves(devices)
+	if err != nil {
+		return RolloutReport{}, fmt.Errorf("failed to plan waves: %w", err)
+	}
+
+	var report RolloutReport
+	for i, wave := range waves {
+		if len(wave.Devices) == 0 {
+			continue
+		}
+
+		waveReport, err := n.runWave(ctx, wave, opts)
+		if err != nil {
+			report.Waves = append(report.Waves, waveReport)
+			report.Halted = i < len(waves)-1
+			return report, err
+		}
+
+		if i < len(waves)-1 {
+			waveReport.SoakFailures, err = n.soak(ctx, wave, waveReport.Report, opts)
+			if err != nil {
+				report.Waves = append(report.Waves, waveReport)
+				report.Halted = true
+				return report, err
+			}
+		}
+
+		failed := waveReport.Report.Failed + len(waveReport.SoakFailures)
+		waveReport.FailureRate = float64(failed) / float64(len(wave.Devices))
+		report.Waves = append(report.Waves, waveReport)
+
+		if waveReport.FailureRate > opts.MaxFailureRate {
+			report.Halted = i < len(waves)-1
+			return report, fmt.Errorf("%w: wave %q failed on %d of %d devices", ErrRolloutHalted, wave.Name, failed, len(wave.Devices))
+		}
+	}
+	return report, nil
+}
+
+// runWave configures and monitors every device of a wave.
+func (n NetworkHandler) runWave(ctx context.Context, wave Wave, opts RolloutOptions) (WaveReport, error) {
+	ipAddresses := make([]string, len(wave.Devices))
+	for i, d := range wave.Devices {
+		ipAddresses[i] = d.IPAddress
+	}
+
+	bulkReport, err := runBulk(ctx, ipAddresses, BulkOptions{Concurrency: opts.Concurrency}, func(ctx context.Context, i int) DeviceResult {
+		return n.operateDevice(ctx, wave.Devices[i])
+	})
+	return WaveReport{Wave: wave, Report: bulkReport}, err
+}
+
+// soak waits for the soak time and then re-checks the devices of a wave that succeeded.
+func (n NetworkHandler) soak(ctx context.Context, wave Wave, bulkReport BulkReport, opts RolloutOptions) ([]DeviceResult, error) {
+	timer := time.NewTimer(opts.SoakTime)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		return nil, ctx.Err()
+	case <-timer.C:
+	}
+
+	var failures []DeviceResult
+	for i, result := range bulkReport.Results {
+		if !result.Success {
+			continue
+		}
+
+		device := wave.Devices[i]
+		start := time.Now()
+		check := DeviceResult{IPAddress: device.IPAddress}
+		err := retry(ctx, n.retryPolicy, func() error {
+			check.Attempts++
+			return n.monitoringClient.MonitorDevice(device)
+		})
+		if err != nil {
+			check.FailedStage = StageMonitor
+			check.Err = fmt.Errorf("monitoring check after soak failed: %w", err)
+			check.Duration = time.Since(start)
+			failures = append(failures, check)
+		}
+	}
+	return failures, ctx.Err()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testDevices(count int) []Device {
+	devices := make([]Device, count)
+	for i := range devices {
+		devices[i] = Device{IPAddress: fmt.Sprintf("10.0.0.%d", i+1)}
+	}
+	return devices
+}
+
+func waveSizes(waves []Wave) []int {
+	sizes := make([]int, len(waves))
+	for i, w := range waves {
+		sizes[i] = len(w.Devices)
+	}
+	return sizes
+}
+
+func TestWavePlanners(t *testing.T) {
+	devices := testDevices(20)
+
+	waves, err := PercentageWaves{Percentages: []int{5, 25, 50}}.PlanWaves(devices)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 4, 5, 10}, waveSizes(waves))
+
+	_, err = PercentageWaves{Percentages: []int{50, 10}}.PlanWaves(devices)
+	assert.Error(t, err)
+
+	waves, err = ExplicitWaves{Waves: [][]string{{"10.0.0.3"}, {"10.0.0.1", "10.0.0.2"}}}.PlanWaves(devices)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 17}, waveSizes(waves))
+	assert.Equal(t, "remainder", waves[2].Name)
+
+	_, err = ExplicitWaves{Waves: [][]string{{"192.0.2.1"}}}.PlanWaves(devices)
+	assert.Error(t, err)
+
+	lastOctetParity := func(d Device) string {
+		if d.IPAddress[len(d.IPAddress)-1]%2 == 0 {
+			return "even"
+		}
+		return "odd"
+	}
+	waves, err = AttributeWaves{Attribute: lastOctetParity, Order: []string{"odd"}}.PlanWaves(devices)
+	assert.NoError(t, err)
+	assert.Equal(t, "odd", waves[0].Name)
+	assert.Equal(t, "even", waves[1].Name)
+}
+
+func TestRollout(t *testing.T) {
+	devices := testDevices(10)
+	planner := PercentageWaves{Percentages: []int{10, 50}}
+
+	t.Run("runs every wave", func(t *testing.T) {
+		monitor := &recordingMonitoringClient{}
+		handler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, &flakyConfigurationClient{}, monitor, DefaultRetryPolicy())
+
+		report, err := handler.Rollout(context.Background(), devices, planner, RolloutOptions{Concurrency: 2})
+		assert.NoError(t, err)
+		assert.False(t, report.Halted)
+		assert.Len(t, report.Waves, 3)
+		// Every device is monitored once, and the first two waves are checked again after soaking.
+		assert.Len(t, monitor.monitored, 10+1+4)
+	})
+
+	t.Run("halts when a wave fails too often", func(t *testing.T) {
+		configClient := &flakyConfigurationClient{failing: map[string]bool{"10.0.0.2": true}}
+		handler := NewNetworkHandler(MockDeviceRepository{}, MockConfigRenderer{}, configClient, &recordingMonitoringClient{}, DefaultRetryPolicy())
+
+		report, err := handler.Rollout(context.Background(), devices, planner, RolloutOptions{Concurrency: 2, MaxFailureRate: 0.2})
+		assert.ErrorIs(t, err, ErrRolloutHalted)
+		assert.True(t, report.Halted)
+		assert.Len(t, report.Waves, 2)
+		assert.InDelta(t, 0.25, report.Waves[1].FailureRate, 0.001)
+	})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// OIDs read by SNMPMonitoringClient (SNMPv2-MIB).
+const (
+	oidSysUpTime = ".1.3.6.1.2.1.1.3.0"
+	oidSysName   = ".1.3.6.1.2.1.1.5.0"
+)
+
+// ErrSNMPNoSuchObject is returned when a device doesn't expose an object we need.
+var ErrSNMPNoSuchObject = errors.New("snmp object not available")
+
+// SNMPCredentials are the SNMP settings for one device. Version is gosnmp.Version2c,
+// which uses Community, or gosnmp.Version3, which uses the USM fields.
+type SNMPCredentials struct {
+	Version        gosnmp.SnmpVersion
+	Community      string
+	Username       string
+	AuthProtocol   gosnmp.SnmpV3AuthProtocol
+	AuthPassphrase string
+	PrivProtocol   gosnmp.SnmpV3PrivProtocol
+	PrivPassphrase string
+}
+
+// SNMPConfig configures an SNMPMonitoringClient.
+type SNMPConfig struct {
+	// Port is the SNMP agent port. Defaults to 161.
+	Port uint16
+	// Credentials returns the SNMP credentials of a device, e.g. by looking up its CredentialsRef.
+	Credentials func(d Device) (SNMPCredentials, error)
+	// Timeout is how long to wait for each response. Defaults to 2s.
+	Timeout time.Duration
+	// Retries is the number of times a request is resent on timeout within one call.
+	Retries int
+}
+
+// SNMPStatus is what a device reported when it was last checked.
+type SNMPStatus struct {
+	SysName string
+	Uptime  time.Duration
+}
+
+// SNMPMonitoringClient is a MonitoringClient that checks a device answers SNMP
+// with the configured credentials by reading sysName and sysUpTime. A device that
+// passes is enrolled into the telemetry polling schedule.
+type SNMPMonitoringClient struct {
+	config SNMPConfig
+	poller PollEnroller
+}
+
+// NewSNMPMonitoringClient is a constructor for the SNMPMonitoringClient struct.
+// poller may be nil if devices shouldn't be enrolled for polling.
+func NewSNMPMonitoringClient(config SNMPConfig, poller PollEnroller) SNMPMonitoringClient {
+	if config.Port == 0 {
+		config.Port = 161
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 2 * time.Second
+	}
+	return SNMPMonitoringClient{config: config, poller: poller}
+}
+
+func (c SNMPMonitoringClient) MonitorDevice(d Device) error {
+	status, err := c.Status(d)
+	if err != nil {
+		return err
+	}
+
+	if c.poller != nil {
+		c.poller.Enrol(PollTarget{IPAddress: d.IPAddress, Hostname: d.Hostname, SysName: status.SysName, EnrolledAt: time.Now()})
+	}
+	return nil
+}
+
+// Status reads sysName and sysUpTime from a device.
+func (c SNMPMonitoringClient) Status(d Device) (SNMPStatus, error) {
+	if c.config.Credentials == nil {
+		return SNMPStatus{}, Permanent(errors.New("snmp client has no credentials"))
+	}
+	creds, err := c.config.Credentials(d)
+	if err != nil {
+		return SNMPStatus{}, Permanent(fmt.Errorf("failed to get SNMP credentials for device %s: %w", d.IPAddress, err))
+	}
+
+	client := &gosnmp.GoSNMP{
+		Target:    d.IPAddress,
+		Port:      c.config.Port,
+		Transport: "udp",
+		Version:   creds.Version,
+		Community: creds.Community,
+		Timeout:   c.config.Timeout,
+		Retries:   c.config.Retries,
+		MaxOids:   gosnmp.MaxOids,
+	}
+	if creds.Version == gosnmp.Version3 {
+		client.SecurityModel = gosnmp.UserSecurityModel
+		client.MsgFlags, client.SecurityParameters = creds.usm()
+	}
+
+	if err := client.Connect(); err != nil {
+		return SNMPStatus{}, Transient(fmt.Errorf("failed to connect to SNMP agent of device %s: %w", d.IPAddress, err))
+	}
+	defer client.Conn.Close()
+
+	result, err := client.Get([]string{oidSysName, oidSysUpTime})
+	if err != nil {
+		return SNMPStatus{}, classifySNMPError(fmt.Errorf("SNMP get from device %s failed: %w", d.IPAddress, err))
+	}
+	if result.Error != gosnmp.NoError {
+		return SNMPStatus{}, Permanent(fmt.Errorf("SNMP get from device %s failed: %s", d.IPAddress, result.Error))
+	}
+
+	var status SNMPStatus
+	found := 0
+	for _, v := range result.Variables {
+		switch {
+		case v.Type == gosnmp.NoSuchObject || v.Type == gosnmp.NoSuchInstance:
+			return SNMPStatus{}, Permanent(fmt.Errorf("%w on device %s: %s", ErrSNMPNoSuchObject, d.IPAddress, v.Name))
+		case v.Name == oidSysName:
+			name, _ := v.Value.([]byte)
+			status.SysName = string(name)
+			found++
+		case v.Name == oidSysUpTime:
+			// sysUpTime counts hundredths of a second.
+			status.Uptime = time.Duration(gosnmp.ToBigInt(v.Value).Int64()) * 10 * time.Millisecond
+			found++
+		}
+	}
+	if found != 2 {
+		return SNMPStatus{}, Permanent(fmt.Errorf("%w on device %s: incomplete response", ErrSNMPNoSuchObject, d.IPAddress))
+	}
+	return status, nil
+}
+
+func (creds SNMPCredentials) usm() (gosnmp.SnmpV3MsgFlags, *gosnmp.UsmSecurityParameters) {
+	params := &gosnmp.UsmSecurityParameters{
+		UserName:                 creds.Username,
+		AuthenticationProtocol:   max(creds.AuthProtocol, gosnmp.NoAuth),
+		AuthenticationPassphrase: creds.AuthPassphrase,
+		PrivacyProtocol:          max(creds.PrivProtocol, gosnmp.NoPriv),
+		PrivacyPassphrase:        creds.PrivPassphrase,
+	}
+
+	flags := gosnmp.NoAuthNoPriv
+	switch {
+	case params.PrivacyProtocol > gosnmp.NoPriv:
+		flags = gosnmp.AuthPriv
+	case params.AuthenticationProtocol > gosnmp.NoAuth:
+		flags = gosnmp.AuthNoPriv
+	}
+	return flags, params
+}
+
+// classifySNMPError marks the USM failures the agent reports as permanent: wrong
+// credentials won't get better by retrying. Anything else, mostly timeouts, is
+// transient. SNMPv2c agents silently drop requests with the wrong community, so
+// those look like timeouts. gosnmp discards responses that fail its own
+// authentication check without an exported error, so those are transient too.
+func classifySNMPError(err error) error {
+	for _, usmErr := range []error{gosnmp.ErrUnknownUsername, gosnmp.ErrWrongDigest, gosnmp.ErrDecryption, gosnmp.ErrUnknownSecurityLevel, gosnmp.ErrUnknownSecurityModels} {
+		if errors.Is(err, usmErr) {
+			return Permanent(err)
+		}
+	}
+	return Transient(err)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/rand"
+	"net"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// USM report OIDs (RFC 3414) sent by SNMPAgentSimulator.
+const (
+	oidUsmStatsUnsupportedSecLevels = ".1.3.6.1.6.3.15.1.1.1.0"
+	oidUsmStatsUnknownEngineIDs     = ".1.3.6.1.6.3.15.1.1.4.0"
+	oidUsmStatsWrongDigests         = ".1.3.6.1.6.3.15.1.1.5.0"
+	oidSysDescr                     = ".1.3.6.1.2.1.1.1.0"
+)
+
+// SNMPAgentOptions configures an SNMPAgentSimulator. It answers SNMPv2c requests
+// with Community and SNMPv3 requests from Username with the given USM settings.
+type SNMPAgentOptions struct {
+	SysName        string
+	Community      string
+	Username       string
+	AuthProtocol   gosnmp.SnmpV3AuthProtocol
+	AuthPassphrase string
+	PrivProtocol   gosnmp.SnmpV3PrivProtocol
+	PrivPassphrase string
+}
+
+// SNMPAgentSimulator is a small in-process SNMP agent, for trying
+// SNMPMonitoringClient without hardware. It answers GET requests for sysDescr,
+// sysUpTime and sysName over SNMPv2c and SNMPv3, including engine discovery.
+// Requests with the wrong community are dropped, like real agents do.
+type SNMPAgentSimulator struct {
+	opts     SNMPAgentOptions
+	conn     *net.UDPConn
+	started  time.Time
+	engineID string
+	usm      *gosnmp.UsmSecurityParameters
+	flags    gosnmp.SnmpV3MsgFlags
+}
+
+// NewSNMPAgentSimulator is a constructor for an SNMPAgentSimulator listening on a
+// random local UDP port. Close must be called to stop it.
+func NewSNMPAgentSimulator(opts SNMPAgentOptions) (*SNMPAgentSimulator, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+
+	// A locally administered engine ID: enterprise prefix, format 5 (octets), random bytes.
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	engineID := string(append([]byte{0x80, 0x00, 0x00, 0x00, 0x05}, suffix...))
+
+	flags, usm := SNMPCredentials{
+		Username:       opts.Username,
+		AuthProtocol:   opts.AuthProtocol,
+		AuthPassphrase: opts.AuthPassphrase,
+		PrivProtocol:   opts.PrivProtocol,
+		PrivPassphrase: opts.PrivPassphrase,
+	}.usm()
+	usm.AuthoritativeEngineID = engineID
+	usm.AuthoritativeEngineBoots = 1
+	if err := usm.InitSecurityKeys(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	s := &SNMPAgentSimulator{opts: opts, conn: conn, started: time.Now(), engineID: engineID, usm: usm, flags: flags}
+	go s.serve()
+	return s, nil
+}
+
+// Port returns the UDP port the simulator listens on.
+func (s *SNMPAgentSimulator) Port() uint16 {
+	return uint16(s.conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// Close stops the simulator.
+func (s *SNMPAgentSimulator) Close() error {
+	return s.conn.Close()
+}
+
+func (s *SNMPAgentSimulator) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if reply := s.handle(append([]byte(nil), buf[:n]...)); reply != nil {
+			s.conn.WriteToUDP(reply, addr)
+		}
+	}
+}
+
+// handle returns the encoded reply to a request, or nil to drop it.
+func (s *SNMPAgentSimulator) handle(request []byte) []byte {
+	if len(request) > 4 && snmpMessageVersion(request) == gosnmp.Version3 {
+		return s.handleV3(request)
+	}
+
+	decoder := &gosnmp.GoSNMP{Version: gosnmp.Version2c}
+	req, err := decoder.SnmpDecodePacket(request)
+	if err != nil || req.Version != gosnmp.Version2c || req.Community != s.opts.Community || req.PDUType != gosnmp.GetRequest {
+		return nil
+	}
+
+	reply := &gosnmp.SnmpPacket{
+		Version:   gosnmp.Version2c,
+		Community: req.Community,
+		PDUType:   gosnmp.GetResponse,
+		RequestID: req.RequestID,
+		Variables: s.lookup(req.Variables),
+	}
+	out, err := reply.MarshalMsg()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+func (s *SNMPAgentSimulator) handleV3(request []byte) []byte {
+	decoder := &gosnmp.GoSNMP{
+		Version:            gosnmp.Version3,
+		SecurityModel:      gosnmp.UserSecurityModel,
+		SecurityParameters: s.usm.Copy(),
+	}
+	req, err := decoder.UnmarshalTrap(request, true)
+	if err != nil {
+		return s.report(nil, oidUsmStatsWrongDigests)
+	}
+
+	params, ok := req.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	switch {
+	case !ok:
+		return nil
+	case params.AuthoritativeEngineID != s.engineID:
+		return s.report(req, oidUsmStatsUnknownEngineIDs)
+	case params.UserName != s.opts.Username:
+		return s.report(req, oidUsmStatsWrongDigests)
+	case req.MsgFlags&gosnmp.AuthPriv != s.flags:
+		return s.report(req, oidUsmStatsUnsupportedSecLevels)
+	case req.PDUType != gosnmp.GetRequest:
+		return nil
+	}
+
+	reply := &gosnmp.SnmpPacket{
+		Version:            gosnmp.Version3,
+		MsgFlags:           s.flags,
+		SecurityModel:      gosnmp.UserSecurityModel,
+		SecurityParameters: s.securityParameters(s.usm.Copy()),
+		ContextEngineID:    s.engineID,
+		ContextName:        req.ContextName,
+		MsgID:              req.MsgID,
+		RequestID:          req.RequestID,
+		PDUType:            gosnmp.GetResponse,
+		Variables:          s.lookup(req.Variables),
+	}
+	if s.flags == gosnmp.AuthPriv {
+		if err := s.usm.InitPacket(reply); err != nil {
+			return nil
+		}
+	}
+	out, err := reply.MarshalMsg()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// report builds an unauthenticated Report PDU, used for engine discovery and USM errors.
+func (s *SNMPAgentSimulator) report(req *gosnmp.SnmpPacket, oid string) []byte {
+	reply := &gosnmp.SnmpPacket{
+		Version:            gosnmp.Version3,
+		MsgFlags:           gosnmp.NoAuthNoPriv,
+		SecurityModel:      gosnmp.UserSecurityModel,
+		SecurityParameters: s.securityParameters(&gosnmp.UsmSecurityParameters{AuthenticationProtocol: gosnmp.NoAuth, PrivacyProtocol: gosnmp.NoPriv}),
+		ContextEngineID:    s.engineID,
+		PDUType:            gosnmp.Report,
+		Variables:          []gosnmp.SnmpPDU{{Name: oid, Type: gosnmp.Counter32, Value: uint32(1)}},
+	}
+	if req != nil {
+		reply.MsgID = req.MsgID
+		reply.RequestID = req.RequestID
+	}
+	out, err := reply.MarshalMsg()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+func (s *SNMPAgentSimulator) securityParameters(params gosnmp.SnmpV3SecurityParameters) gosnmp.SnmpV3SecurityParameters {
+	usm := params.(*gosnmp.UsmSecurityParameters)
+	usm.AuthoritativeEngineID = s.engineID
+	usm.AuthoritativeEngineBoots = 1
+	usm.AuthoritativeEngineTime = uint32(time.Since(s.started).Seconds())
+	return usm
+}
+
+// lookup answers the requested OIDs from the simulated system group.
+func (s *SNMPAgentSimulator) lookup(requested []gosnmp.SnmpPDU) []gosnmp.SnmpPDU {
+	values := make([]gosnmp.SnmpPDU, len(requested))
+	for i, pdu := range requested {
+		switch pdu.Name {
+		case oidSysDescr:
+			values[i] = gosnmp.SnmpPDU{Name: pdu.Name, Type: gosnmp.OctetString, Value: "SNMP agent simulator"}
+		case oidSysUpTime:
+			values[i] = gosnmp.SnmpPDU{Name: pdu.Name, Type: gosnmp.TimeTicks, Value: uint32(time.Since(s.started) / (10 * time.Millisecond))}
+		case oidSysName:
+			values[i] = gosnmp.SnmpPDU{Name: pdu.Name, Type: gosnmp.OctetString, Value: s.opts.SysName}
+		default:
+			values[i] = gosnmp.SnmpPDU{Name: pdu.Name, Type: gosnmp.NoSuchObject}
+		}
+	}
+	return values
+}
+
+// snmpMessageVersion reads the version from the start of an SNMP message:
+// SEQUENCE, length, then INTEGER version.
+func snmpMessageVersion(msg []byte) gosnmp.SnmpVersion {
+	if msg[0] != 0x30 {
+		return 0
+	}
+	cursor := 2
+	if msg[1]&0x80 != 0 {
+		cursor += int(msg[1] & 0x7f)
+	}
+	if cursor+2 >= len(msg) || msg[cursor] != 0x02 || msg[cursor+1] != 0x01 {
+		return 0
+	}
+	return gosnmp.SnmpVersion(msg[cursor+2])
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/stretchr/testify/assert"
+)
+
+// telemetryQueue records telemetry tasks like the queue of a TelemetryWorker.
+type telemetryQueue []TelemetryTask
+
+func (q *telemetryQueue) Send(task TelemetryTask) {
+	*q = append(*q, task)
+}
+
+func newSNMPTest(t *testing.T, opts SNMPAgentOptions, creds SNMPCredentials, poller PollEnroller) SNMPMonitoringClient {
+	t.Helper()
+	agent, err := NewSNMPAgentSimulator(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { agent.Close() })
+
+	return NewSNMPMonitoringClient(SNMPConfig{
+		Port:    agent.Port(),
+		Timeout: 200 * time.Millisecond,
+		Credentials: func(d Device) (SNMPCredentials, error) {
+			return creds, nil
+		},
+	}, poller)
+}
+
+func TestSNMPMonitoringClient(t *testing.T) {
+	device := Device{IPAddress: "127.0.0.1", Hostname: "edge-1"}
+	v3Agent := SNMPAgentOptions{
+		SysName:        "edge-1.ams1",
+		Username:       "monitor",
+		AuthProtocol:   gosnmp.SHA256,
+		AuthPassphrase: "auth-secret",
+		PrivProtocol:   gosnmp.AES,
+		PrivPassphrase: "priv-secret",
+	}
+	v3Creds := SNMPCredentials{
+		Version:        gosnmp.Version3,
+		Username:       "monitor",
+		AuthProtocol:   gosnmp.SHA256,
+		AuthPassphrase: "auth-secret",
+		PrivProtocol:   gosnmp.AES,
+		PrivPassphrase: "priv-secret",
+	}
+
+	t.Run("reads sysName and sysUpTime over v2c", func(t *testing.T) {
+		client := newSNMPTest(t, SNMPAgentOptions{SysName: "edge-1.ams1", Community: "public"}, SNMPCredentials{Version: gosnmp.Version2c, Community: "public"}, nil)
+
+		status, err := client.Status(device)
+		assert.NoError(t, err)
+		assert.Equal(t, "edge-1.ams1", status.SysName)
+		assert.Less(t, status.Uptime, time.Minute)
+	})
+
+	t.Run("reads sysName over v3 with authPriv", func(t *testing.T) {
+		client := newSNMPTest(t, v3Agent, v3Creds, nil)
+
+		status, err := client.Status(device)
+		assert.NoError(t, err)
+		assert.Equal(t, "edge-1.ams1", status.SysName)
+	})
+
+	t.Run("wrong v3 credentials are permanent", func(t *testing.T) {
+		wrong := v3Creds
+		wrong.AuthPassphrase = "guess"
+		client := newSNMPTest(t, v3Agent, wrong, nil)
+
+		assert.ErrorIs(t, client.MonitorDevice(device), ErrPermanent)
+	})
+
+	t.Run("a wrong community looks like an unreachable device", func(t *testing.T) {
+		client := newSNMPTest(t, SNMPAgentOptions{Community: "public"}, SNMPCredentials{Version: gosnmp.Version2c, Community: "private"}, nil)
+
+		assert.ErrorIs(t, client.MonitorDevice(device), ErrTransient)
+	})
+
+	t.Run("enrols monitored devices for polling", func(t *testing.T) {
+		collected := make(chan PollTarget, 10)
+		scheduler := NewPollScheduler(10*time.Millisecond, func(target PollTarget) { collected <- target })
+		client := newSNMPTest(t, v3Agent, v3Creds, scheduler)
+
+		handler := NewNetworkHandler(hostnameRepository{}, MockConfigRenderer{}, MockConfigurationClient{}, client, DefaultRetryPolicy())
+		assert.NoError(t, handler.PerformNetworkOperation(context.Background(), "127.0.0.1"))
+
+		targets := scheduler.Targets()
+		if assert.Len(t, targets, 1) {
+			assert.Equal(t, "edge-1.ams1", targets[0].SysName)
+			assert.Equal(t, "edge-1", targets[0].Hostname)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go scheduler.Run(ctx)
+		select {
+		case target := <-collected:
+			assert.Equal(t, "127.0.0.1", target.IPAddress)
+		case <-time.After(time.Second):
+			t.Fatal("device was never polled")
+		}
+	})
+
+	t.Run("defaults the polling interval", func(t *testing.T) {
+		assert.Equal(t, time.Minute, NewPollScheduler(0, func(PollTarget) {}).interval)
+	})
+
+	t.Run("sends a telemetry task per data type", func(t *testing.T) {
+		var queue telemetryQueue
+		TelemetryCollector(&queue)(PollTarget{IPAddress: "10.0.0.1", SysName: "edge-1.ams1"})
+		TelemetryCollector(&queue, CrcErrors)(PollTarget{IPAddress: "10.0.0.2"})
+
+		assert.Equal(t, telemetryQueue{
+			{DeviceID: "edge-1.ams1", DataType: BroadcastsPkts},
+			{DeviceID: "edge-1.ams1", DataType: InputDrops},
+			{DeviceID: "edge-1.ams1", DataType: CrcErrors},
+			{DeviceID: "10.0.0.2", DataType: CrcErrors},
+		}, queue)
+	})
+}
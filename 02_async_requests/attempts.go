@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultAttemptRetention bounds how long the attempts of an event that is never
+// delivered again are remembered.
+const defaultAttemptRetention = 24 * time.Hour
+
+// AttemptStore counts the failed deliveries of each event to a consumer group.
+type AttemptStore interface {
+	// Incr records another failed delivery of an event and returns the total.
+	Incr(ctx context.Context, group, eventID string) (int, error)
+	// Clear forgets an event once it was acked.
+	Clear(ctx context.Context, group, eventID string) error
+}
+
+// MemoryAttemptStore is an AttemptStore kept in memory. Its counts are lost on
+// restart, so an event that always fails could be retried forever by a consumer
+// that keeps restarting.
+type MemoryAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+// NewMemoryAttemptStore is a constructor for the MemoryAttemptStore struct.
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{attempts: make(map[string]int)}
+}
+
+func (s *MemoryAttemptStore) Incr(ctx context.Context, group, eventID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts[group+":"+eventID]++
+	return s.attempts[group+":"+eventID], nil
+}
+
+func (s *MemoryAttemptStore) Clear(ctx context.Context, group, eventID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, group+":"+eventID)
+	return nil
+}
+
+// RedisAttemptStore is an AttemptStore on Redis, shared by every consumer of a
+// group and kept across restarts. Each event's count is a key under prefix that
+// expires after retention, so events that are never acked don't pile up.
+type RedisAttemptStore struct {
+	rdb       redis.UniversalClient
+	prefix    string
+	retention time.Duration
+}
+
+// NewRedisAttemptStore is a constructor for the RedisAttemptStore struct.
+// Counts are kept for retention after the last failure, 24 hours if it is zero.
+func NewRedisAttemptStore(rdb redis.UniversalClient, prefix string, retention time.Duration) RedisAttemptStore {
+	if retention <= 0 {
+		retention = defaultAttemptRetention
+	}
+	return RedisAttemptStore{rdb: rdb, prefix: prefix, retention: retention}
+}
+
+func (s RedisAttemptStore) Incr(ctx context.Context, group, eventID string) (int, error) {
+	key := s.prefix + group + ":" + eventID
+
+	pipe := s.rdb.TxPipeline()
+	incr := pipe.Incr(ctx, key)
+	pipe.PExpire(ctx, key, s.retention)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return int(incr.Val()), nil
+}
+
+func (s RedisAttemptStore) Clear(ctx context.Context, group, eventID string) error {
+	return s.rdb.Del(ctx, s.prefix+group+":"+eventID).Err()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrDeadLetterNotFound is returned when a dead letter doesn't exist.
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// Step is a background side effect of a sign-up.
+type Step string
+
+const (
+	StepNewsletter   Step = "newsletter"
+	StepNotification Step = "notification"
+)
+
+// DeadLetter records a sign-up step that failed every attempt of its RetryPolicy.
+type DeadLetter struct {
+	ID        string
+	SignUpID  string
+	User      User
+	Step      Step
+	Attempts  int
+	LastError string
+	FailedAt  time.Time
+}
+
+// DeadLetterStore keeps the sign-up steps that gave up, so operators can re-drive them.
+type DeadLetterStore interface {
+	Add(letter DeadLetter) error
+	Get(id string) (DeadLetter, error)
+	List() ([]DeadLetter, error)
+	Remove(id string) error
+}
+
+// MemoryDeadLetterStore is a DeadLetterStore kept in memory. Its dead letters are
+// lost on restart, so production deployments should use a persistent store.
+type MemoryDeadLetterStore struct {
+	mu      sync.Mutex
+	letters map[string]DeadLetter
+}
+
+// NewMemoryDeadLetterStore is a constructor for the MemoryDeadLetterStore struct.
+func NewMemoryDeadLetterStore() *MemoryDeadLetterStore {
+	return &MemoryDeadLetterStore{letters: make(map[string]DeadLetter)}
+}
+
+func (s *MemoryDeadLetterStore) Add(letter DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.letters[letter.ID] = letter
+	return nil
+}
+
+func (s *MemoryDeadLetterStore) Get(id string) (DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	letter, ok := s.letters[id]
+	if !ok {
+		return DeadLetter{}, ErrDeadLetterNotFound
+	}
+	return letter, nil
+}
+
+// List returns the dead letters, oldest first.
+func (s *MemoryDeadLetterStore) List() ([]DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letters := make([]DeadLetter, 0, len(s.letters))
+	for _, letter := range s.letters {
+		letters = append(letters, letter)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].FailedAt.Before(letters[j].FailedAt) })
+	return letters, nil
+}
+
+func (s *MemoryDeadLetterStore) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.letters[id]; !ok {
+		return ErrDeadLetterNotFound
+	}
+	delete(s.letters, id)
+	return nil
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingClient fails its first failures calls, then succeeds.
+type countingClient struct {
+	mu       sync.Mutex
+	calls    int
+	failures int
+}
+
+func (c *countingClient) call(User) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	if c.calls <= c.failures {
+		return errors.New("service unavailable")
+	}
+	return nil
+}
+
+func (c *countingClient) AddToNewsletter(u User) error  { return c.call(u) }
+func (c *countingClient) SendNotification(u User) error { return c.call(u) }
+
+func (c *countingClient) Calls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls
+}
+
+func fastRetryPolicy(attempts int) RetryPolicy {
+	return RetryPolicy{MaxAttempts: attempts, InitialBackoff: time.Millisecond, Multiplier: 2}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second, Multiplier: 2}
+
+	assert.Equal(t, time.Second, policy.backoff(1))
+	assert.Equal(t, 4*time.Second, policy.backoff(3))
+	assert.Equal(t, 5*time.Second, policy.backoff(10))
+
+	policy.Jitter = FullJitter
+	for i := 0; i < 100; i++ {
+		assert.LessOrEqual(t, policy.backoff(2), 2*time.Second)
+	}
+}
+
+func TestSignUpDeadLetters(t *testing.T) {
+	user := User{Email: "ada@example.com", MarketingConsent: true}
+
+	t.Run("dead-letters a step that fails every attempt", func(t *testing.T) {
+		newsletter := &countingClient{failures: 100}
+		notifications := &countingClient{}
+		store := NewMemoryDeadLetterStore()
+		handler := NewHandler(MockRepository{}, newsletter, notifications).
+			WithRetryPolicy(fastRetryPolicy(3)).
+			WithDeadLetterStore(store)
+
+		assert.NoError(t, handler.SignUp(user))
+
+		assert.Eventually(t, func() bool {
+			letters, _ := handler.DeadLetters()
+			return len(letters) == 1
+		}, time.Second, time.Millisecond)
+
+		letters, err := handler.DeadLetters()
+		assert.NoError(t, err)
+		assert.Equal(t, StepNewsletter, letters[0].Step)
+		assert.Equal(t, user, letters[0].User)
+		assert.Equal(t, 3, letters[0].Attempts)
+		assert.Equal(t, "service unavailable", letters[0].LastError)
+		assert.Equal(t, 3, newsletter.Calls())
+		assert.Equal(t, 1, notifications.Calls())
+	})
+
+	t.Run("re-drive removes the dead letter once the step succeeds", func(t *testing.T) {
+		newsletter := &countingClient{failures: 3}
+		store := NewMemoryDeadLetterStore()
+		handler := NewHandler(MockRepository{}, newsletter, &countingClient{}).
+			WithRetryPolicy(fastRetryPolicy(2)).
+			WithDeadLetterStore(store)
+		assert.NoError(t, store.Add(DeadLetter{ID: "dl-1", User: user, Step: StepNewsletter, Attempts: 2}))
+
+		err := handler.Redrive(context.Background(), "dl-1")
+		assert.ErrorContains(t, err, "service unavailable")
+		letter, err := store.Get("dl-1")
+		assert.NoError(t, err)
+		assert.Equal(t, 4, letter.Attempts)
+
+		assert.NoError(t, handler.Redrive(context.Background(), "dl-1"))
+		_, err = store.Get("dl-1")
+		assert.ErrorIs(t, err, ErrDeadLetterNotFound)
+		assert.Equal(t, 4, newsletter.Calls())
+	})
+
+	t.Run("re-driving an unknown dead letter fails", func(t *testing.T) {
+		handler := NewHandler(MockRepository{}, &countingClient{}, &countingClient{})
+		assert.ErrorIs(t, handler.Redrive(context.Background(), "missing"), ErrDeadLetterNotFound)
+	})
+}
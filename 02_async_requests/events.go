@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-redisstream/pkg/redisstream"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/redis/go-redis/v9"
+)
+
+// UserSignedUpTopic is the topic UserSignedUp events are published on.
+const UserSignedUpTopic = "user-signed-up"
+
+// Consumer groups of the sign-up steps. Each step reads every event through its
+// own group, so the steps succeed, fail and retry independently.
+const (
+	NewsletterConsumerGroup    = "signup-newsletter"
+	NotificationsConsumerGroup = "signup-notifications"
+)
+
+// UserSignedUp is published once for every account that was created. EventID
+// also identifies the sign-up, e.g. to query its status.
+type UserSignedUp struct {
+	EventID    string    `json:"event_id"`
+	User       User      `json:"user"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// ConsumerConfig configures the consumer of one sign-up step.
+type ConsumerConfig struct {
+	Step Step
+	// ConsumerGroup defaults to the step's own group, e.g. NewsletterConsumerGroup.
+	// Consumers of a step must share a group, or each of them gets every event.
+	ConsumerGroup string
+	// Retry bounds the deliveries of an event to this step. Every failed delivery is
+	// nacked, and the one that uses up MaxAttempts is dead-lettered and acked. When a
+	// nacked event comes back is up to the subscriber; the ones created by Subscribe
+	// resend it after InitialBackoff.
+	Retry RetryPolicy
+	// Attempts counts the failed deliveries of each event. Subscribe defaults it to
+	// a RedisAttemptStore, so the count survives restarts, and Consume to a
+	// MemoryAttemptStore.
+	Attempts AttemptStore
+}
+
+// DefaultConsumerConfigs returns a consumer for each step, with the default retry policy.
+func DefaultConsumerConfigs() []ConsumerConfig {
+	return []ConsumerConfig{
+		{Step: StepNewsletter, ConsumerGroup: NewsletterConsumerGroup, Retry: DefaultRetryPolicy()},
+		{Step: StepNotification, ConsumerGroup: NotificationsConsumerGroup, Retry: DefaultRetryPolicy()},
+	}
+}
+
+// WithEventPublisher returns a copy of the handler whose SignUp publishes a
+// UserSignedUp event instead of running the steps itself. If publishing fails the
+// steps run in the background as before, so the user still gets them. For a
+// guarantee that survives crashes, use WithOutbox instead.
+func (h Handler) WithEventPublisher(publisher message.Publisher) Handler {
+	h.eventPublisher = publisher
+	return h
+}
+
+func (h Handler) publishSignUp(event UserSignedUp) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return h.eventPublisher.Publish(UserSignedUpTopic, message.NewMessage(event.EventID, payload))
+}
+
+// Subscribe starts a redisstream consumer for every config, in the config's
+// consumer group. The consumers stop when ctx is cancelled or the handler is shut
+// down. If any consumer can't be created, none is started.
+func (h Handler) Subscribe(ctx context.Context, rdb redis.UniversalClient, configs ...ConsumerConfig) error {
+	logger := watermill.NewStdLogger(false, false)
+
+	configs = append([]ConsumerConfig(nil), configs...)
+	subs := make([]message.Subscriber, 0, len(configs))
+	for i := range configs {
+		if configs[i].ConsumerGroup == "" {
+			configs[i].ConsumerGroup = defaultConsumerGroup(configs[i].Step)
+		}
+		if configs[i].Attempts == nil {
+			configs[i].Attempts = NewRedisAttemptStore(rdb, "signup-attempts:", 0)
+		}
+		nackResendSleep := configs[i].Retry.InitialBackoff
+		if nackResendSleep <= 0 {
+			nackResendSleep = redisstream.NoSleep
+		}
+		sub, err := redisstream.NewSubscriber(redisstream.SubscriberConfig{
+			Client:          rdb,
+			ConsumerGroup:   configs[i].ConsumerGroup,
+			NackResendSleep: nackResendSleep,
+		}, logger)
+		if err != nil {
+			for _, sub := range subs {
+				sub.Close()
+			}
+			return fmt.Errorf("failed to create %s consumer: %w", configs[i].Step, err)
+		}
+		subs = append(subs, sub)
+	}
+
+	for i, sub := range subs {
+		go func(config ConsumerConfig) {
+			if err := h.Consume(ctx, sub, config); err != nil {
+				log.Printf("%s consumer stopped: %v", config.Step, err)
+			}
+		}(configs[i])
+	}
+	return nil
+}
+
+// defaultConsumerGroup returns the consumer group of a step.
+func defaultConsumerGroup(step Step) string {
+	switch step {
+	case StepNewsletter:
+		return NewsletterConsumerGroup
+	case StepNotification:
+		return NotificationsConsumerGroup
+	default:
+		return "signup-" + string(step)
+	}
+}
+
+// Consume runs config's step for every UserSignedUp event from sub until ctx is
+// cancelled or the handler is shut down. A delivery is acked when the step
+// succeeded, and nacked when it failed so that sub delivers the event again. When
+// the policy's attempts are used up, the step is dead-lettered and the event acked.
+//
+// Every event is handled as part of the handler's lifecycle, so Shutdown waits for
+// it. Once Shutdown has started, Consume takes no new events and returns; the event
+// it received is left unacked for another consumer. An event whose step Shutdown
+// cancels at its deadline is left unacked too, and isn't counted as an attempt.
+func (h Handler) Consume(ctx context.Context, sub message.Subscriber, config ConsumerConfig) error {
+	ctx, cancel := h.lifecycle.bind(ctx)
+	defer cancel()
+
+	if config.ConsumerGroup == "" {
+		config.ConsumerGroup = defaultConsumerGroup(config.Step)
+	}
+	if config.Attempts == nil {
+		config.Attempts = NewMemoryAttemptStore()
+	}
+
+	messages, err := sub.Subscribe(ctx, UserSignedUpTopic)
+	if err != nil {
+		return err
+	}
+
+	c := consumer{handler: h, config: config}
+	for msg := range messages {
+		release, err := h.lifecycle.admit()
+		if err != nil {
+			return nil
+		}
+		if c.handle(ctx, msg) {
+			msg.Ack()
+		} else if ctx.Err() == nil {
+			msg.Nack()
+		}
+		release()
+	}
+	return nil
+}
+
+type consumer struct {
+	handler Handler
+	config  ConsumerConfig
+}
+
+// handle makes one attempt at the step for msg and reports whether msg should be acked.
+func (c *consumer) handle(ctx context.Context, msg *message.Message) bool {
+	var event UserSignedUp
+	if err := json.Unmarshal(msg.Payload, &event); err != nil {
+		// It will never decode, so redelivering it would only block the subscription.
+		log.Printf("dropping invalid %s message %s: %v", UserSignedUpTopic, msg.UUID, err)
+		return true
+	}
+
+	step, u := c.config.Step, event.User
+	err := c.handler.runStep(ctx, event.EventID, step, u)
+	if err == nil {
+		c.clearAttempts(ctx, msg)
+		return true
+	}
+	if ctx.Err() != nil {
+		// Cancelled by the consumer stopping, not a failure of the step.
+		return false
+	}
+	log.Printf("%s step for user %s failed: %v", step, u.Email, err)
+
+	attempt, countErr := c.config.Attempts.Incr(ctx, c.config.ConsumerGroup, msg.UUID)
+	if countErr != nil {
+		log.Printf("failed to count attempts of %s message %s: %v", UserSignedUpTopic, msg.UUID, countErr)
+		return false
+	}
+	if attempt >= max(c.config.Retry.MaxAttempts, 1) {
+		c.handler.deadLetter(Task{ID: event.EventID + "/" + string(step), SignUpID: event.EventID, User: u, Step: step, Attempts: attempt, CreatedAt: event.OccurredAt}, err)
+		c.clearAttempts(ctx, msg)
+		return true
+	}
+	return false
+}
+
+func (c *consumer) clearAttempts(ctx context.Context, msg *message.Message) {
+	if err := c.config.Attempts.Clear(ctx, c.config.ConsumerGroup, msg.UUID); err != nil {
+		log.Printf("failed to clear attempts of %s message %s: %v", UserSignedUpTopic, msg.UUID, err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-redisstream/pkg/redisstream"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignUpEvents(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	publisher, err := redisstream.NewPublisher(redisstream.PublisherConfig{Client: rdb}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newsletter := &countingClient{failures: 100}
+	notifications := &countingClient{failures: 1}
+	handler := NewHandler(MockRepository{}, newsletter, notifications).WithEventPublisher(publisher)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = handler.Subscribe(ctx, rdb,
+		ConsumerConfig{Step: StepNewsletter, ConsumerGroup: NewsletterConsumerGroup, Retry: fastRetryPolicy(2)},
+		// The notification consumer gets its step's group by default.
+		ConsumerConfig{Step: StepNotification, Retry: fastRetryPolicy(3)},
+	)
+	assert.NoError(t, err)
+
+	assert.NoError(t, handler.SignUp(User{Email: "ada@example.com", MarketingConsent: true}))
+	assert.Equal(t, TaskStats{}, handler.Stats(), "steps run in the consumers, not in SignUp")
+
+	assert.Eventually(t, func() bool {
+		letters, _ := handler.DeadLetters()
+		return len(letters) == 1 && notifications.Calls() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	letters, err := handler.DeadLetters()
+	assert.NoError(t, err)
+	assert.Equal(t, StepNewsletter, letters[0].Step)
+	assert.Equal(t, 2, letters[0].Attempts)
+	assert.Equal(t, 2, newsletter.Calls())
+
+	// Both groups acked the event, so nothing is left pending.
+	for _, group := range []string{NewsletterConsumerGroup, NotificationsConsumerGroup} {
+		assert.Eventually(t, func() bool {
+			pending, err := rdb.XPending(ctx, UserSignedUpTopic, group).Result()
+			return err == nil && pending.Count == 0
+		}, time.Second, 10*time.Millisecond, group)
+	}
+}
+
+func TestConsumerAttempts(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	payload, err := json.Marshal(UserSignedUp{EventID: "signup-1", User: User{Email: "ada@example.com", MarketingConsent: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := ConsumerConfig{
+		Step:          StepNewsletter,
+		ConsumerGroup: NewsletterConsumerGroup,
+		Retry:         fastRetryPolicy(3),
+		Attempts:      NewRedisAttemptStore(rdb, "signup-attempts:", time.Hour),
+	}
+
+	t.Run("counts attempts across restarts", func(t *testing.T) {
+		handler := NewHandler(MockRepository{}, &countingClient{failures: 100}, &countingClient{})
+
+		// Each consumer stands for a new process that gets the event redelivered.
+		for i := 0; i < 2; i++ {
+			c := consumer{handler: handler, config: config}
+			assert.False(t, c.handle(ctx, message.NewMessage("msg-1", payload)), "failed deliveries are nacked")
+		}
+		count, err := mr.Get("signup-attempts:" + NewsletterConsumerGroup + ":msg-1")
+		assert.NoError(t, err)
+		assert.Equal(t, "2", count)
+
+		c := consumer{handler: handler, config: config}
+		assert.True(t, c.handle(ctx, message.NewMessage("msg-1", payload)), "the last attempt is acked")
+		letters, err := handler.DeadLetters()
+		assert.NoError(t, err)
+		if assert.Len(t, letters, 1) {
+			assert.Equal(t, 3, letters[0].Attempts)
+		}
+		assert.False(t, mr.Exists("signup-attempts:"+NewsletterConsumerGroup+":msg-1"))
+	})
+
+	t.Run("forgets acked messages", func(t *testing.T) {
+		handler := NewHandler(MockRepository{}, &countingClient{failures: 1}, &countingClient{})
+		c := consumer{handler: handler, config: config}
+
+		assert.False(t, c.handle(ctx, message.NewMessage("msg-2", payload)))
+		assert.True(t, mr.Exists("signup-attempts:"+NewsletterConsumerGroup+":msg-2"))
+		assert.True(t, c.handle(ctx, message.NewMessage("msg-2", payload)))
+		assert.False(t, mr.Exists("signup-attempts:"+NewsletterConsumerGroup+":msg-2"))
+	})
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/net/idna"
+)
+
+// ErrSignUpInProgress is returned when a sign-up with the same idempotency key is still running.
+var ErrSignUpInProgress = errors.New("sign-up already in progress")
+
+// ErrStepInProgress is returned when a step for the same user is running elsewhere.
+// The step is retried like any other failure.
+var ErrStepInProgress = errors.New("sign-up step already in progress")
+
+// ErrClaimNotHeld is returned when completing or releasing a key whose claim
+// expired or was taken over.
+var ErrClaimNotHeld = errors.New("idempotency claim not held")
+
+// idempotencyLease bounds how long a claimed key stays in progress, so the key is
+// freed again if the process dies before completing or releasing it.
+const idempotencyLease = 5 * time.Minute
+
+const defaultIdempotencyRetention = 24 * time.Hour
+
+// IdempotencyRecord is what an IdempotencyStore remembers about a key.
+type IdempotencyRecord struct {
+	Completed   bool      `json:"completed"`
+	CompletedAt time.Time `json:"completed_at,omitempty"`
+	// Token identifies a claim. It is only returned to the caller that made the
+	// claim, and must be passed to Complete or Release.
+	Token string `json:"token,omitempty"`
+}
+
+// IdempotencyStore makes sure work identified by a key runs to completion only once.
+type IdempotencyStore interface {
+	// Claim reserves key for lease. If key is already claimed or completed, it
+	// returns the existing record and false.
+	Claim(ctx context.Context, key string, lease time.Duration) (IdempotencyRecord, bool, error)
+	// Complete marks a claimed key as done. The store remembers it for its retention period.
+	// It returns ErrClaimNotHeld if the claim with token is no longer the current one.
+	Complete(ctx context.Context, key, token string) error
+	// Release frees a claimed key, so the work can be tried again.
+	// It returns ErrClaimNotHeld if the claim with token is no longer the current one.
+	Release(ctx context.Context, key, token string) error
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore kept in memory. It only protects
+// against duplicates within one process.
+type MemoryIdempotencyStore struct {
+	retention time.Duration
+
+	mu      sync.Mutex
+	records map[string]memoryIdempotencyRecord
+}
+
+type memoryIdempotencyRecord struct {
+	IdempotencyRecord
+	expiresAt time.Time
+}
+
+// NewMemoryIdempotencyStore is a constructor for the MemoryIdempotencyStore struct.
+// Completed keys are remembered for retention, 24 hours if it is zero.
+func NewMemoryIdempotencyStore(retention time.Duration) *MemoryIdempotencyStore {
+	if retention <= 0 {
+		retention = defaultIdempotencyRetention
+	}
+	return &MemoryIdempotencyStore{retention: retention, records: make(map[string]memoryIdempotencyRecord)}
+}
+
+func (s *MemoryIdempotencyStore) Claim(ctx context.Context, key string, lease time.Duration) (IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if existing, ok := s.records[key]; ok && now.Before(existing.expiresAt) {
+		record := existing.IdempotencyRecord
+		record.Token = ""
+		return record, false, nil
+	}
+	claim := IdempotencyRecord{Token: newID()}
+	s.records[key] = memoryIdempotencyRecord{IdempotencyRecord: claim, expiresAt: now.Add(lease)}
+	return claim, true, nil
+}
+
+func (s *MemoryIdempotencyStore) Complete(ctx context.Context, key, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if !s.holds(key, token, now) {
+		return fmt.Errorf("%w: %s", ErrClaimNotHeld, key)
+	}
+	s.records[key] = memoryIdempotencyRecord{
+		IdempotencyRecord: IdempotencyRecord{Completed: true, CompletedAt: now},
+		expiresAt:         now.Add(s.retention),
+	}
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(ctx context.Context, key, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.holds(key, token, time.Now()) {
+		return fmt.Errorf("%w: %s", ErrClaimNotHeld, key)
+	}
+	delete(s.records, key)
+	return nil
+}
+
+// holds reports whether token is the current, unexpired claim on key.
+func (s *MemoryIdempotencyStore) holds(key, token string, now time.Time) bool {
+	existing, ok := s.records[key]
+	return ok && !existing.Completed && existing.Token == token && now.Before(existing.expiresAt)
+}
+
+// RedisIdempotencyStore is an IdempotencyStore on Redis, shared by every process
+// that uses the same Redis. Keys are stored under prefix. A claim stores its token
+// in the key's value, and Complete and Release only change a key that still holds it.
+type RedisIdempotencyStore struct {
+	rdb       redis.UniversalClient
+	prefix    string
+	retention time.Duration
+}
+
+// NewRedisIdempotencyStore is a constructor for the RedisIdempotencyStore struct.
+// Completed keys are remembered for retention, 24 hours if it is zero.
+func NewRedisIdempotencyStore(rdb redis.UniversalClient, prefix string, retention time.Duration) RedisIdempotencyStore {
+	if retention <= 0 {
+		retention = defaultIdempotencyRetention
+	}
+	return RedisIdempotencyStore{rdb: rdb, prefix: prefix, retention: retention}
+}
+
+// releaseClaimScript deletes the key only if it still holds our claim.
+var releaseClaimScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// completeClaimScript replaces our claim with the completed record, only if the
+// key still holds the claim.
+var completeClaimScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+	return 1
+end
+return 0
+`)
+
+func (s RedisIdempotencyStore) Claim(ctx context.Context, key string, lease time.Duration) (IdempotencyRecord, bool, error) {
+	token := newID()
+	claim, err := json.Marshal(IdempotencyRecord{Token: token})
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+
+	// A key that expires between SET NX and GET is claimed again on the next loop.
+	for {
+		claimed, err := s.rdb.SetNX(ctx, s.prefix+key, claim, lease).Result()
+		if err != nil {
+			return IdempotencyRecord{}, false, err
+		}
+		if claimed {
+			return IdempotencyRecord{Token: token}, true, nil
+		}
+
+		data, err := s.rdb.Get(ctx, s.prefix+key).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return IdempotencyRecord{}, false, err
+		}
+		var record IdempotencyRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return IdempotencyRecord{}, false, fmt.Errorf("invalid idempotency record %s: %w", key, err)
+		}
+		record.Token = ""
+		return record, false, nil
+	}
+}
+
+func (s RedisIdempotencyStore) Complete(ctx context.Context, key, token string) error {
+	claim, err := json.Marshal(IdempotencyRecord{Token: token})
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(IdempotencyRecord{Completed: true, CompletedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+
+	completed, err := completeClaimScript.Run(ctx, s.rdb, []string{s.prefix + key}, claim, data, s.retention.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if completed == 0 {
+		return fmt.Errorf("%w: %s", ErrClaimNotHeld, key)
+	}
+	return nil
+}
+
+func (s RedisIdempotencyStore) Release(ctx context.Context, key, token string) error {
+	claim, err := json.Marshal(IdempotencyRecord{Token: token})
+	if err != nil {
+		return err
+	}
+
+	deleted, err := releaseClaimScript.Run(ctx, s.rdb, []string{s.prefix + key}, claim).Int()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return fmt.Errorf("%w: %s", ErrClaimNotHeld, key)
+	}
+	return nil
+}
+
+// WithIdempotencyStore returns a copy of the handler that uses store to run every
+// sign-up, and every step of it, only once.
+func (h Handler) WithIdempotencyStore(store IdempotencyStore) Handler {
+	h.idempotency = store
+	return h
+}
+
+// normaliseEmail returns the form of an email address used to recognise a user.
+// The domain is converted to its ASCII form like UserValidator does, so lookups
+// with an internationalised domain find the user it stored.
+func normaliseEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	domain, err := idna.Lookup.ToASCII(email[at+1:])
+	if err != nil {
+		return email
+	}
+	return email[:at+1] + strings.ToLower(domain)
+}
+
+// signUpKey is the idempotency key of a sign-up: the request ID if the client
+// supplied one, otherwise the normalised email.
+func signUpKey(requestID string, u User) string {
+	if requestID != "" {
+		return "signup:request:" + requestID
+	}
+	return "signup:email:" + normaliseEmail(u.Email)
+}
+
+// stepKey is the idempotency key of a step. It is keyed by user rather than by
+// sign-up, so duplicate events, redeliveries and re-drives all share it.
+func stepKey(step Step, u User) string {
+	return "step:" + string(step) + ":" + normaliseEmail(u.Email)
+}
+
+// once runs f under key. It returns the recorded outcome when key was already
+// completed and errInProgress while it is claimed elsewhere. A failed f releases
+// key so it can be tried again. The claim is completed or released even if ctx
+// was cancelled while f ran, as it is on Shutdown.
+func (h Handler) once(ctx context.Context, key string, errInProgress error, f func() error) error {
+	if h.idempotency == nil {
+		return f()
+	}
+
+	record, claimed, err := h.idempotency.Claim(ctx, key, idempotencyLease)
+	if err != nil {
+		return fmt.Errorf("failed to claim idempotency key %s: %w", key, err)
+	}
+	if !claimed {
+		if record.Completed {
+			return nil
+		}
+		return errInProgress
+	}
+
+	settleCtx := context.WithoutCancel(ctx)
+	if err := f(); err != nil {
+		if releaseErr := h.idempotency.Release(settleCtx, key, record.Token); releaseErr != nil {
+			log.Printf("failed to release idempotency key %s: %v", key, releaseErr)
+		}
+		return err
+	}
+	if err := h.idempotency.Complete(settleCtx, key, record.Token); err != nil {
+		// The work is done; the key expires with its lease and the work may run again.
+		log.Printf("failed to complete idempotency key %s: %v", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingRepository fails its first failures calls, then succeeds.
+type countingRepository struct {
+	mu       sync.Mutex
+	accounts []User
+	failures int
+}
+
+func (r *countingRepository) CreateUserAccount(u User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failures > 0 {
+		r.failures--
+		return errors.New("database unavailable")
+	}
+	r.accounts = append(r.accounts, u)
+	return nil
+}
+
+func TestIdempotentSignUp(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("a repeated sign-up for the same email runs once", func(t *testing.T) {
+		repository := &countingRepository{}
+		newsletter, notifications := &countingClient{}, &countingClient{}
+		handler := NewHandler(repository, newsletter, notifications).
+			WithIdempotencyStore(NewMemoryIdempotencyStore(time.Hour))
+
+		assert.NoError(t, handler.SignUp(User{Email: "ada@example.com", MarketingConsent: true}))
+		assert.NoError(t, handler.SignUp(User{Email: " Ada@Example.com", MarketingConsent: true}))
+		assert.NoError(t, handler.Shutdown(ctx))
+
+		assert.Len(t, repository.accounts, 1)
+		assert.Equal(t, 1, newsletter.Calls())
+		assert.Equal(t, 1, notifications.Calls())
+	})
+
+	t.Run("a failed sign-up can be retried with the same request ID", func(t *testing.T) {
+		repository := &countingRepository{failures: 1}
+		client := &countingClient{}
+		handler := NewHandler(repository, client, client).
+			WithIdempotencyStore(NewMemoryIdempotencyStore(time.Hour))
+
+		assert.ErrorContains(t, handler.SignUpWithRequestID("req-1", User{Email: "ada@example.com"}), "database unavailable")
+		assert.NoError(t, handler.SignUpWithRequestID("req-1", User{Email: "ada@example.com"}))
+		assert.NoError(t, handler.SignUpWithRequestID("req-1", User{Email: "ada@example.com"}))
+		assert.NoError(t, handler.Shutdown(ctx))
+
+		assert.Len(t, repository.accounts, 1)
+	})
+
+	t.Run("a sign-up still in progress is refused", func(t *testing.T) {
+		store := NewMemoryIdempotencyStore(time.Hour)
+		handler := NewHandler(&countingRepository{}, &countingClient{}, &countingClient{}).WithIdempotencyStore(store)
+
+		_, claimed, err := store.Claim(ctx, signUpKey("req-1", User{}), time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, claimed)
+		assert.ErrorIs(t, handler.SignUpWithRequestID("req-1", User{Email: "ada@example.com"}), ErrSignUpInProgress)
+	})
+
+	t.Run("duplicate events run each step once", func(t *testing.T) {
+		pubSub := gochannel.NewGoChannel(gochannel.Config{Persistent: true}, watermill.NopLogger{})
+		defer pubSub.Close()
+
+		newsletter, notifications := &countingClient{}, &countingClient{}
+		handler := NewHandler(MockRepository{}, newsletter, notifications).
+			WithIdempotencyStore(NewMemoryIdempotencyStore(time.Hour))
+
+		consumeCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go handler.Consume(consumeCtx, pubSub, ConsumerConfig{Step: StepNewsletter, Retry: fastRetryPolicy(3)})
+		go handler.Consume(consumeCtx, pubSub, ConsumerConfig{Step: StepNotification, Retry: fastRetryPolicy(3)})
+
+		payload, err := json.Marshal(UserSignedUp{EventID: "event-1", User: User{Email: "ada@example.com", MarketingConsent: true}})
+		assert.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, pubSub.Publish(UserSignedUpTopic, message.NewMessage(watermill.NewUUID(), payload)))
+		}
+
+		assert.Eventually(t, func() bool {
+			return newsletter.Calls() == 1 && notifications.Calls() == 1
+		}, time.Second, time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+		assert.Equal(t, 1, newsletter.Calls())
+		assert.Equal(t, 1, notifications.Calls())
+	})
+}
+
+func TestRedisIdempotencyStore(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	store := NewRedisIdempotencyStore(rdb, "idempotency:", time.Hour)
+
+	claim, claimed, err := store.Claim(ctx, "key", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	assert.NotEmpty(t, claim.Token)
+
+	record, claimed, err := store.Claim(ctx, "key", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+	assert.False(t, record.Completed)
+	assert.Empty(t, record.Token)
+
+	assert.NoError(t, store.Release(ctx, "key", claim.Token))
+	claim, claimed, err = store.Claim(ctx, "key", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	assert.NoError(t, store.Complete(ctx, "key", claim.Token))
+	record, claimed, err = store.Claim(ctx, "key", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+	assert.True(t, record.Completed)
+	assert.Equal(t, time.Hour, mr.TTL("idempotency:key"))
+	assert.ErrorIs(t, store.Release(ctx, "key", claim.Token), ErrClaimNotHeld)
+
+	t.Run("an abandoned claim expires with its lease", func(t *testing.T) {
+		_, claimed, err := store.Claim(ctx, "abandoned", time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, claimed)
+
+		mr.FastForward(2 * time.Minute)
+		_, claimed, err = store.Claim(ctx, "abandoned", time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, claimed)
+	})
+
+	t.Run("a stale claim can't release or complete the new one", func(t *testing.T) {
+		stale, _, err := store.Claim(ctx, "taken-over", time.Minute)
+		assert.NoError(t, err)
+		mr.FastForward(2 * time.Minute)
+		current, claimed, err := store.Claim(ctx, "taken-over", time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, claimed)
+
+		assert.ErrorIs(t, store.Release(ctx, "taken-over", stale.Token), ErrClaimNotHeld)
+		assert.ErrorIs(t, store.Complete(ctx, "taken-over", stale.Token), ErrClaimNotHeld)
+		_, claimed, err = store.Claim(ctx, "taken-over", time.Minute)
+		assert.NoError(t, err)
+		assert.False(t, claimed, "the current claim must survive")
+
+		assert.NoError(t, store.Complete(ctx, "taken-over", current.Token))
+	})
+
+	t.Run("once settles its claim after ctx is cancelled", func(t *testing.T) {
+		handler := NewHandler(MockRepository{}, &countingClient{}, &countingClient{}).WithIdempotencyStore(store)
+		cancelled, cancel := context.WithCancel(ctx)
+
+		assert.NoError(t, handler.once(cancelled, "cancelled", ErrStepInProgress, func() error {
+			cancel()
+			return nil
+		}))
+		record, claimed, err := store.Claim(ctx, "cancelled", time.Minute)
+		assert.NoError(t, err)
+		assert.False(t, claimed)
+		assert.True(t, record.Completed)
+	})
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrShuttingDown is returned by SignUp once Shutdown has been called.
+var ErrShuttingDown = errors.New("handler is shutting down")
+
+// Task is one background step of a sign-up.
+type Task struct {
+	ID        string    `json:"id"`
+	SignUpID  string    `json:"sign_up_id"`
+	User      User      `json:"user"`
+	Step      Step      `json:"step"`
+	Attempts  int       `json:"attempts"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TaskStats counts the handler's background tasks.
+type TaskStats struct {
+	// InFlight is the number of tasks that are running or waiting to retry.
+	InFlight int
+	// Failed is the number of tasks that were dead-lettered since the handler started.
+	Failed int
+}
+
+// PendingTaskStore keeps the tasks that were still unfinished at shutdown, so the
+// next process can resume them. A resumed task stays in the store until it finishes,
+// so it isn't lost if that process dies too.
+type PendingTaskStore interface {
+	// Save adds tasks to the store, replacing saved tasks with the same ID.
+	Save(tasks []Task) error
+	// Load returns the saved tasks.
+	Load() ([]Task, error)
+	// Remove deletes a finished task from the store.
+	Remove(id string) error
+}
+
+// FilePendingTaskStore is a PendingTaskStore that keeps tasks in a JSON file.
+type FilePendingTaskStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFilePendingTaskStore is a constructor for the FilePendingTaskStore struct.
+func NewFilePendingTaskStore(path string) *FilePendingTaskStore {
+	return &FilePendingTaskStore{path: path}
+}
+
+// Save adds tasks to the file. The file is replaced atomically, so a crash while
+// saving leaves the previous contents.
+func (s *FilePendingTaskStore) Save(tasks []Task) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, err := s.read()
+	if err != nil {
+		return err
+	}
+	index := make(map[string]int, len(existing))
+	for i, task := range existing {
+		index[task.ID] = i
+	}
+	for _, task := range tasks {
+		if i, ok := index[task.ID]; ok {
+			existing[i] = task
+			continue
+		}
+		index[task.ID] = len(existing)
+		existing = append(existing, task)
+	}
+	return s.write(existing)
+}
+
+func (s *FilePendingTaskStore) Load() ([]Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read()
+}
+
+func (s *FilePendingTaskStore) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tasks, err := s.read()
+	if err != nil {
+		return err
+	}
+	remaining := tasks[:0]
+	for _, task := range tasks {
+		if task.ID != id {
+			remaining = append(remaining, task)
+		}
+	}
+	if len(remaining) == len(tasks) {
+		return nil
+	}
+	if len(remaining) == 0 {
+		return os.Remove(s.path)
+	}
+	return s.write(remaining)
+}
+
+// write replaces the file with tasks.
+func (s *FilePendingTaskStore) write(tasks []Task) error {
+	data, err := json.MarshalIndent(tasks, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *FilePendingTaskStore) read() ([]Task, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tasks []Task
+	if err := json.Unmarshal(data, &tasks); err != nil {
+		return nil, fmt.Errorf("invalid pending task file %s: %w", s.path, err)
+	}
+	return tasks, nil
+}
+
+// lifecycle tracks a handler's background tasks. It is shared by every copy of
+// the handler.
+type lifecycle struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	// active counts admitted sign-ups and running tasks.
+	active sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+	tasks  map[string]*Task
+	// saved holds the IDs of running tasks that are also in the pending task store.
+	// They are removed from the store when they finish.
+	saved  map[string]bool
+	failed int
+}
+
+func newLifecycle() *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &lifecycle{ctx: ctx, cancel: cancel, tasks: make(map[string]*Task), saved: make(map[string]bool)}
+}
+
+// admit registers a unit of work, or fails once the handler is shutting down.
+// The returned function must be called when the work is done.
+func (l *lifecycle) admit() (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, ErrShuttingDown
+	}
+	l.active.Add(1)
+	return l.active.Done, nil
+}
+
+// bind returns a copy of ctx that is also cancelled once Shutdown is done, so
+// consumers and relays started with ctx stop with the handler.
+func (l *lifecycle) bind(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(l.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+func (l *lifecycle) attempted(task *Task) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	task.Attempts++
+}
+
+// taskOutcome is how a background task ended.
+type taskOutcome int
+
+const (
+	taskSucceeded taskOutcome = iota
+	taskDeadLettered
+	// taskInterrupted means Shutdown cancelled the task before it succeeded.
+	taskInterrupted
+)
+
+// finished forgets a task. Interrupted tasks are kept, so Shutdown saves them.
+// A finished task that is in store is removed from it; this happens under the
+// lock, so it can't be undone by a Shutdown saving the task at the same time.
+func (l *lifecycle) finished(task *Task, outcome taskOutcome, store PendingTaskStore) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if outcome == taskInterrupted {
+		return
+	}
+	if outcome == taskDeadLettered {
+		l.failed++
+	}
+	delete(l.tasks, task.ID)
+	if l.saved[task.ID] {
+		delete(l.saved, task.ID)
+		if err := store.Remove(task.ID); err != nil {
+			log.Printf("failed to remove finished task %s from the pending task store: %v", task.ID, err)
+		}
+	}
+}
+
+// WithPendingTaskStore returns a copy of the handler that saves unfinished tasks to store on shutdown.
+func (h Handler) WithPendingTaskStore(store PendingTaskStore) Handler {
+	h.pendingTasks = store
+	return h
+}
+
+// Stats returns the number of in-flight and failed background tasks.
+func (h Handler) Stats() TaskStats {
+	h.lifecycle.mu.Lock()
+	defer h.lifecycle.mu.Unlock()
+	return TaskStats{InFlight: len(h.lifecycle.tasks), Failed: h.lifecycle.failed}
+}
+
+// Shutdown stops accepting sign-ups and waits for the background tasks to finish.
+// Consumers started with Subscribe or Consume and relays started with
+// RunOutboxRelay take no new work; Shutdown waits for the event and the batch they
+// are handling and then stops them. If ctx ends first, the remaining tasks are
+// cancelled and saved to the pending task store, and the context's error is returned. A task whose client call was
+// still running is saved too, so it runs at least once but may run twice. A saved
+// task that still finishes is removed from the store again.
+func (h Handler) Shutdown(ctx context.Context) error {
+	l := h.lifecycle
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		l.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		l.cancel()
+		return nil
+	case <-ctx.Done():
+	}
+
+	// The tasks are saved while holding the lock, so a task that finishes in the
+	// meantime waits in finished and then removes itself from the store again.
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cancel()
+	unfinished := make([]Task, 0, len(l.tasks))
+	for _, task := range l.tasks {
+		unfinished = append(unfinished, *task)
+	}
+
+	if len(unfinished) == 0 {
+		return nil
+	}
+	if h.pendingTasks == nil {
+		return fmt.Errorf("%d unfinished task(s) lost, no pending task store: %w", len(unfinished), ctx.Err())
+	}
+	if err := h.pendingTasks.Save(unfinished); err != nil {
+		return fmt.Errorf("failed to save %d unfinished task(s): %w", len(unfinished), errors.Join(ctx.Err(), err))
+	}
+	for _, task := range unfinished {
+		l.saved[task.ID] = true
+	}
+	return fmt.Errorf("saved %d unfinished task(s) for later: %w", len(unfinished), ctx.Err())
+}
+
+// Resume starts the tasks saved by a previous Shutdown and returns how many were started.
+// Each task stays in the pending task store until it succeeds or is dead-lettered.
+func (h Handler) Resume() (int, error) {
+	if h.pendingTasks == nil {
+		return 0, nil
+	}
+	release, err := h.lifecycle.admit()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	tasks, err := h.pendingTasks.Load()
+	if err != nil {
+		return 0, err
+	}
+	started := 0
+	for _, task := range tasks {
+		if h.startSavedTask(task) {
+			started++
+		}
+	}
+	return started, nil
+}
+
+// startTask runs a task in the background. The caller must hold an admission.
+func (h Handler) startTask(task Task) {
+	l := h.lifecycle
+	l.mu.Lock()
+	l.tasks[task.ID] = &task
+	l.active.Add(1)
+	l.mu.Unlock()
+
+	go h.run(&task)
+}
+
+// startSavedTask runs a task from the pending task store, unless it is already running.
+func (h Handler) startSavedTask(task Task) bool {
+	l := h.lifecycle
+	l.mu.Lock()
+	if _, ok := l.tasks[task.ID]; ok {
+		l.mu.Unlock()
+		return false
+	}
+	l.tasks[task.ID] = &task
+	l.saved[task.ID] = true
+	l.active.Add(1)
+	l.mu.Unlock()
+
+	go h.run(&task)
+	return true
+}
+
+func (h Handler) run(task *Task) {
+	l := h.lifecycle
+	defer l.active.Done()
+	l.finished(task, h.runTask(l.ctx, task), h.pendingTasks)
+}
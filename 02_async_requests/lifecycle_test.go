@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingClient blocks every call until release is closed.
+type blockingClient struct {
+	release chan struct{}
+}
+
+func (c blockingClient) AddToNewsletter(User) error  { <-c.release; return nil }
+func (c blockingClient) SendNotification(User) error { <-c.release; return nil }
+
+// startedClient closes started on its first call and blocks every call until release is closed.
+type startedClient struct {
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (c *startedClient) call() error {
+	c.once.Do(func() { close(c.started) })
+	<-c.release
+	return nil
+}
+
+func (c *startedClient) AddToNewsletter(User) error  { return c.call() }
+func (c *startedClient) SendNotification(User) error { return c.call() }
+
+// blockingPublisher closes publishing on its first Publish and blocks it until release is closed.
+type blockingPublisher struct {
+	publishing chan struct{}
+	release    chan struct{}
+	once       sync.Once
+}
+
+func (p *blockingPublisher) Publish(topic string, messages ...*message.Message) error {
+	p.once.Do(func() { close(p.publishing) })
+	<-p.release
+	return nil
+}
+
+func (p *blockingPublisher) Close() error { return nil }
+
+// blockingDeadLetterStore closes adding on the first Add and blocks it until release is closed.
+type blockingDeadLetterStore struct {
+	*MemoryDeadLetterStore
+	adding  chan struct{}
+	release chan struct{}
+}
+
+func (s blockingDeadLetterStore) Add(letter DeadLetter) error {
+	close(s.adding)
+	<-s.release
+	return s.MemoryDeadLetterStore.Add(letter)
+}
+
+func TestHandlerShutdown(t *testing.T) {
+	user := User{Email: "ada@example.com", MarketingConsent: true}
+
+	t.Run("waits for in-flight tasks and refuses new sign-ups", func(t *testing.T) {
+		client := blockingClient{release: make(chan struct{})}
+		handler := NewHandler(MockRepository{}, client, client)
+
+		assert.NoError(t, handler.SignUp(user))
+		assert.Equal(t, TaskStats{InFlight: 2}, handler.Stats())
+
+		shutdown := make(chan error)
+		go func() { shutdown <- handler.Shutdown(context.Background()) }()
+
+		assert.Eventually(t, func() bool {
+			return handler.SignUp(user) == ErrShuttingDown
+		}, time.Second, time.Millisecond)
+
+		close(client.release)
+		assert.NoError(t, <-shutdown)
+		assert.Equal(t, TaskStats{}, handler.Stats())
+	})
+
+	t.Run("counts dead-lettered tasks as failed", func(t *testing.T) {
+		handler := NewHandler(MockRepository{}, &countingClient{failures: 100}, &countingClient{}).
+			WithRetryPolicy(fastRetryPolicy(2))
+
+		assert.NoError(t, handler.SignUp(user))
+		assert.NoError(t, handler.Shutdown(context.Background()))
+		assert.Equal(t, TaskStats{Failed: 1}, handler.Stats())
+	})
+
+	t.Run("saves unfinished tasks at the deadline and resumes them", func(t *testing.T) {
+		store := NewFilePendingTaskStore(filepath.Join(t.TempDir(), "pending.json"))
+		newsletter := &countingClient{failures: 100}
+		notifications := blockingClient{release: make(chan struct{})}
+		defer close(notifications.release)
+		handler := NewHandler(MockRepository{}, newsletter, notifications).
+			WithRetryPolicy(RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Hour}).
+			WithPendingTaskStore(store)
+
+		assert.NoError(t, handler.SignUp(user))
+		assert.Eventually(t, func() bool { return newsletter.Calls() == 1 }, time.Second, time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		err := handler.Shutdown(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.ErrorContains(t, err, "saved 2 unfinished task(s)")
+
+		resumedClient := &countingClient{}
+		resumed := NewHandler(MockRepository{}, resumedClient, resumedClient).WithPendingTaskStore(store)
+		n, err := resumed.Resume()
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+		assert.NoError(t, resumed.Shutdown(context.Background()))
+		assert.Equal(t, 2, resumedClient.Calls())
+
+		tasks, err := store.Load()
+		assert.NoError(t, err)
+		assert.Empty(t, tasks)
+	})
+
+	t.Run("keeps resumed tasks in the store until they finish", func(t *testing.T) {
+		store := NewFilePendingTaskStore(filepath.Join(t.TempDir(), "pending.json"))
+		assert.NoError(t, store.Save([]Task{{ID: "task-1", User: user, Step: StepNotification}}))
+
+		client := blockingClient{release: make(chan struct{})}
+		handler := NewHandler(MockRepository{}, client, client).WithPendingTaskStore(store)
+		n, err := handler.Resume()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		n, err = handler.Resume()
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n, "a running task is not resumed twice")
+
+		tasks, err := store.Load()
+		assert.NoError(t, err)
+		assert.Len(t, tasks, 1)
+
+		close(client.release)
+		assert.NoError(t, handler.Shutdown(context.Background()))
+		tasks, err = store.Load()
+		assert.NoError(t, err)
+		assert.Empty(t, tasks)
+	})
+
+	t.Run("removes a saved task that is dead-lettered during shutdown", func(t *testing.T) {
+		store := NewFilePendingTaskStore(filepath.Join(t.TempDir(), "pending.json"))
+		deadLetters := blockingDeadLetterStore{NewMemoryDeadLetterStore(), make(chan struct{}), make(chan struct{})}
+		handler := NewHandler(MockRepository{}, &countingClient{failures: 100}, &countingClient{}).
+			WithRetryPolicy(fastRetryPolicy(1)).
+			WithDeadLetterStore(deadLetters).
+			WithPendingTaskStore(store)
+
+		assert.NoError(t, handler.SignUp(user))
+		<-deadLetters.adding
+		assert.Eventually(t, func() bool { return handler.Stats().InFlight == 1 }, time.Second, time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.ErrorContains(t, handler.Shutdown(ctx), "saved 1 unfinished task(s)")
+
+		close(deadLetters.release)
+		assert.Eventually(t, func() bool {
+			tasks, err := store.Load()
+			return err == nil && len(tasks) == 0
+		}, time.Second, time.Millisecond)
+		assert.Equal(t, TaskStats{Failed: 1}, handler.Stats())
+	})
+}
+
+func TestShutdownStopsConsumersAndRelays(t *testing.T) {
+	user := User{Email: "ada@example.com", MarketingConsent: true}
+
+	t.Run("waits for the event a consumer is handling", func(t *testing.T) {
+		pubSub := gochannel.NewGoChannel(gochannel.Config{Persistent: true}, watermill.NopLogger{})
+		defer pubSub.Close()
+		newsletter := &startedClient{started: make(chan struct{}), release: make(chan struct{})}
+		handler := NewHandler(MockRepository{}, newsletter, &countingClient{})
+
+		consumed := make(chan error)
+		go func() {
+			consumed <- handler.Consume(context.Background(), pubSub, ConsumerConfig{Step: StepNewsletter, Retry: fastRetryPolicy(3)})
+		}()
+		payload, err := json.Marshal(UserSignedUp{EventID: "signup-1", User: user})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, pubSub.Publish(UserSignedUpTopic, message.NewMessage("msg-1", payload)))
+		<-newsletter.started
+
+		shutdown := make(chan error)
+		go func() { shutdown <- handler.Shutdown(context.Background()) }()
+		select {
+		case <-shutdown:
+			t.Fatal("Shutdown returned while a consumer step was running")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		close(newsletter.release)
+		assert.NoError(t, <-shutdown)
+		select {
+		case err := <-consumed:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("consumer wasn't stopped by Shutdown")
+		}
+	})
+
+	t.Run("waits for the batch a relay is publishing", func(t *testing.T) {
+		repository := newSQLiteUserRepository(t)
+		assert.NoError(t, repository.CreateUserAccountWithEvent(UserSignedUp{EventID: "signup-1", User: user}))
+		publisher := &blockingPublisher{publishing: make(chan struct{}), release: make(chan struct{})}
+		handler := NewHandler(repository, &countingClient{}, &countingClient{})
+
+		relayed := make(chan struct{})
+		go func() {
+			handler.RunOutboxRelay(context.Background(), NewOutboxRelay(repository, publisher, OutboxRelayOptions{Interval: time.Millisecond}))
+			close(relayed)
+		}()
+		<-publisher.publishing
+
+		shutdown := make(chan error)
+		go func() { shutdown <- handler.Shutdown(context.Background()) }()
+		select {
+		case <-shutdown:
+			t.Fatal("Shutdown returned while a batch was being published")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		close(publisher.release)
+		assert.NoError(t, <-shutdown)
+		select {
+		case <-relayed:
+		case <-time.After(time.Second):
+			t.Fatal("relay wasn't stopped by Shutdown")
+		}
+
+		records, err := repository.Unpublished(context.Background(), 10)
+		assert.NoError(t, err)
+		assert.Empty(t, records, "the batch is marked published before the relay stops")
+	})
+}
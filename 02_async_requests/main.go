@@ -1,14 +1,28 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"os"
 	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-redisstream/pkg/redisstream"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/redis/go-redis/v9"
 )
 
 // User struct represents a user in the system.
 type User struct {
-	Email string
+	Email  string `json:"email"`
+	Name   string `json:"name,omitempty"`
+	Locale string `json:"locale,omitempty"`
+	// MarketingConsent must be given before the user is added to the newsletter.
+	MarketingConsent bool         `json:"marketing_consent"`
+	Source           SignUpSource `json:"source,omitempty"`
 }
 
 // UserRepository interface represents a component responsible for creating user accounts.
@@ -31,6 +45,15 @@ type Handler struct {
 	repository          UserRepository
 	newsletterClient    NewsletterClient
 	notificationsClient NotificationsClient
+	retryPolicy         RetryPolicy
+	deadLetters         DeadLetterStore
+	pendingTasks        PendingTaskStore
+	lifecycle           *lifecycle
+	outbox              bool
+	eventPublisher      message.Publisher
+	idempotency         IdempotencyStore
+	statuses            StatusStore
+	validator           UserValidator
 }
 
 // NewHandler is a constructor for the Handler struct.
@@ -43,42 +66,192 @@ func NewHandler(
 		repository:          repository,
 		newsletterClient:    newsletterClient,
 		notificationsClient: notificationsClient,
+		retryPolicy:         DefaultRetryPolicy(),
+		deadLetters:         NewMemoryDeadLetterStore(),
+		lifecycle:           newLifecycle(),
+		validator:           NewUserValidator(DefaultDisposableDomains),
 	}
 }
 
+// WithRetryPolicy returns a copy of the handler that retries background steps with policy.
+func (h Handler) WithRetryPolicy(policy RetryPolicy) Handler {
+	h.retryPolicy = policy
+	return h
+}
+
+// WithDeadLetterStore returns a copy of the handler that records steps that gave up in store.
+func (h Handler) WithDeadLetterStore(store DeadLetterStore) Handler {
+	h.deadLetters = store
+	return h
+}
+
 // SignUp method is responsible for the sign-up process.
 func (h Handler) SignUp(u User) error {
-	if err := h.repository.CreateUserAccount(u); err != nil {
+	return h.SignUpWithRequestID("", u)
+}
+
+// SignUpWithRequestID signs up a user like SignUp. The user is validated and
+// normalised first; an invalid user fails with a *ValidationError. With an idempotency store, a
+// sign-up that already succeeded for the same request ID, or for the same email
+// when requestID is empty, returns nil again without creating the account twice.
+// A sign-up that failed can be retried with the same key.
+func (h Handler) SignUpWithRequestID(requestID string, u User) error {
+	release, err := h.lifecycle.admit()
+	if err != nil {
 		return err
 	}
+	defer release()
 
-	// Asynchronously add the user to the newsletter with retries
-	go func() {
-		for {
-			if err := h.newsletterClient.AddToNewsletter(u); err != nil {
-				log.Printf("failed to add user %s to the newsletter: %v", u.Email, err)
-				time.Sleep(1 * time.Second)
-				continue
-			}
-			break
-		}
-	}()
+	u, err = h.validator.Validate(u)
+	if err != nil {
+		return err
+	}
 
-	// Asynchronously send a notification to the user with retries
-	go func() {
-		for {
-			if err := h.notificationsClient.SendNotification(u); err != nil {
-				log.Printf("failed to send notification to user %s: %v", u.Email, err)
-				time.Sleep(1 * time.Second)
-				continue
-			}
-			break
+	return h.once(context.Background(), signUpKey(requestID, u), ErrSignUpInProgress, func() error {
+		return h.signUp(u)
+	})
+}
+
+func (h Handler) signUp(u User) error {
+	event := UserSignedUp{EventID: watermill.NewUUID(), User: u, OccurredAt: time.Now().UTC()}
+	h.recordSignUp(event)
+
+	outboxed, err := h.createAccount(event)
+	h.recordAccount(event.EventID, err)
+	if err != nil {
+		return err
+	}
+
+	if outboxed {
+		return nil
+	}
+	if h.eventPublisher != nil {
+		err := h.publishSignUp(event)
+		if err == nil {
+			return nil
 		}
-	}()
+		log.Printf("failed to publish sign-up of user %s, running its steps here: %v", u.Email, err)
+	}
+
+	// Asynchronously add the user to the newsletter and send a notification, with retries
+	h.startTask(Task{ID: newID(), SignUpID: event.EventID, User: u, Step: StepNewsletter, CreatedAt: event.OccurredAt})
+	h.startTask(Task{ID: newID(), SignUpID: event.EventID, User: u, Step: StepNotification, CreatedAt: event.OccurredAt})
 
 	return nil
 }
 
+// createAccount creates the account of a sign-up. An OutboxRepository records the
+// sign-up's own event, so its ID can be used to track the sign-up's status, and
+// outboxed reports that the event's consumers will run the sign-up's steps.
+func (h Handler) createAccount(event UserSignedUp) (outboxed bool, err error) {
+	if repository, ok := h.repository.(OutboxRepository); ok && h.outbox {
+		return true, repository.CreateUserAccountWithEvent(event)
+	}
+	return false, h.repository.CreateUserAccount(event.User)
+}
+
+// DeadLetters returns the steps that failed every attempt, oldest first.
+func (h Handler) DeadLetters() ([]DeadLetter, error) {
+	return h.deadLetters.List()
+}
+
+// Redrive runs a dead-lettered step again with the handler's retry policy. The dead
+// letter is removed when the step succeeds, and updated with the new attempts when it fails again.
+func (h Handler) Redrive(ctx context.Context, id string) error {
+	letter, err := h.deadLetters.Get(id)
+	if err != nil {
+		return err
+	}
+
+	attempts, err := retry(ctx, h.retryPolicy, func() error { return h.runStep(ctx, letter.SignUpID, letter.Step, letter.User) })
+	if err == nil {
+		return h.deadLetters.Remove(id)
+	}
+
+	letter.Attempts += attempts
+	letter.LastError = err.Error()
+	letter.FailedAt = time.Now()
+	if storeErr := h.deadLetters.Add(letter); storeErr != nil {
+		return errors.Join(err, storeErr)
+	}
+	return fmt.Errorf("re-driving %s for user %s failed after %d attempt(s): %w", letter.Step, letter.User.Email, attempts, err)
+}
+
+// runTask retries a task according to the retry policy and dead-letters it when
+// every attempt fails. A task interrupted by Shutdown is left for the pending
+// task store instead.
+func (h Handler) runTask(ctx context.Context, task *Task) taskOutcome {
+	u, step := task.User, task.Step
+	_, err := retry(ctx, h.retryPolicy, func() error {
+		h.lifecycle.attempted(task)
+		err := h.runStep(ctx, task.SignUpID, step, u)
+		if err != nil {
+			log.Printf("%s step for user %s failed: %v", step, u.Email, err)
+		}
+		return err
+	})
+	if err == nil {
+		return taskSucceeded
+	}
+	if ctx.Err() != nil {
+		return taskInterrupted
+	}
+
+	h.lifecycle.mu.Lock()
+	finished := *task
+	h.lifecycle.mu.Unlock()
+
+	h.deadLetter(finished, err)
+	return taskDeadLettered
+}
+
+// deadLetter records a task that failed every attempt with err.
+func (h Handler) deadLetter(task Task, err error) {
+	h.recordFailed(task.SignUpID, task.Step)
+
+	letter := DeadLetter{
+		ID:        newID(),
+		SignUpID:  task.SignUpID,
+		User:      task.User,
+		Step:      task.Step,
+		Attempts:  task.Attempts,
+		LastError: err.Error(),
+		FailedAt:  time.Now(),
+	}
+	if err := h.deadLetters.Add(letter); err != nil {
+		log.Printf("failed to dead-letter %s step for user %s: %v", task.Step, task.User.Email, err)
+		return
+	}
+	log.Printf("gave up on %s step for user %s after %d attempt(s), dead letter %s", task.Step, task.User.Email, task.Attempts, letter.ID)
+}
+
+// runStep makes one attempt at a step of a sign-up and records it in the sign-up's
+// status. With an idempotency store, a step that already succeeded for the user
+// isn't run again. The newsletter step is skipped for users without marketing consent.
+func (h Handler) runStep(ctx context.Context, signUpID string, step Step, u User) error {
+	if step == StepNewsletter && !u.MarketingConsent {
+		h.recordSkipped(signUpID, step)
+		return nil
+	}
+
+	err := h.once(ctx, stepKey(step, u), ErrStepInProgress, func() error {
+		return h.step(step)(u)
+	})
+	h.recordAttempt(signUpID, step, err)
+	return err
+}
+
+func (h Handler) step(step Step) func(User) error {
+	switch step {
+	case StepNewsletter:
+		return h.newsletterClient.AddToNewsletter
+	case StepNotification:
+		return h.notificationsClient.SendNotification
+	default:
+		return func(User) error { return fmt.Errorf("unknown sign-up step %q", step) }
+	}
+}
+
 // Mock implementations for the interfaces
 type MockRepository struct{}
 
@@ -102,13 +275,68 @@ func (m MockNewsletterClient) AddToNewsletter(u User) error {
 }
 
 func main() {
-	handler := NewHandler(MockRepository{}, MockNewsletterClient{}, MockNotificationsClient{})
-	user := User{Email: "test@example.com"}
+	rdb := redis.NewClient(&redis.Options{
+		Addr: os.Getenv("REDIS_ADDR"),
+	})
+	publisher, err := redisstream.NewPublisher(redisstream.PublisherConfig{Client: rdb}, watermill.NewStdLogger(false, false))
+	if err != nil {
+		log.Fatalf("Failed to create publisher: %v", err)
+	}
+
+	// Serve the status of sign-ups for support, e.g. GET /signups?email=test@example.com
+	statuses := NewMemoryStatusStore()
+	go func() {
+		log.Printf("Status API stopped: %v", http.ListenAndServe(":8080", NewStatusHTTPHandler(statuses)))
+	}()
+
+	retryPolicy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, Multiplier: 2, Jitter: FullJitter}
+	handler := NewHandler(MockRepository{}, MockNewsletterClient{}, MockNotificationsClient{}).
+		WithRetryPolicy(retryPolicy).
+		WithStatusStore(statuses).
+		WithPendingTaskStore(NewFilePendingTaskStore("pending-tasks.json")).
+		WithEventPublisher(publisher)
+	user := User{Email: "test@example.com", Name: "Test User", Locale: "en-GB", MarketingConsent: true, Source: SourceWeb}
+
+	consumers := DefaultConsumerConfigs()
+	for i := range consumers {
+		consumers[i].Retry = retryPolicy
+	}
+	// Shutdown stops the consumers, after the events they are handling.
+	if err := handler.Subscribe(context.Background(), rdb, consumers...); err != nil {
+		log.Fatalf("Failed to subscribe: %v", err)
+	}
+
+	if resumed, err := handler.Resume(); err != nil {
+		log.Fatalf("Failed to resume pending tasks: %v", err)
+	} else if resumed > 0 {
+		log.Printf("Resumed %d task(s) left by the previous run", resumed)
+	}
 
 	if err := handler.SignUp(user); err != nil {
 		log.Fatalf("Failed to sign up user: %v", err)
 	}
 
-	// Keep the main goroutine running to allow asynchronous goroutines to execute.
+	// Keep the main goroutine running to allow the consumers to process the event.
 	time.Sleep(10 * time.Second)
+
+	// Give the background tasks up to 10 seconds to finish, and save the rest for the next run.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := handler.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: %v", err)
+	}
+	stats := handler.Stats()
+	log.Printf("%d task(s) in flight, %d failed", stats.InFlight, stats.Failed)
+
+	letters, err := handler.DeadLetters()
+	if err != nil {
+		log.Fatalf("Failed to list dead letters: %v", err)
+	}
+	for _, letter := range letters {
+		log.Printf("Dead letter %s: %s step for user %s failed %d time(s): %s", letter.ID, letter.Step, letter.User.Email, letter.Attempts, letter.LastError)
+	}
+
+	if status, err := statuses.Latest(user.Email); err == nil {
+		log.Printf("Sign-up %s: notification %s, newsletter %s", status.SignUpID, status.Notification.State, status.Newsletter.State)
+	}
 }
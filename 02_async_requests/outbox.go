@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrUserExists is returned when an account already exists for an email.
+var ErrUserExists = errors.New("user already exists")
+
+// OutboxRecord is an event written in the same transaction as the change it describes.
+type OutboxRecord struct {
+	ID        int64
+	EventID   string
+	Topic     string
+	Payload   []byte
+	CreatedAt time.Time
+}
+
+// OutboxRepository is a UserRepository that records a given UserSignedUp event
+// in the outbox with the account. Handler uses it so the event ID, which is the
+// sign-up ID, is known up front.
+type OutboxRepository interface {
+	UserRepository
+	CreateUserAccountWithEvent(event UserSignedUp) error
+}
+
+// OutboxStore gives the relay the outbox records that haven't been published yet.
+type OutboxStore interface {
+	// Unpublished returns up to limit unpublished records, oldest first.
+	Unpublished(ctx context.Context, limit int) ([]OutboxRecord, error)
+	MarkPublished(ctx context.Context, id int64) error
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	email      TEXT PRIMARY KEY,
+	created_at TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS outbox (
+	id           INTEGER PRIMARY KEY AUTOINCREMENT,
+	event_id     TEXT NOT NULL UNIQUE,
+	topic        TEXT NOT NULL,
+	payload      BLOB NOT NULL,
+	created_at   TIMESTAMP NOT NULL,
+	published_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS outbox_unpublished ON outbox (id) WHERE published_at IS NULL;
+`
+
+// SQLiteUserRepository is a UserRepository on SQLite. It writes every account and
+// its UserSignedUp outbox record in one transaction, so an account never exists
+// without the event that triggers its newsletter and notification.
+type SQLiteUserRepository struct {
+	db *sql.DB
+}
+
+// NewSQLiteUserRepository is a constructor for the SQLiteUserRepository struct.
+// It creates the tables if they don't exist.
+func NewSQLiteUserRepository(db *sql.DB) (*SQLiteUserRepository, error) {
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		return nil, fmt.Errorf("failed to create schema: %w", err)
+	}
+	return &SQLiteUserRepository{db: db}, nil
+}
+
+func (r *SQLiteUserRepository) CreateUserAccount(u User) error {
+	return r.CreateUserAccountWithEvent(UserSignedUp{EventID: watermill.NewUUID(), User: u, OccurredAt: time.Now().UTC()})
+}
+
+// CreateUserAccountWithEvent creates the account of event's user and records event in the outbox.
+func (r *SQLiteUserRepository) CreateUserAccountWithEvent(event UserSignedUp) error {
+	u, now := event.User, event.OccurredAt
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO users (email, created_at) VALUES (?, ?)`, u.Email, now); err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+			return fmt.Errorf("%w: %s", ErrUserExists, u.Email)
+		}
+		return fmt.Errorf("failed to create account for %s: %w", u.Email, err)
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO outbox (event_id, topic, payload, created_at) VALUES (?, ?, ?, ?)`,
+		event.EventID, UserSignedUpTopic, payload, now,
+	); err != nil {
+		return fmt.Errorf("failed to record sign-up event for %s: %w", u.Email, err)
+	}
+	return tx.Commit()
+}
+
+func (r *SQLiteUserRepository) Unpublished(ctx context.Context, limit int) ([]OutboxRecord, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT id, event_id, topic, payload, created_at FROM outbox WHERE published_at IS NULL ORDER BY id LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []OutboxRecord
+	for rows.Next() {
+		var record OutboxRecord
+		if err := rows.Scan(&record.ID, &record.EventID, &record.Topic, &record.Payload, &record.CreatedAt); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (r *SQLiteUserRepository) MarkPublished(ctx context.Context, id int64) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE outbox SET published_at = ? WHERE id = ?`, time.Now().UTC(), id)
+	return err
+}
+
+// OutboxRelayOptions configures an OutboxRelay.
+type OutboxRelayOptions struct {
+	// Interval is how often the outbox is polled. Defaults to 1s.
+	Interval time.Duration
+	// BatchSize is the maximum number of records published per poll. Defaults to 100.
+	BatchSize int
+}
+
+// OutboxRelay forwards outbox records to a Watermill publisher. A record is marked
+// published only after Publish returns, so delivery is at least once: after a crash
+// in between, the record is published again. The message UUID is the event ID, so
+// subscribers can recognise duplicates.
+type OutboxRelay struct {
+	store     OutboxStore
+	publisher message.Publisher
+	opts      OutboxRelayOptions
+}
+
+// NewOutboxRelay is a constructor for the OutboxRelay struct.
+func NewOutboxRelay(store OutboxStore, publisher message.Publisher, opts OutboxRelayOptions) OutboxRelay {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	return OutboxRelay{store: store, publisher: publisher, opts: opts}
+}
+
+// Run relays records every interval until ctx is cancelled.
+func (r OutboxRelay) Run(ctx context.Context) {
+	r.run(ctx, nil)
+}
+
+// RunOutboxRelay runs relay as part of the handler's lifecycle, until ctx is
+// cancelled or the handler is shut down. Shutdown waits for a batch that is being
+// published, and the relay publishes no new batch once Shutdown has started.
+func (h Handler) RunOutboxRelay(ctx context.Context, relay OutboxRelay) {
+	ctx, cancel := h.lifecycle.bind(ctx)
+	defer cancel()
+	relay.run(ctx, h.lifecycle.admit)
+}
+
+// run relays records every interval. If admit is set, every batch is admitted
+// with it first, and the relay stops once admit fails.
+func (r OutboxRelay) run(ctx context.Context, admit func() (func(), error)) {
+	ticker := time.NewTicker(r.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		release := func() {}
+		if admit != nil {
+			var err error
+			if release, err = admit(); err != nil {
+				return
+			}
+		}
+		if _, err := r.RelayOnce(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("outbox relay: %v", err)
+		}
+		release()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RelayOnce publishes one batch of records in order and returns how many were
+// published. It stops at the first record that fails, so the order is kept.
+func (r OutboxRelay) RelayOnce(ctx context.Context) (int, error) {
+	records, err := r.store.Unpublished(ctx, r.opts.BatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read outbox: %w", err)
+	}
+
+	for i, record := range records {
+		msg := message.NewMessage(record.EventID, record.Payload)
+		if err := r.publisher.Publish(record.Topic, msg); err != nil {
+			return i, fmt.Errorf("failed to publish outbox record %d: %w", record.ID, err)
+		}
+		if err := r.store.MarkPublished(ctx, record.ID); err != nil {
+			return i, fmt.Errorf("failed to mark outbox record %d as published: %w", record.ID, err)
+		}
+	}
+	return len(records), nil
+}
+
+// WithOutbox returns a copy of the handler for a repository that records a
+// UserSignedUp event with every account, such as SQLiteUserRepository. SignUp
+// then leaves the newsletter and notification to the UserSignedUp consumers. With a
+// repository that isn't an OutboxRepository, SignUp publishes the event or runs the
+// steps itself as usual, since nothing would be left in an outbox to relay.
+func (h Handler) WithOutbox() Handler {
+	h.outbox = true
+	return h
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSQLiteUserRepository(t *testing.T) *SQLiteUserRepository {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	repository, err := NewSQLiteUserRepository(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repository
+}
+
+// flakyPublisher fails while failing is set and records what it published.
+type flakyPublisher struct {
+	mu        sync.Mutex
+	failing   bool
+	published []*message.Message
+}
+
+func (p *flakyPublisher) Publish(topic string, messages ...*message.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failing {
+		return errors.New("broker unavailable")
+	}
+	p.published = append(p.published, messages...)
+	return nil
+}
+
+func (p *flakyPublisher) Close() error { return nil }
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("writes an outbox record with every account", func(t *testing.T) {
+		repository := newSQLiteUserRepository(t)
+		client := &countingClient{}
+		handler := NewHandler(repository, client, client).WithOutbox()
+
+		assert.NoError(t, handler.SignUp(User{Email: "ada@example.com"}))
+		assert.ErrorIs(t, handler.SignUp(User{Email: "ada@example.com"}), ErrUserExists)
+		assert.NoError(t, handler.Shutdown(ctx))
+		assert.Equal(t, 0, client.Calls())
+
+		records, err := repository.Unpublished(ctx, 10)
+		assert.NoError(t, err)
+		if assert.Len(t, records, 1) {
+			assert.Equal(t, UserSignedUpTopic, records[0].Topic)
+			assert.Contains(t, string(records[0].Payload), `"email":"ada@example.com"`)
+		}
+	})
+
+	t.Run("runs the steps itself without an outbox repository", func(t *testing.T) {
+		client := &countingClient{}
+		handler := NewHandler(MockRepository{}, client, client).WithOutbox()
+
+		assert.NoError(t, handler.SignUp(User{Email: "ada@example.com", MarketingConsent: true}))
+		assert.NoError(t, handler.Shutdown(ctx))
+		assert.Equal(t, 2, client.Calls())
+	})
+
+	t.Run("relay keeps records until they are published", func(t *testing.T) {
+		repository := newSQLiteUserRepository(t)
+		assert.NoError(t, repository.CreateUserAccount(User{Email: "ada@example.com"}))
+		assert.NoError(t, repository.CreateUserAccount(User{Email: "grace@example.com"}))
+
+		publisher := &flakyPublisher{failing: true}
+		relay := NewOutboxRelay(repository, publisher, OutboxRelayOptions{})
+
+		n, err := relay.RelayOnce(ctx)
+		assert.ErrorContains(t, err, "broker unavailable")
+		assert.Equal(t, 0, n)
+
+		publisher.failing = false
+		n, err = relay.RelayOnce(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+		assert.Contains(t, string(publisher.published[0].Payload), "ada@example.com")
+		assert.Contains(t, string(publisher.published[1].Payload), "grace@example.com")
+
+		n, err = relay.RelayOnce(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+	})
+
+	t.Run("subscribers run the side effects", func(t *testing.T) {
+		repository := newSQLiteUserRepository(t)
+		pubSub := gochannel.NewGoChannel(gochannel.Config{Persistent: true}, watermill.NopLogger{})
+		defer pubSub.Close()
+
+		newsletter := &countingClient{failures: 1}
+		notifications := &countingClient{}
+		handler := NewHandler(repository, newsletter, notifications).WithOutbox()
+
+		consumeCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go handler.Consume(consumeCtx, pubSub, ConsumerConfig{Step: StepNewsletter, Retry: fastRetryPolicy(3)})
+		go handler.Consume(consumeCtx, pubSub, ConsumerConfig{Step: StepNotification, Retry: fastRetryPolicy(3)})
+
+		assert.NoError(t, handler.SignUp(User{Email: "ada@example.com", MarketingConsent: true}))
+		relay := NewOutboxRelay(repository, pubSub, OutboxRelayOptions{Interval: time.Millisecond})
+		go relay.Run(consumeCtx)
+
+		assert.Eventually(t, func() bool {
+			return newsletter.Calls() == 2 && notifications.Calls() == 1
+		}, time.Second, time.Millisecond)
+		letters, err := handler.DeadLetters()
+		assert.NoError(t, err)
+		assert.Empty(t, letters)
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Jitter selects how much randomness is applied to each backoff delay.
+type Jitter int
+
+const (
+	// NoJitter sleeps for exactly the computed backoff.
+	NoJitter Jitter = iota
+	// FullJitter sleeps for a random duration between zero and the computed backoff.
+	FullJitter
+	// EqualJitter sleeps for half the computed backoff plus a random duration up to the other half.
+	EqualJitter
+)
+
+// RetryPolicy describes how a background sign-up step is retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+	// InitialBackoff is the delay before the second attempt.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between two attempts. Zero means no cap.
+	MaxBackoff time.Duration
+	// Multiplier grows the delay after every failed attempt.
+	Multiplier float64
+	// Jitter randomises the delay so retries after an outage don't arrive in lockstep.
+	Jitter Jitter
+}
+
+// DefaultRetryPolicy returns the policy used when nothing else is configured:
+// five attempts starting at a 1 second backoff, so a step gives up after about 15 seconds.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 1 * time.Second,
+		MaxBackoff:     30 * time.Second,
+		Multiplier:     2,
+		Jitter:         FullJitter,
+	}
+}
+
+// backoff returns the delay to wait after the given (1-based) failed attempt.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	multiplier := max(p.Multiplier, 1)
+
+	delay := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+
+	d := time.Duration(delay)
+	if d <= 0 {
+		return 0
+	}
+
+	switch p.Jitter {
+	case FullJitter:
+		return time.Duration(rand.Int63n(int64(d) + 1))
+	case EqualJitter:
+		half := d / 2
+		return half + time.Duration(rand.Int63n(int64(d-half)+1))
+	default:
+		return d
+	}
+}
+
+// retry calls f until it succeeds, the policy runs out of attempts or ctx is
+// cancelled. It returns the number of attempts made and the last error.
+func retry(ctx context.Context, policy RetryPolicy, f func() error) (int, error) {
+	maxAttempts := max(policy.MaxAttempts, 1)
+
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = f(); err == nil {
+			return attempt, nil
+		}
+		if attempt == maxAttempts {
+			return attempt, err
+		}
+
+		timer := time.NewTimer(policy.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, err
+		case <-timer.C:
+		}
+	}
+	return maxAttempts, err
+}
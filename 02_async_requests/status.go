@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrSignUpNotFound is returned when no status is known for a sign-up.
+var ErrSignUpNotFound = errors.New("sign-up not found")
+
+// StepState is where a sign-up step stands.
+type StepState string
+
+const (
+	StepPending StepState = "pending"
+	// StepSent is the state of a notification that was sent.
+	StepSent StepState = "sent"
+	// StepAdded is the state of a newsletter subscription that was added.
+	StepAdded StepState = "added"
+	// StepFailed is the state of a step that was dead-lettered.
+	StepFailed StepState = "failed"
+	// StepSkipped is the state of a newsletter subscription without marketing consent.
+	StepSkipped StepState = "skipped"
+)
+
+// StepStatus is the progress of one step of a sign-up.
+type StepStatus struct {
+	State     StepState `json:"state"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SignUpStatus is the progress of a sign-up and its steps.
+type SignUpStatus struct {
+	SignUpID       string    `json:"sign_up_id"`
+	Email          string    `json:"email"`
+	CreatedAt      time.Time `json:"created_at"`
+	AccountCreated bool      `json:"account_created"`
+	// AccountError is set when the account couldn't be created.
+	AccountError string     `json:"account_error,omitempty"`
+	Notification StepStatus `json:"notification"`
+	Newsletter   StepStatus `json:"newsletter"`
+}
+
+func (s *SignUpStatus) step(step Step) *StepStatus {
+	switch step {
+	case StepNewsletter:
+		return &s.Newsletter
+	case StepNotification:
+		return &s.Notification
+	default:
+		return nil
+	}
+}
+
+// StatusStore keeps the status of sign-ups.
+type StatusStore interface {
+	Create(status SignUpStatus) error
+	// Update applies update to a sign-up's status, or returns ErrSignUpNotFound.
+	Update(signUpID string, update func(*SignUpStatus)) error
+	Get(signUpID string) (SignUpStatus, error)
+	// Latest returns the most recent sign-up for an email.
+	Latest(email string) (SignUpStatus, error)
+}
+
+// MemoryStatusStore is a StatusStore kept in memory.
+type MemoryStatusStore struct {
+	mu       sync.Mutex
+	statuses map[string]SignUpStatus
+	latest   map[string]string
+}
+
+// NewMemoryStatusStore is a constructor for the MemoryStatusStore struct.
+func NewMemoryStatusStore() *MemoryStatusStore {
+	return &MemoryStatusStore{statuses: make(map[string]SignUpStatus), latest: make(map[string]string)}
+}
+
+func (s *MemoryStatusStore) Create(status SignUpStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[status.SignUpID] = status
+	s.latest[normaliseEmail(status.Email)] = status.SignUpID
+	return nil
+}
+
+func (s *MemoryStatusStore) Update(signUpID string, update func(*SignUpStatus)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok := s.statuses[signUpID]
+	if !ok {
+		return ErrSignUpNotFound
+	}
+	update(&status)
+	s.statuses[signUpID] = status
+	return nil
+}
+
+func (s *MemoryStatusStore) Get(signUpID string) (SignUpStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok := s.statuses[signUpID]
+	if !ok {
+		return SignUpStatus{}, ErrSignUpNotFound
+	}
+	return status, nil
+}
+
+func (s *MemoryStatusStore) Latest(email string) (SignUpStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok := s.statuses[s.latest[normaliseEmail(email)]]
+	if !ok {
+		return SignUpStatus{}, ErrSignUpNotFound
+	}
+	return status, nil
+}
+
+// WithStatusStore returns a copy of the handler that records the progress of every sign-up in store.
+func (h Handler) WithStatusStore(store StatusStore) Handler {
+	h.statuses = store
+	return h
+}
+
+// recordSignUp records a new sign-up with both steps pending.
+func (h Handler) recordSignUp(event UserSignedUp) {
+	if h.statuses == nil {
+		return
+	}
+	pending := StepStatus{State: StepPending, UpdatedAt: event.OccurredAt}
+	status := SignUpStatus{
+		SignUpID:     event.EventID,
+		Email:        event.User.Email,
+		CreatedAt:    event.OccurredAt,
+		Notification: pending,
+		Newsletter:   pending,
+	}
+	if !event.User.MarketingConsent {
+		status.Newsletter.State = StepSkipped
+	}
+	if err := h.statuses.Create(status); err != nil {
+		log.Printf("failed to record sign-up %s: %v", event.EventID, err)
+	}
+}
+
+// recordAccount records whether the account of a sign-up was created.
+func (h Handler) recordAccount(signUpID string, err error) {
+	h.updateStatus(signUpID, func(status *SignUpStatus) {
+		status.AccountCreated = err == nil
+		if err != nil {
+			status.AccountError = err.Error()
+		}
+	})
+}
+
+// recordAttempt records one attempt at a step.
+func (h Handler) recordAttempt(signUpID string, step Step, err error) {
+	h.updateStatus(signUpID, func(status *SignUpStatus) {
+		s := status.step(step)
+		if s == nil {
+			return
+		}
+		s.Attempts++
+		s.UpdatedAt = time.Now()
+		switch {
+		case err != nil:
+			s.State = StepPending
+			s.LastError = err.Error()
+		case step == StepNotification:
+			s.State = StepSent
+		default:
+			s.State = StepAdded
+		}
+	})
+}
+
+// recordSkipped records that a step was skipped.
+func (h Handler) recordSkipped(signUpID string, step Step) {
+	h.updateStatus(signUpID, func(status *SignUpStatus) {
+		if s := status.step(step); s != nil {
+			s.State = StepSkipped
+			s.UpdatedAt = time.Now()
+		}
+	})
+}
+
+// recordFailed records that a step was dead-lettered.
+func (h Handler) recordFailed(signUpID string, step Step) {
+	h.updateStatus(signUpID, func(status *SignUpStatus) {
+		if s := status.step(step); s != nil {
+			s.State = StepFailed
+			s.UpdatedAt = time.Now()
+		}
+	})
+}
+
+func (h Handler) updateStatus(signUpID string, update func(*SignUpStatus)) {
+	if h.statuses == nil || signUpID == "" {
+		return
+	}
+	// Sign-ups from before the status store, or recorded elsewhere, aren't tracked.
+	if err := h.statuses.Update(signUpID, update); err != nil && !errors.Is(err, ErrSignUpNotFound) {
+		log.Printf("failed to record status of sign-up %s: %v", signUpID, err)
+	}
+}
+
+// NewStatusHTTPHandler is a constructor for the HTTP API of sign-up statuses:
+//
+//	GET /signups/{id}         the status of a sign-up
+//	GET /signups?email=EMAIL  the status of the latest sign-up of a user
+func NewStatusHTTPHandler(store StatusStore) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /signups/{id}", func(w http.ResponseWriter, r *http.Request) {
+		status, err := store.Get(r.PathValue("id"))
+		writeStatus(w, status, err)
+	})
+	mux.HandleFunc("GET /signups", func(w http.ResponseWriter, r *http.Request) {
+		email := r.URL.Query().Get("email")
+		if email == "" {
+			writeJSONError(w, http.StatusBadRequest, "the email query parameter is required")
+			return
+		}
+		status, err := store.Latest(email)
+		writeStatus(w, status, err)
+	})
+	return mux
+}
+
+func writeStatus(w http.ResponseWriter, status SignUpStatus, err error) {
+	switch {
+	case errors.Is(err, ErrSignUpNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	case err != nil:
+		log.Printf("failed to get sign-up status: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to get sign-up status")
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/stretchr/testify/assert"
+)
+
+func getStatus(t *testing.T, handler http.Handler, target string) (int, SignUpStatus) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+
+	var status SignUpStatus
+	if rec.Code == http.StatusOK {
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	}
+	return rec.Code, status
+}
+
+func TestSignUpStatus(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("tracks the steps of a sign-up", func(t *testing.T) {
+		store := NewMemoryStatusStore()
+		handler := NewHandler(MockRepository{}, &countingClient{failures: 100}, &countingClient{failures: 1}).
+			WithRetryPolicy(fastRetryPolicy(2)).
+			WithStatusStore(store)
+		api := NewStatusHTTPHandler(store)
+
+		assert.NoError(t, handler.SignUp(User{Email: "ada@example.com", MarketingConsent: true}))
+		assert.NoError(t, handler.Shutdown(ctx))
+
+		code, status := getStatus(t, api, "/signups?email=Ada@Example.com")
+		assert.Equal(t, http.StatusOK, code)
+		assert.True(t, status.AccountCreated)
+		assert.Equal(t, StepSent, status.Notification.State)
+		assert.Equal(t, 2, status.Notification.Attempts)
+		assert.Equal(t, StepFailed, status.Newsletter.State)
+		assert.Equal(t, 2, status.Newsletter.Attempts)
+		assert.Equal(t, "service unavailable", status.Newsletter.LastError)
+
+		code, byID := getStatus(t, api, "/signups/"+status.SignUpID)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, status, byID)
+
+		letters, err := handler.DeadLetters()
+		assert.NoError(t, err)
+		assert.Equal(t, status.SignUpID, letters[0].SignUpID)
+	})
+
+	t.Run("finds an internationalised email", func(t *testing.T) {
+		store := NewMemoryStatusStore()
+		handler := NewHandler(MockRepository{}, &countingClient{}, &countingClient{}).WithStatusStore(store)
+		api := NewStatusHTTPHandler(store)
+
+		assert.NoError(t, handler.SignUp(User{Email: "ada@bücher.example"}))
+		assert.NoError(t, handler.Shutdown(ctx))
+
+		code, status := getStatus(t, api, "/signups?email="+url.QueryEscape("ada@BÜCHER.example"))
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "ada@xn--bcher-kva.example", status.Email)
+	})
+
+	t.Run("records a failed account", func(t *testing.T) {
+		store := NewMemoryStatusStore()
+		handler := NewHandler(&countingRepository{failures: 1}, &countingClient{}, &countingClient{}).WithStatusStore(store)
+
+		assert.Error(t, handler.SignUp(User{Email: "ada@example.com", MarketingConsent: true}))
+		status, err := store.Latest("ada@example.com")
+		assert.NoError(t, err)
+		assert.False(t, status.AccountCreated)
+		assert.Equal(t, "database unavailable", status.AccountError)
+		assert.Equal(t, StepPending, status.Newsletter.State)
+	})
+
+	t.Run("tracks steps run by consumers of the outbox", func(t *testing.T) {
+		repository := newSQLiteUserRepository(t)
+		store := NewMemoryStatusStore()
+		pubSub := gochannel.NewGoChannel(gochannel.Config{Persistent: true}, watermill.NopLogger{})
+		defer pubSub.Close()
+
+		handler := NewHandler(repository, &countingClient{}, &countingClient{}).WithOutbox().WithStatusStore(store)
+		consumeCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go handler.Consume(consumeCtx, pubSub, ConsumerConfig{Step: StepNewsletter, Retry: fastRetryPolicy(3)})
+		go handler.Consume(consumeCtx, pubSub, ConsumerConfig{Step: StepNotification, Retry: fastRetryPolicy(3)})
+
+		assert.NoError(t, handler.SignUp(User{Email: "ada@example.com", MarketingConsent: true}))
+		_, err := NewOutboxRelay(repository, pubSub, OutboxRelayOptions{}).RelayOnce(ctx)
+		assert.NoError(t, err)
+
+		assert.Eventually(t, func() bool {
+			status, err := store.Latest("ada@example.com")
+			return err == nil && status.Newsletter.State == StepAdded && status.Notification.State == StepSent
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("answers unknown sign-ups and bad requests", func(t *testing.T) {
+		api := NewStatusHTTPHandler(NewMemoryStatusStore())
+
+		code, _ := getStatus(t, api, "/signups/missing")
+		assert.Equal(t, http.StatusNotFound, code)
+		code, _ = getStatus(t, api, "/signups?email=nobody@example.com")
+		assert.Equal(t, http.StatusNotFound, code)
+		code, _ = getStatus(t, api, "/signups")
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+}
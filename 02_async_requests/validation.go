@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/language"
+)
+
+// ErrInvalidUser is matched by every ValidationError.
+var ErrInvalidUser = errors.New("invalid user")
+
+// Codes of FieldError.
+const (
+	CodeRequired    = "required"
+	CodeInvalid     = "invalid"
+	CodeTooLong     = "too_long"
+	CodeDisposable  = "disposable"
+	CodeUnsupported = "unsupported"
+)
+
+// maxNameLength is the longest name accepted, in characters.
+const maxNameLength = 100
+
+// SignUpSource is where a user signed up.
+type SignUpSource string
+
+const (
+	SourceWeb     SignUpSource = "web"
+	SourceMobile  SignUpSource = "mobile"
+	SourceAPI     SignUpSource = "api"
+	SourcePartner SignUpSource = "partner"
+)
+
+// DefaultDisposableDomains are well-known disposable email providers, refused by
+// the default UserValidator. Subdomains are refused too.
+var DefaultDisposableDomains = []string{
+	"10minutemail.com",
+	"guerrillamail.com",
+	"mailinator.com",
+	"sharklasers.com",
+	"temp-mail.org",
+	"throwawaymail.com",
+	"trashmail.com",
+	"yopmail.com",
+}
+
+// FieldError describes what is wrong with one field of a User.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned for a User that can't sign up. It lists every field
+// that failed, so a form can show all problems at once.
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		problems[i] = f.Field + ": " + f.Message
+	}
+	return fmt.Sprintf("%v: %s", ErrInvalidUser, strings.Join(problems, "; "))
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidUser
+}
+
+func (e *ValidationError) add(field, code, format string, args ...any) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+// UserValidator validates and normalises users before they sign up.
+type UserValidator struct {
+	disposable map[string]bool
+}
+
+// NewUserValidator is a constructor for the UserValidator struct. Emails at
+// disposableDomains, or their subdomains, are refused.
+func NewUserValidator(disposableDomains []string) UserValidator {
+	disposable := make(map[string]bool, len(disposableDomains))
+	for _, domain := range disposableDomains {
+		disposable[strings.ToLower(domain)] = true
+	}
+	return UserValidator{disposable: disposable}
+}
+
+// Validate returns u normalised, or a *ValidationError listing every invalid field:
+//
+//   - Email is required and must be a single RFC 5322 address without a display
+//     name. Its domain is converted to lower-case ASCII, so internationalised
+//     domain names compare equal in either form. Disposable domains are refused.
+//   - Name is optional, trimmed, at most 100 characters and without control characters.
+//   - Locale is optional and must be a BCP 47 language tag, e.g. "en-GB". It is canonicalised.
+//   - Source is optional and must be one of the SignUpSource values.
+func (v UserValidator) Validate(u User) (User, error) {
+	verr := &ValidationError{}
+
+	u.Email = v.email(strings.TrimSpace(u.Email), verr)
+
+	u.Name = strings.TrimSpace(u.Name)
+	switch {
+	case utf8.RuneCountInString(u.Name) > maxNameLength:
+		verr.add("name", CodeTooLong, "must be at most %d characters", maxNameLength)
+	case strings.IndexFunc(u.Name, unicode.IsControl) >= 0:
+		verr.add("name", CodeInvalid, "must not contain control characters")
+	}
+
+	if u.Locale = strings.TrimSpace(u.Locale); u.Locale != "" {
+		tag, err := language.Parse(u.Locale)
+		if err != nil {
+			verr.add("locale", CodeInvalid, "%q is not a BCP 47 language tag", u.Locale)
+		} else {
+			u.Locale = tag.String()
+		}
+	}
+
+	switch u.Source {
+	case "", SourceWeb, SourceMobile, SourceAPI, SourcePartner:
+	default:
+		verr.add("source", CodeUnsupported, "unknown sign-up source %q", u.Source)
+	}
+
+	if len(verr.Fields) > 0 {
+		return u, verr
+	}
+	return u, nil
+}
+
+func (v UserValidator) email(email string, verr *ValidationError) string {
+	if email == "" {
+		verr.add("email", CodeRequired, "is required")
+		return email
+	}
+
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Name != "" || strings.ContainsAny(email, "<>") {
+		verr.add("email", CodeInvalid, "%q is not a valid email address", email)
+		return email
+	}
+
+	at := strings.LastIndex(address.Address, "@")
+	local, domain := address.Address[:at], address.Address[at+1:]
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil || !strings.Contains(ascii, ".") {
+		verr.add("email", CodeInvalid, "%q is not a valid email domain", domain)
+		return email
+	}
+	ascii = strings.ToLower(ascii)
+
+	for d := ascii; d != ""; {
+		if v.disposable[d] {
+			verr.add("email", CodeDisposable, "disposable email addresses at %s are not accepted", d)
+			break
+		}
+		_, d, _ = strings.Cut(d, ".")
+	}
+	return quoteLocalPart(local) + "@" + ascii
+}
+
+// quoteLocalPart puts back the quotes that mail.ParseAddress removes from a local
+// part such as "john doe", so the address stays valid.
+func quoteLocalPart(local string) string {
+	if isDotAtom(local) {
+		return local
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range local {
+		if r == '"' || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// isDotAtom reports whether local can be written without quotes (RFC 5322).
+// Non-ASCII characters are allowed, as in RFC 6531.
+func isDotAtom(local string) bool {
+	for _, atom := range strings.Split(local, ".") {
+		if atom == "" {
+			return false
+		}
+		for _, r := range atom {
+			if r < utf8.RuneSelf && !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", r) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// WithUserValidator returns a copy of the handler that validates users with validator.
+func (h Handler) WithUserValidator(validator UserValidator) Handler {
+	h.validator = validator
+	return h
+}
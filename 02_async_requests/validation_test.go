@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserValidator(t *testing.T) {
+	validator := NewUserValidator(DefaultDisposableDomains)
+
+	t.Run("normalises a valid user", func(t *testing.T) {
+		u, err := validator.Validate(User{
+			Email:  " Ada@BÜCHER.example ",
+			Name:   "  Ada Lovelace ",
+			Locale: "en-gb",
+			Source: SourceWeb,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "Ada@xn--bcher-kva.example", u.Email)
+		assert.Equal(t, "Ada Lovelace", u.Name)
+		assert.Equal(t, "en-GB", u.Locale)
+	})
+
+	t.Run("keeps a quoted local part quoted", func(t *testing.T) {
+		u, err := validator.Validate(User{Email: `"john doe"@example.com`})
+		assert.NoError(t, err)
+		assert.Equal(t, `"john doe"@example.com`, u.Email)
+
+		u, err = validator.Validate(User{Email: `"john.doe"@example.com`})
+		assert.NoError(t, err)
+		assert.Equal(t, "john.doe@example.com", u.Email)
+	})
+
+	tests := []struct {
+		name  string
+		user  User
+		field string
+		code  string
+	}{
+		{"missing email", User{}, "email", CodeRequired},
+		{"malformed email", User{Email: "ada.example.com"}, "email", CodeInvalid},
+		{"display name", User{Email: "Ada <ada@example.com>"}, "email", CodeInvalid},
+		{"several addresses", User{Email: "ada@example.com, grace@example.com"}, "email", CodeInvalid},
+		{"domain without a dot", User{Email: "ada@localhost"}, "email", CodeInvalid},
+		{"disposable domain", User{Email: "ada@Mailinator.com"}, "email", CodeDisposable},
+		{"disposable subdomain", User{Email: "ada@eu.yopmail.com"}, "email", CodeDisposable},
+		{"control characters in name", User{Email: "ada@example.com", Name: "Ada\x00"}, "name", CodeInvalid},
+		{"long name", User{Email: "ada@example.com", Name: string(make([]rune, 101))}, "name", CodeTooLong},
+		{"invalid locale", User{Email: "ada@example.com", Locale: "english please"}, "locale", CodeInvalid},
+		{"unknown source", User{Email: "ada@example.com", Source: "fax"}, "source", CodeUnsupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := validator.Validate(tt.user)
+			assert.ErrorIs(t, err, ErrInvalidUser)
+
+			var verr *ValidationError
+			if assert.True(t, errors.As(err, &verr)) && assert.Len(t, verr.Fields, 1) {
+				assert.Equal(t, tt.field, verr.Fields[0].Field)
+				assert.Equal(t, tt.code, verr.Fields[0].Code)
+			}
+		})
+	}
+
+	t.Run("reports every invalid field", func(t *testing.T) {
+		_, err := validator.Validate(User{Locale: "??", Source: "fax"})
+
+		var verr *ValidationError
+		if assert.True(t, errors.As(err, &verr)) {
+			assert.Len(t, verr.Fields, 3)
+		}
+	})
+}
+
+func TestSignUpValidation(t *testing.T) {
+	t.Run("refuses an invalid user before creating the account", func(t *testing.T) {
+		repository := &countingRepository{}
+		handler := NewHandler(repository, &countingClient{}, &countingClient{})
+
+		assert.ErrorIs(t, handler.SignUp(User{Email: ""}), ErrInvalidUser)
+		assert.Empty(t, repository.accounts)
+	})
+
+	t.Run("skips the newsletter without marketing consent", func(t *testing.T) {
+		repository := &countingRepository{}
+		newsletter, notifications := &countingClient{}, &countingClient{}
+		store := NewMemoryStatusStore()
+		handler := NewHandler(repository, newsletter, notifications).WithStatusStore(store)
+
+		assert.NoError(t, handler.SignUp(User{Email: "ada@EXAMPLE.com", Locale: "fr-ca"}))
+		assert.NoError(t, handler.Shutdown(context.Background()))
+
+		assert.Equal(t, 0, newsletter.Calls())
+		assert.Equal(t, 1, notifications.Calls())
+		assert.Equal(t, []User{{Email: "ada@example.com", Locale: "fr-CA"}}, repository.accounts)
+
+		status, err := store.Latest("ada@example.com")
+		assert.NoError(t, err)
+		assert.Equal(t, StepSkipped, status.Newsletter.State)
+		assert.Equal(t, StepSent, status.Notification.State)
+	})
+}